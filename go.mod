@@ -4,10 +4,12 @@ go 1.20
 
 require (
 	github.com/andybalholm/brotli v1.0.5
-	github.com/klauspost/compress v1.16.7
+	github.com/klauspost/compress v1.17.9
+	github.com/pierrec/lz4/v4 v4.1.18
 	github.com/pkg/errors v0.9.1
 	github.com/pkg/xattr v0.4.9
 	github.com/spf13/cobra v1.7.0
+	github.com/ulikunitz/xz v0.5.11
 )
 
 require (
@@ -20,7 +22,7 @@ require (
 require (
 	github.com/davecgh/go-spew v1.1.1
 	github.com/x448/float16 v0.8.4 // indirect
-	golang.org/x/sys v0.10.0 // indirect
+	golang.org/x/sys v0.10.0
 )
 
 require (
@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/indrora/ponzu/ponzu/compression"
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/indrora/ponzu/ponzu/writer"
+)
+
+var ErrCompressionRule = errors.New("invalid compression rule")
+
+// zstdLevels are the named zstd levels, on the zstd command line's scale.
+var zstdLevels = map[string]int{
+	"fastest": 1,
+	"default": 3,
+	"better":  7,
+	"best":    11,
+}
+
+// compressRule says how to compress the files that match a pattern.
+type compressRule struct {
+	// Empty matches every file
+	pattern     string
+	compression format.CompressionType
+	options     writer.CompressionOptions
+}
+
+// parseCompressRule parses a rule of the form [PATTERN=]ALGORITHM[:LEVEL][,OPTION...].
+//
+// Patterns without a slash are matched against the base name of the file, and those
+// with one against the whole path in the archive. The algorithm is none, zstd, brotli,
+// lz4, xz or deflate. zstd takes a level of 1 to 22 or fastest, default, better or best,
+// and the option long; the encoder has only four speeds, for levels 1-2, 3-5, 6-9 and
+// 10-22. brotli takes a quality of 1 to 11 and the option window=10 to 24; lz4 and
+// deflate take a level of 1 to 9. Codecs registered by name in the compression package
+// can be used too, without a level or options.
+func parseCompressRule(rule string) (compressRule, error) {
+	// brotli's window=N has an equals sign of its own, so try the rule without a
+	// pattern first.
+	compression, options, err := parseCompression(rule)
+	if err == nil {
+		return compressRule{compression: compression, options: options}, nil
+	}
+
+	pattern, spec, ok := strings.Cut(rule, "=")
+	if !ok {
+		return compressRule{}, fmt.Errorf("%w %q: %v", ErrCompressionRule, rule, err)
+	}
+	if pattern == "" || !doublestar.ValidatePattern(pattern) {
+		return compressRule{}, fmt.Errorf("%w %q: bad pattern", ErrCompressionRule, rule)
+	}
+	if compression, options, err = parseCompression(spec); err != nil {
+		return compressRule{}, fmt.Errorf("%w %q: %v", ErrCompressionRule, rule, err)
+	}
+	return compressRule{pattern: pattern, compression: compression, options: options}, nil
+}
+
+// parseCompression parses ALGORITHM[:LEVEL][,OPTION...].
+func parseCompression(spec string) (format.CompressionType, writer.CompressionOptions, error) {
+	options := writer.CompressionOptions{}
+
+	fields := strings.Split(spec, ",")
+	name, level, hasLevel := strings.Cut(fields[0], ":")
+
+	var ctype format.CompressionType
+	switch name {
+	case "none":
+		if hasLevel || len(fields) > 1 {
+			return 0, options, errors.New("none takes no level or options")
+		}
+		return format.COMPRESSION_NONE, options, nil
+	case "zstd":
+		ctype = format.COMPRESSION_ZSTD
+		if n, ok := zstdLevels[level]; ok {
+			options.Level = n
+		} else if hasLevel {
+			n, err := strconv.Atoi(level)
+			if err != nil || n < 1 || n > 22 {
+				return 0, options, fmt.Errorf("zstd level %q is not 1 to 22 or one of fastest, default, better or best", level)
+			}
+			options.Level = n
+		}
+	case "brotli":
+		ctype = format.COMPRESSION_BROTLI
+		if hasLevel {
+			n, err := strconv.Atoi(level)
+			if err != nil || n < 1 || n > 11 {
+				return 0, options, fmt.Errorf("brotli quality %q is not 1 to 11", level)
+			}
+			options.Level = n
+		}
+	case "lz4", "deflate":
+		ctype = format.COMPRESSION_LZ4
+		if name == "deflate" {
+			ctype = format.COMPRESSION_DEFLATE
+		}
+		if hasLevel {
+			n, err := strconv.Atoi(level)
+			if err != nil || n < 1 || n > 9 {
+				return 0, options, fmt.Errorf("%v level %q is not 1 to 9", name, level)
+			}
+			options.Level = n
+		}
+	case "xz":
+		if hasLevel || len(fields) > 1 {
+			return 0, options, errors.New("xz takes no level or options")
+		}
+		return format.COMPRESSION_XZ, options, nil
+	default:
+		// Codecs registered by the application take no level or options.
+		ctype, _, ok := compression.ByName(name)
+		if !ok {
+			return 0, options, fmt.Errorf("unknown compression %q", name)
+		}
+		if hasLevel || len(fields) > 1 {
+			return 0, options, fmt.Errorf("%v takes no level or options", name)
+		}
+		return ctype, options, nil
+	}
+
+	for _, option := range fields[1:] {
+		key, value, _ := strings.Cut(option, "=")
+		switch {
+		case ctype == format.COMPRESSION_ZSTD && option == "long":
+			options.Long = true
+		case ctype == format.COMPRESSION_BROTLI && key == "window":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 10 || n > 24 {
+				return 0, options, fmt.Errorf("brotli window %q is not 10 to 24", value)
+			}
+			options.Window = n
+		default:
+			return 0, options, fmt.Errorf("unknown option %q for %v", option, name)
+		}
+	}
+
+	return ctype, options, nil
+}
+
+// matches reports whether a file in the archive falls under the rule.
+func (rule compressRule) matches(archivePath string) bool {
+	if rule.pattern == "" {
+		return true
+	}
+	archivePath = path.Clean(archivePath)
+	if !strings.Contains(rule.pattern, "/") {
+		archivePath = path.Base(archivePath)
+	}
+	ok, _ := doublestar.Match(rule.pattern, archivePath)
+	return ok
+}
+
+// pickCompression finds the last rule that matches a file.
+func pickCompression(rules []compressRule, archivePath string) (compressRule, bool) {
+	for i := len(rules) - 1; i >= 0; i-- {
+		if rules[i].matches(archivePath) {
+			return rules[i], true
+		}
+	}
+	return compressRule{}, false
+}
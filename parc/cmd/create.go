@@ -5,16 +5,19 @@ package cmd
 
 import (
 	"bytes"
+	"crypto/ecdh"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 
 	"github.com/indrora/ponzu/ponzu/format"
 	"github.com/indrora/ponzu/ponzu/writer"
 	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ed25519"
 
 	"github.com/bmatcuk/doublestar/v4"
 )
@@ -67,6 +70,48 @@ func createMain(cmd *cobra.Command, args []string) {
 	comment, _ := cmd.Flags().GetString("comment")
 	relroot, _ := cmd.Flags().GetString("chdir")
 
+	if cmd.Flags().Changed("train-dict") && cmd.Flags().Changed("zstandard-dictionary") {
+		cmd.PrintErrln("--train-dict and --zstandard-dictionary can't be used together")
+		return
+	}
+
+	var signKey ed25519.PrivateKey
+	if keyPath, _ := cmd.Flags().GetString("sign-key"); keyPath != "" {
+		key, err := loadPrivateKey(keyPath)
+		if err != nil {
+			cmd.PrintErrln(err)
+			return
+		}
+		signKey = key
+	}
+
+	passphrase, err := passphraseFlag()
+	if err != nil {
+		cmd.PrintErrln(err)
+		return
+	}
+	var recipients []*ecdh.PublicKey
+	recipientPaths, _ := cmd.Flags().GetStringArray("recipient")
+	for _, path := range recipientPaths {
+		recipient, err := loadRecipient(path)
+		if err != nil {
+			cmd.PrintErrln(err)
+			return
+		}
+		recipients = append(recipients, recipient)
+	}
+
+	rules := make([]compressRule, 0)
+	ruleFlags, _ := cmd.Flags().GetStringArray("compress")
+	for _, flag := range ruleFlags {
+		rule, err := parseCompressRule(flag)
+		if err != nil {
+			cmd.PrintErrln(err)
+			return
+		}
+		rules = append(rules, rule)
+	}
+
 	files := make(map[string]string)
 
 	if verbose {
@@ -91,11 +136,60 @@ func createMain(cmd *cobra.Command, args []string) {
 	}
 	defer fhandle.Close()
 	writer := writer.NewWriter(fhandle, (*BuffSize)*format.BLOCK_SIZE)
+	writer.WriteIndex, _ = cmd.Flags().GetBool("index")
+	writer.Parity, _ = cmd.Flags().GetInt("parity")
+	writer.ParityShards, _ = cmd.Flags().GetInt("parity-shards")
+	writer.Jobs = *Jobs
+	writer.SpoolSize = (*SpoolSize) * int(format.BLOCK_SIZE)
+	writer.SignKey = signKey
+	writer.Passphrase = passphrase
+	writer.Recipients = recipients
+	forceCompress, _ := cmd.Flags().GetBool("force-compress")
+	writer.SkipIncompressible = !forceCompress
+	writer.Uncompressed = func(name string, reason string) {
+		if verbose {
+			fmt.Printf("Not compressing %v: %v\n", name, reason)
+		}
+	}
+	if writer.Jobs <= 0 {
+		writer.Jobs = runtime.NumCPU()
+	}
 
-	writer.AppendStart(prefix, comment)
+	if err := writer.AppendStart(prefix, comment); err != nil {
+		cmd.PrintErr(err)
+		return
+	}
+
+	archive_files := make([]string, 0, len(files))
+	for k := range files {
+		archive_files = append(archive_files, k)
+	}
+	// sort the keys for deterministic output
+	sort.Strings(archive_files)
 
 	zstdDict, _ := cmd.Flags().GetString("zstandard-dictionary")
-	if zstdDict != "" {
+	trainDict, _ := cmd.Flags().GetBool("train-dict")
+	if trainDict {
+		dictSize, _ := cmd.Flags().GetInt("dict-size")
+		paths := make([]string, 0, len(archive_files))
+		for _, k := range archive_files {
+			paths = append(paths, files[k])
+		}
+
+		dict, err := trainDictionary(paths, dictSize)
+		if err != nil {
+			// The archive is still fine without one.
+			cmd.PrintErrln("Not using a dictionary:", err)
+		} else {
+			if verbose {
+				fmt.Printf("Trained a %d byte dictionary on %d files\n", len(dict), len(paths))
+			}
+			if err = writer.AppendZstdDict(dict); err != nil {
+				cmd.PrintErr(err)
+				return
+			}
+		}
+	} else if zstdDict != "" {
 		// try and open the file
 		dict, err := os.Open(zstdDict)
 		if err != nil {
@@ -111,22 +205,22 @@ func createMain(cmd *cobra.Command, args []string) {
 		dictBytes := buff.Bytes()
 
 		dict.Close()
-		writer.AppendZstdDict(dictBytes)
+		if err = writer.AppendZstdDict(dictBytes); err != nil {
+			cmd.PrintErr(err)
+			return
+		}
 	}
 
-	archive_files := make([]string, 0, len(files))
-	for k := range files {
-		archive_files = append(archive_files, k)
-	}
-	// sort the keys for deterministic output
-	sort.Strings(archive_files)
+	// The first path found for a file with several links gets the body; the rest
+	// become hardlinks to it.
+	linked := make(map[inode]string)
 
 	for _, archiveFilePath := range archive_files {
 		localFilePath := files[archiveFilePath]
 
 		fmt.Printf("%s -> %v\n", archiveFilePath, localFilePath)
 
-		mask := os.ModeDir | os.ModeSymlink
+		mask := os.ModeDir | os.ModeSymlink | os.ModeNamedPipe | os.ModeSocket | os.ModeDevice | os.ModeCharDevice
 
 		statn, err := os.Lstat(localFilePath)
 		if err == nil {
@@ -135,7 +229,7 @@ func createMain(cmd *cobra.Command, args []string) {
 				if verbose {
 					fmt.Println("Directory")
 				}
-				writer.AppendDirectory(archiveFilePath, statn)
+				writer.AppendDirectory(archiveFilePath, localFilePath, statn)
 			case os.ModeSymlink:
 				linkinfo, err := os.Readlink(localFilePath)
 				if err != nil {
@@ -144,26 +238,54 @@ func createMain(cmd *cobra.Command, args []string) {
 					if verbose {
 						fmt.Printf("Symlink to %v\n", linkinfo)
 					}
-					writer.AppendSymlink(archiveFilePath, linkinfo, statn)
+					writer.AppendSymlink(archiveFilePath, localFilePath, linkinfo, statn)
+				}
+			case os.ModeNamedPipe, os.ModeSocket, os.ModeDevice, os.ModeDevice | os.ModeCharDevice:
+				if verbose {
+					fmt.Printf("Special file, mode=%v\n", statn.Mode())
+				}
+				if err = writer.AppendSpecial(archiveFilePath, localFilePath, statn); err != nil {
+					cmd.PrintErrf("Failed to add special file %v: %v\n", localFilePath, err)
 				}
 			default:
+				if id, ok := fileInode(statn); ok {
+					if target, seen := linked[id]; seen {
+						if verbose {
+							fmt.Printf("Hardlink to %v\n", target)
+						}
+						if err = writer.AppendHardlink(archiveFilePath, localFilePath, target, statn); err != nil {
+							cmd.PrintErr(err)
+							return
+						}
+						continue
+					}
+					linked[id] = archiveFilePath
+				}
+
 				if verbose {
 					fmt.Printf("Regular file, size=%v, modtime=%v\n", statn.Size(), statn.ModTime())
 				}
 
+				// A rule that matches is followed whatever the size of the file; without
+				// one, files of a block or less aren't worth compressing.
 				compression := format.COMPRESSION_NONE
-				if !*NoCompress && statn.Size() > int64(format.BLOCK_SIZE) {
+				rule, picked := pickCompression(rules, archiveFilePath)
+				if picked {
+					compression = rule.compression
+					if verbose {
+						fmt.Printf("Compression %v, options %+v\n", compression, rule.options)
+					}
+				} else if !*NoCompress && statn.Size() > int64(format.BLOCK_SIZE) {
 					if *UseBrotli {
 						compression = format.COMPRESSION_BROTLI
 					} else {
 						compression = format.COMPRESSION_ZSTD
 					}
-				} else {
-					if verbose {
-						fmt.Println("File is smaller than single block, not compressing.")
-					}
+				} else if verbose && !*NoCompress {
+					fmt.Println("File is smaller than single block, not compressing.")
 				}
 
+				writer.CompressionOptions = rule.options
 				if err = writer.AppendFile(archiveFilePath, localFilePath, compression, statn); err != nil {
 					cmd.PrintErr(err)
 					return
@@ -173,7 +295,9 @@ func createMain(cmd *cobra.Command, args []string) {
 			cmd.PrintErrf("Failed to stat file: %v", err)
 		}
 	}
-	writer.AppendEnd()
+	if err = writer.AppendEnd(); err != nil {
+		cmd.PrintErr(err)
+	}
 	fhandle.Close()
 
 }
@@ -206,17 +330,31 @@ Depending on your shell, you may have to enclose globbing patterns in single quo
 }
 
 var BuffSize *uint64
+var SpoolSize *int
 var UseBrotli *bool
 var NoCompress *bool
+var Jobs *int
 var verbose bool
 
 func init() {
 	rootCmd.AddCommand(createCmd)
 	createCmd.Flags().String("comment", "", "Add comment to archive")
 	createCmd.Flags().String("prefix", "", "Archive prefix")
-	BuffSize = createCmd.Flags().Uint64("buff-size", 5000, "Number of blocks to read into memory at once (default 5000, 2GB)")
+	BuffSize = createCmd.Flags().Uint64("buff-size", 5000, "Number of blocks of a file to take in before writing it out, half to each record (5000 is about 20MB)")
+	SpoolSize = createCmd.Flags().Int("spool-size", writer.DefaultSpoolSize/int(format.BLOCK_SIZE), "Number of blocks of each record to keep in memory; the rest goes to a temporary file")
 	createCmd.Flags().String("chdir", ".", "Search this path to find relative paths")
 	NoCompress = createCmd.Flags().Bool("no-compress", false, "Disable compression")
+	createCmd.Flags().Bool("force-compress", false, "Compress files even if they do not get any smaller")
 	UseBrotli = createCmd.Flags().Bool("brotli", false, "use Brotli compression vs. ZStandard")
 	createCmd.Flags().String("zstandard-dictionary", "", "Path to ZStandard Dictionary to use")
+	createCmd.Flags().Bool("train-dict", false, "Train a ZStandard dictionary on the files being archived and use it")
+	createCmd.Flags().Int("dict-size", 110*1024, "Largest dictionary to train with --train-dict, in bytes")
+	createCmd.Flags().StringArray("compress", nil, "Compress files matching a pattern with an algorithm and level, as [PATTERN=]none|zstd[:LEVEL][,long]|brotli[:QUALITY][,window=N]|lz4[:LEVEL]|xz|deflate[:LEVEL] (e.g. '*.log=zstd:19', '*.jpg=none'); the last rule that matches wins, even for files of a block or less. zstd levels map onto four encoder speeds: 1-2, 3-5, 6-9 and 10-22")
+	createCmd.Flags().String("sign-key", "", "Sign the archive with an Ed25519 private key, as PEM encoded PKCS #8 (see parc sign)")
+	createCmd.Flags().StringArray("recipient", nil, "Encrypt the archive for an X25519 public key, as PEM encoded PKIX; with --passphrase-file, a passphrase opens it too")
+	createCmd.Flags().Bool("index", false, "Write an index at the end of the archive for random access")
+	createCmd.Flags().Int("parity", 0, "Add a parity record after every so many blocks, so that parc repair can rebuild damaged blocks")
+	createCmd.Flags().Int("parity-shards", writer.DefaultParityShards, "Number of parity blocks for each stripe of up to 256 blocks with --parity; as many damaged blocks can be rebuilt in each")
+	Jobs = createCmd.Flags().IntP("jobs", "j", 1, "Number of records to compress at once (0 for one per CPU)")
+	createCmd.MarkFlagsMutuallyExclusive("no-compress", "compress")
 }
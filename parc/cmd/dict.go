@@ -0,0 +1,144 @@
+/*
+Copyright © 2022 Morgan Gangwere <morgan.gangwere@gmail.com>
+*/
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/indrora/ponzu/ponzu/reader"
+	"github.com/indrora/ponzu/ponzu/writer"
+	"github.com/spf13/cobra"
+)
+
+var ErrNoDictionary = errors.New("archive has no zstd dictionary")
+
+const (
+	// dictSampleSize is the most of any one file that a dictionary is trained on.
+	dictSampleSize = 128 * 1024
+	// dictTrainingSize is the most that a dictionary is trained on altogether.
+	dictTrainingSize = 64 * 1024 * 1024
+	// dictMinSamples is how many files it takes to be worth training on.
+	dictMinSamples = 8
+)
+
+// dictCmd represents the dict command
+var dictCmd = &cobra.Command{
+	Use:   "dict archive [output]",
+	Short: "Export the zstd dictionary from a Ponzu archive",
+	Long: `Export a zstd dictionary from an archive, such as one trained with
+parc create --train-dict, so that it can be used with other archives or tools.
+
+The dictionary is written to output, or to standard output if there is none.
+Archives can hold more than one dictionary; --number picks which, counting
+from 1.`,
+	RunE:         dictMain,
+	Args:         cobra.RangeArgs(1, 2),
+	SilenceUsage: true,
+}
+
+func dictMain(cmd *cobra.Command, args []string) error {
+	number, _ := cmd.Flags().GetInt("number")
+
+	fh, err := os.Open(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer fh.Close()
+
+	r := reader.NewReader(fh)
+	if err = unlock(r); err != nil {
+		return err
+	}
+	dict, found, err := findDictionary(r, number)
+	if err != nil {
+		return err
+	} else if dict == nil {
+		if found == 0 {
+			return ErrNoDictionary
+		}
+		return fmt.Errorf("%w numbered %d, only %d", ErrNoDictionary, number, found)
+	}
+
+	out := cmd.OutOrStdout()
+	if len(args) > 1 {
+		fout, err := os.Create(args[1])
+		if err != nil {
+			return err
+		}
+		defer fout.Close()
+		out = fout
+	}
+	_, err = out.Write(dict)
+	return err
+}
+
+// findDictionary returns the numbered dictionary in an archive, along with how many were
+// found getting to it.
+func findDictionary(r *reader.Reader, number int) ([]byte, int, error) {
+	found := 0
+	var last []byte
+	for {
+		_, _, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, found, nil
+		} else if err != nil {
+			return nil, found, err
+		}
+
+		// Dictionaries are taken in by the reader as it goes past them.
+		if dict := r.ZstdDict(); dict != nil && !bytes.Equal(dict, last) {
+			found++
+			if found == number {
+				return dict, found, nil
+			}
+			last = dict
+		}
+	}
+}
+
+// trainDictionary trains a zstd dictionary on the start of each of the regular files
+// given.
+func trainDictionary(paths []string, size int) ([]byte, error) {
+	samples := make([][]byte, 0, len(paths))
+	total := 0
+	for _, path := range paths {
+		if total >= dictTrainingSize {
+			break
+		}
+		info, err := os.Lstat(path)
+		if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+			continue
+		}
+
+		sample, err := readSample(path)
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, sample)
+		total += len(sample)
+	}
+
+	if len(samples) < dictMinSamples {
+		return nil, fmt.Errorf("only %d files to train a dictionary on, need at least %d", len(samples), dictMinSamples)
+	}
+	return writer.TrainZstdDict(samples, size)
+}
+
+func readSample(path string) ([]byte, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	return io.ReadAll(io.LimitReader(fh, dictSampleSize))
+}
+
+func init() {
+	rootCmd.AddCommand(dictCmd)
+	dictCmd.Flags().IntP("number", "n", 1, "Which dictionary to export, if there are several")
+}
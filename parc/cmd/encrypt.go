@@ -0,0 +1,92 @@
+/*
+Copyright © 2022 Morgan Gangwere <morgan.gangwere@gmail.com>
+*/
+package cmd
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/indrora/ponzu/ponzu/reader"
+)
+
+var ErrNotX25519Key = errors.New("not an X25519 key")
+
+// readPassphrase reads a passphrase from a file, without the line ending after it.
+func readPassphrase(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSuffix(data, []byte("\n"))
+	data = bytes.TrimSuffix(data, []byte("\r"))
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%v: passphrase is empty", path)
+	}
+	return data, nil
+}
+
+// loadIdentity reads a PEM encoded PKCS #8 X25519 private key.
+func loadIdentity(path string) (*ecdh.PrivateKey, error) {
+	der, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	if key, ok := key.(*ecdh.PrivateKey); ok && key.Curve() == ecdh.X25519() {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%v: %w", path, ErrNotX25519Key)
+}
+
+// loadRecipient reads a PEM encoded PKIX X25519 public key.
+func loadRecipient(path string) (*ecdh.PublicKey, error) {
+	der, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	if key, ok := key.(*ecdh.PublicKey); ok && key.Curve() == ecdh.X25519() {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%v: %w", path, ErrNotX25519Key)
+}
+
+// passphraseFlag reads the passphrase given with --passphrase-file, if there is one.
+func passphraseFlag() ([]byte, error) {
+	path, _ := rootCmd.PersistentFlags().GetString("passphrase-file")
+	if path == "" {
+		return nil, nil
+	}
+	return readPassphrase(path)
+}
+
+// unlock gives a reader the passphrase and identities from the command line, to open
+// encrypted archives with.
+func unlock(r *reader.Reader) error {
+	passphrase, err := passphraseFlag()
+	if err != nil {
+		return err
+	}
+	r.Passphrase = passphrase
+
+	paths, _ := rootCmd.PersistentFlags().GetStringArray("identity")
+	for _, path := range paths {
+		identity, err := loadIdentity(path)
+		if err != nil {
+			return err
+		}
+		r.Identities = append(r.Identities, identity)
+	}
+	return nil
+}
@@ -5,61 +5,110 @@ package cmd
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path"
+	"path/filepath"
+	"time"
 
 	"github.com/indrora/ponzu/ponzu/format"
 	"github.com/indrora/ponzu/ponzu/format/metadata"
 	"github.com/indrora/ponzu/ponzu/reader"
+	"github.com/indrora/ponzu/ponzu/sanitize"
 	"github.com/spf13/cobra"
 )
 
 var (
-	ErrMissingHeader = errors.New("archive is missing start control record")
-	ErrBadMetadata   = errors.New("failed to cast")
+	ErrMissingHeader  = errors.New("archive is missing start control record")
+	ErrBadMetadata    = errors.New("failed to cast")
+	ErrUnknownSpecial = errors.New("special file can't be made on this system")
+	ErrNeedsRoot      = errors.New("only root can make device nodes")
 )
 
 // extractCmd represents the extract command
 var extractCmd = &cobra.Command{
-	Use:   "extract",
-	Short: "Unwrap a Ponzu archive",
-	Long:  `Unwrap a given archive to the given path (default ".")`,
-	Run:   run,
-	Args:  cobra.ExactArgs(1),
+	Use:          "extract",
+	Short:        "Unwrap a Ponzu archive",
+	Long:         `Unwrap a given archive to the given path (default ".")`,
+	RunE:         run,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
 }
 
-func run(cmd *cobra.Command, args []string) {
+// dirTime is a directory whose modification time (and metadata) is restored once
+// everything inside of it has been written.
+type dirTime struct {
+	path    string
+	modTime time.Time
+	meta    any
+}
 
-	if len(args) != 1 {
-		cmd.PrintErrln("Expected 1 argument, got something else.")
-		return
-	}
-	fh, err := os.OpenFile(args[0], os.O_RDONLY, os.ModeExclusive)
+func run(cmd *cobra.Command, args []string) error {
+
+	verbose, _ := rootCmd.Flags().GetBool("verbose")
+	root, _ := cmd.Flags().GetString("root")
+	trust, _ := cmd.Flags().GetBool("trust-archive")
+	sameOwner, _ := cmd.Flags().GetBool("same-owner")
+	// Giving files away generally takes root, and root gets to do it unasked.
+	sameOwner = sameOwner || os.Geteuid() == 0
+	noSpecials, _ := cmd.Flags().GetBool("no-specials")
+	jobs, _ := cmd.Flags().GetInt("jobs")
+
+	fh, err := os.Open(args[0])
 	if err != nil {
-		cmd.PrintErrln("Failed to open file:", err)
+		return fmt.Errorf("failed to open archive: %w", err)
 	}
 	defer fh.Close()
 
-	r := reader.NewReader(fh)
+	r, err := newReader(fh, jobs)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer r.Close()
+	if err = unlock(r); err != nil {
+		return err
+	}
 
 	// Get information about the archive
 
 	var cSOA *format.StartOfArchive
+	var paths *sanitize.Sanitizer
 
 	// make sure it's nil at the start.
 	cSOA = nil
 
+	// directories get their mtimes put back at the very end, since writing into them changes it.
+	dirs := make([]dirTime, 0)
+
+	// Unsafe names are skipped over rather than ending the extraction.
+	skipUnsafe := func(err error) error {
+		if errors.Is(err, sanitize.ErrUnsafePath) || errors.Is(err, sanitize.ErrUnsafeLink) || errors.Is(err, sanitize.ErrLinkTraverse) {
+			cmd.PrintErrln("Skipping unsafe entry:", err)
+			return nil
+		}
+		return err
+	}
+
+	// Metadata that can't be put back is worth a warning, but not worth stopping for.
+	restore := func(dest string, raw any) {
+		meta := metadata.Decode(cSOA.Host, raw)
+		if err := metadata.Restore(dest, meta, sameOwner); err != nil {
+			cmd.PrintErrf("Failed to restore metadata on %v: %v\n", dest, err)
+		}
+	}
+
 	walkFun := func(p *format.Preamble, m any) error {
 
 		if cSOA == nil {
-			if p.Rtype != format.RECORD_TYPE_CONTROL && p.Flags != format.RECORD_FLAG_CONTROL_START {
+			if !p.IsStartOfArchive() {
 				return ErrMissingHeader
 			} else {
 				soa, ok := m.(*format.StartOfArchive)
 				if ok {
 					cSOA = soa
 					// patch up the prefix if we have a change
-					if forcedPrefix != nil {
+					if cmd.Flags().Changed("force-prefix") {
 						cmd.Println("Overriding prefix with " + *forcedPrefix)
 						cSOA.Prefix = *forcedPrefix
 					}
@@ -69,6 +118,12 @@ func run(cmd *cobra.Command, args []string) {
 				}
 			}
 
+			var err error
+			if paths, err = sanitize.New(root, cSOA.Prefix, trust); err != nil {
+				return err
+			}
+			cSOA.Prefix = paths.Prefix()
+
 			cmd.Printf("Unpacking archive (version %v) with prefix %v \n", cSOA.Version, cSOA.Prefix)
 
 		} else {
@@ -80,24 +135,82 @@ func run(cmd *cobra.Command, args []string) {
 				if !ok {
 					return ErrBadMetadata
 				}
-				finfo, ok := metadata.TransmogrifyCbor[metadata.CommonMetadata](fmeta.Metadata.(map[any]any))
-				if !ok {
-					return ErrBadMetadata
+				dest, err := paths.Resolve(fmeta.Name)
+				if err != nil {
+					return skipUnsafe(err)
+				}
+				if raw, ok := fmeta.Metadata.(map[any]any); ok && verbose {
+					if finfo, ok := metadata.TransmogrifyCbor[metadata.CommonMetadata](raw); ok && finfo.FileSize != nil {
+						cmd.Printf("%v (%v bytes)\n", path.Join(cSOA.Prefix, fmeta.Name), *finfo.FileSize)
+					}
+				} else {
+					cmd.Println(path.Join(cSOA.Prefix, fmeta.Name))
+				}
+				if err = extractFile(r, dest, fmeta.ModTime); err != nil {
+					return err
 				}
-				cmd.Printf("%v (%v bytes)\n", path.Join(cSOA.Prefix, fmeta.Name), *finfo.FileSize)
+				restore(dest, fmeta.Metadata)
 			case format.RECORD_TYPE_DIRECTORY:
 				dmeta, ok := m.(*format.Directory)
 				if !ok {
 					return ErrBadMetadata
 				}
+				dpath, err := paths.Resolve(dmeta.Name)
+				if err != nil {
+					return skipUnsafe(err)
+				}
 				cmd.Println(path.Join(cSOA.Prefix, dmeta.Name))
+				if err := os.MkdirAll(dpath, 0755); err != nil {
+					return err
+				}
+				dirs = append(dirs, dirTime{dpath, dmeta.ModTime, dmeta.Metadata})
+			case format.RECORD_TYPE_SYMLINK:
+				lmeta, ok := m.(*format.Symlink)
+				if !ok {
+					return ErrBadMetadata
+				}
+				dest, err := paths.ResolveSymlink(lmeta.Name, lmeta.Target)
+				if err != nil {
+					return skipUnsafe(err)
+				}
+				cmd.Printf("%v -> %v\n", path.Join(cSOA.Prefix, lmeta.Name), lmeta.Target)
+				if err = extractLink(os.Symlink, filepath.FromSlash(lmeta.Target), dest); err != nil {
+					return err
+				}
+				restore(dest, lmeta.Metadata)
+			case format.RECORD_TYPE_HARDLINK:
+				lmeta, ok := m.(*format.Hardlink)
+				if !ok {
+					return ErrBadMetadata
+				}
+				dest, err := paths.Resolve(lmeta.Name)
+				if err != nil {
+					return skipUnsafe(err)
+				}
+				// Hardlinks may only point at files that have already been extracted.
+				targetName, err := r.CheckHardlink(lmeta)
+				if err != nil {
+					cmd.PrintErrln("Skipping hardlink:", err)
+					return nil
+				}
+				target, err := paths.Resolve(targetName)
+				if err != nil {
+					return skipUnsafe(err)
+				}
+				cmd.Printf("%v => %v\n", path.Join(cSOA.Prefix, lmeta.Name), lmeta.Target)
+				return extractLink(os.Link, target, dest)
 			case format.RECORD_TYPE_CONTROL:
-				if p.Flags == format.RECORD_FLAG_CONTROL_START {
+				if p.IsStartOfArchive() {
 					cmd.PrintErrln("Encountered a start control record out of sequence.")
 					return ErrMissingHeader
 				}
-				if p.Flags == format.RECORD_FLAG_CONTROL_END {
-					cmd.Println("End of archive record found.")
+				if p.IsEndOfArchive() {
+					if verbose {
+						cmd.Println("End of archive record found.")
+					}
+					// Directories are finished with once their archive is.
+					restoreDirs(cmd, dirs, restore)
+					dirs = dirs[:0]
 					cSOA = nil
 					return nil
 				}
@@ -106,9 +219,25 @@ func run(cmd *cobra.Command, args []string) {
 				if !ok {
 					return ErrBadMetadata
 				}
-				cmd.Printf("%v (special, type=%v dev=%v mode=%v) \n", path.Join(cSOA.Prefix, smeta.Name), smeta.SpecialType, smeta.Device, smeta.Mode)
+				dest, err := paths.Resolve(smeta.Name)
+				if err != nil {
+					return skipUnsafe(err)
+				}
+				cmd.Printf("%v (special, type=%v dev=%v mode=%o) \n", path.Join(cSOA.Prefix, smeta.Name), smeta.SpecialType, smeta.Device, smeta.Mode)
+				if noSpecials {
+					return nil
+				}
+				if err = clearPath(dest); err == nil {
+					err = makeSpecial(dest, smeta)
+				}
+				if err != nil {
+					// Not being able to make one isn't reason enough to give up on the rest.
+					cmd.PrintErrf("Skipping special file %v: %v\n", dest, err)
+					return nil
+				}
+				restore(dest, smeta.Metadata)
 
-			case format.RECORD_TYPE_CONTINUE:
+			case format.RECORD_TYPE_CONTINUE, format.RECORD_TYPE_INDEX, format.RECORD_TYPE_SIGNATURE, format.RECORD_TYPE_PARITY:
 				return nil
 			default:
 				cmd.PrintErrln("Encountered unknown record type... skipping")
@@ -120,11 +249,74 @@ func run(cmd *cobra.Command, args []string) {
 	}
 
 	err = r.Walk(walkFun)
+	if cSOA != nil {
+		// The archive ended without an end record; put back what can be.
+		restoreDirs(cmd, dirs, restore)
+	}
+
+	return err
+}
+
+// restoreDirs puts back the metadata and modification times of directories. This is
+// done last, as writing into a directory changes its mtime, and its mode may not allow
+// writing into it at all.
+func restoreDirs(cmd *cobra.Command, dirs []dirTime, restore func(string, any)) {
+	// Deepest directories first, so that setting a parent's mtime is the last thing to touch it.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		restore(dirs[i].path, dirs[i].meta)
+		if err := os.Chtimes(dirs[i].path, dirs[i].modTime, dirs[i].modTime); err != nil {
+			cmd.PrintErrf("Failed to set modification time on %v: %v\n", dirs[i].path, err)
+		}
+	}
+}
+
+// extractFile writes the body of the current record (and any continuations) to dest.
+func extractFile(r *reader.Reader, dest string, modTime time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	// Never write through a link that is already sitting where the file goes.
+	if info, err := os.Lstat(dest); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err = os.Remove(dest); err != nil {
+			return err
+		}
+	}
 
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	if err = r.CopyAll(out, true); err != nil && !errors.Is(err, io.EOF) {
+		out.Close()
+		return fmt.Errorf("failed to extract %v: %w", dest, err)
 	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+
+	return os.Chtimes(dest, modTime, modTime)
+}
+
+// extractLink creates a link (hard or symbolic, depending on linker) at dest,
+// replacing anything that was already there.
+func extractLink(linker func(string, string) error, target string, dest string) error {
+	if err := clearPath(dest); err != nil {
+		return err
+	}
+	return linker(target, dest)
+}
 
+// clearPath makes way for something to be created at dest: the directories it goes
+// in are made, and whatever was there before is removed.
+func clearPath(dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(dest); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
 }
 
 var forcedPrefix *string
@@ -133,4 +325,8 @@ func init() {
 	rootCmd.AddCommand(extractCmd)
 	forcedPrefix = extractCmd.Flags().String("force-prefix", "", "Force the specified prefix")
 	extractCmd.Flags().String("root", "", "Extract to specified root path (in addition to prefix)")
+	extractCmd.Flags().Bool("trust-archive", false, "Trust the archive: allow absolute and parent paths and links that leave the root")
+	extractCmd.Flags().Bool("no-specials", false, "Skip FIFOs, sockets and device nodes")
+	extractCmd.Flags().IntP("jobs", "j", 1, "Number of records to decompress at once (0 for one per CPU)")
+	extractCmd.Flags().Bool("same-owner", false, "Restore the owner and group of files (the default when running as root)")
 }
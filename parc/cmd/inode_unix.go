@@ -0,0 +1,23 @@
+//go:build unix
+
+package cmd
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// inode identifies a file on disk, so that hardlinks to it can be spotted.
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// fileInode returns the inode of a file, if there is more than one link to it.
+func fileInode(info fs.FileInfo) (inode, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink < 2 {
+		return inode{}, false
+	}
+	return inode{uint64(stat.Dev), uint64(stat.Ino)}, true
+}
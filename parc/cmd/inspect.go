@@ -21,16 +21,20 @@ var inspectCmd = &cobra.Command{
 	Use:   "inspect",
 	Short: "Investigate the contents of a Ponzu archive",
 	Long: `Investigate and show the structure of the Ponzu archive,
-including compression information and similar. `,
+including compression information and similar.
+
+With --salvage, damaged records are skipped over rather than stopping there,
+and what was skipped is shown.`,
 	Run: func(cmd *cobra.Command, args []string) {
+		salvage, _ := cmd.Flags().GetBool("salvage")
 		for _, filename := range args {
-			inspectArchive(filename)
+			inspectArchive(filename, salvage)
 		}
 	},
 	Args: cobra.MinimumNArgs(1),
 }
 
-func inspectArchive(path string) {
+func inspectArchive(path string, salvage bool) {
 
 	verbose, _ := rootCmd.Flags().GetBool("verbose")
 
@@ -40,6 +44,22 @@ func inspectArchive(path string) {
 	}
 	defer fileh.Close()
 	archiveReader := reader.NewReader(fileh)
+	if salvage {
+		info, err := fileh.Stat()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		archiveReader = reader.NewReaderAt(fileh, info.Size())
+		archiveReader.Salvage = true
+		archiveReader.Skipped = func(skip reader.Skip) {
+			fmt.Printf("Skipped damaged bytes %d to %d: %v\n", skip.From, skip.To, skip.Err)
+		}
+	}
+	if err = unlock(archiveReader); err != nil {
+		fmt.Println(err)
+		return
+	}
 
 	err = nil
 	for !errors.Is(err, io.EOF) {
@@ -49,6 +69,11 @@ func inspectArchive(path string) {
 
 		preamble, meta, err = archiveReader.Next()
 
+		if errors.Is(err, reader.ErrEncrypted) {
+			fmt.Printf("Encrypted record: type %d, %d blocks\n", preamble.Rtype, preamble.DataLen)
+			err = nil
+			continue
+		}
 		if err != nil && !errors.Is(err, io.EOF) {
 			fmt.Println("Failed to read record header:")
 			fmt.Println(err)
@@ -82,10 +107,19 @@ func explainRecord(preamble format.Preamble, meta any) {
 	switch preamble.Rtype {
 	case format.RECORD_TYPE_CONTROL:
 		fmt.Print("Control record: ")
-		if preamble.Flags == format.RECORD_FLAG_CONTROL_START {
+		if preamble.IsStartOfArchive() {
 			fmt.Println("Begin archive.", "ponzu version", meta.(*format.StartOfArchive).Version)
-		} else if preamble.Flags == format.RECORD_FLAG_CONTROL_END {
-			fmt.Println("End of archive marker")
+		} else if preamble.IsEndOfArchive() {
+			fmt.Print("End of archive marker")
+			if eoa, ok := meta.(*format.EndOfArchive); ok {
+				if eoa.Index != 0 {
+					fmt.Printf(", index at block %d", eoa.Index)
+				}
+				if eoa.Records != 0 {
+					fmt.Printf(", %d records of %d data blocks before it", eoa.Records, eoa.DataBlocks)
+				}
+			}
+			fmt.Println()
 		} else {
 			fmt.Println("Unknown control record.")
 		}
@@ -111,6 +145,20 @@ func explainRecord(preamble format.Preamble, meta any) {
 
 	case format.RECORD_TYPE_CONTINUE:
 		fmt.Println("[Previous record continues]")
+	case format.RECORD_TYPE_INDEX:
+		fmt.Printf("Index record (%d blocks)\n", preamble.DataLen)
+	case format.RECORD_TYPE_SIGNATURE:
+		if sig, ok := meta.(*format.Signature); ok {
+			fmt.Printf("Signature: %v, key %x\n", sig.Algorithm, sig.PublicKey)
+		} else {
+			fmt.Println("Unreadable signature record")
+		}
+	case format.RECORD_TYPE_PARITY:
+		if p, ok := meta.(*format.Parity); ok {
+			fmt.Printf("Parity: %v, %d blocks from %d blocks back, %d stripes of %d parity blocks\n", p.Algorithm, p.Blocks, p.Before, p.Stripes, p.Shards)
+		} else {
+			fmt.Println("Unreadable parity record")
+		}
 	default:
 		fmt.Printf("======Record ======\n")
 		fmt.Printf("Type: %d\n", preamble.Rtype)
@@ -140,4 +188,5 @@ func init() {
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// inspectCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	inspectCmd.Flags().Bool("salvage", false, "Skip over damaged records to the next intact one")
 }
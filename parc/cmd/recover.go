@@ -0,0 +1,234 @@
+/*
+Copyright © 2022 Morgan Gangwere <morgan.gangwere@gmail.com>
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/indrora/ponzu/ponzu/reader"
+	"github.com/indrora/ponzu/ponzu/writer"
+	"github.com/spf13/cobra"
+)
+
+var (
+	ErrSameFile       = errors.New("can't recover an archive over itself")
+	ErrArchiveChanged = errors.New("archive changed while it was being recovered")
+)
+
+// recoverCmd represents the recover command
+var recoverCmd = &cobra.Command{
+	Use:   "recover damaged.pzarc recovered.pzarc",
+	Short: "Copy the intact records of a damaged Ponzu archive into a new one",
+	Long: `Recover reads a damaged archive, scanning forward past whatever is damaged
+to the next intact record, and copies every record whose header and body are
+intact into a new archive, as they are stored. Files split over several records
+are kept whole or not at all.
+
+Indexes and end of archive records are written afresh to match what was kept.
+Signatures are left out, as what they signed may not all be there; sign the
+recovered archive again with parc sign.`,
+	RunE:         recoverMain,
+	Args:         cobra.ExactArgs(2),
+	SilenceUsage: true,
+}
+
+func recoverMain(cmd *cobra.Command, args []string) error {
+	out := cmd.OutOrStdout()
+
+	in, err := os.Open(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if existing, err := os.Stat(args[1]); err == nil && os.SameFile(info, existing) {
+		return ErrSameFile
+	}
+
+	open := func() (*reader.Reader, error) {
+		r := reader.NewReaderAt(in, info.Size())
+		r.Salvage = true
+		return r, unlock(r)
+	}
+
+	// The first pass finds what is intact, and the second copies it.
+	r, err := open()
+	if err != nil {
+		return err
+	}
+	r.Skipped = func(skip reader.Skip) {
+		fmt.Fprintf(out, "Skipped damaged bytes %d to %d: %v\n", skip.From, skip.To, skip.Err)
+	}
+	plan, err := planRecovery(r)
+	if err != nil {
+		return err
+	}
+
+	if r, err = open(); err != nil {
+		return err
+	}
+	fout, err := os.OpenFile(args[1], os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer fout.Close()
+	w := writer.NewWriter(fout, 0)
+	w.WriteIndex = plan.indexed
+	if err = copyRecovered(r, w, plan.keep); err != nil {
+		return err
+	}
+	// Closing the writer closes the file too.
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Recovered %d of %d records\n", plan.kept, len(plan.keep))
+	if plan.signatures > 0 {
+		fmt.Fprintf(out, "Left out %d signatures; sign the recovered archive again\n", plan.signatures)
+	}
+	return nil
+}
+
+// recoveryPlan is what a first pass over a damaged archive found: which of the records
+// read from it to keep, and what was left out that a new archive should make up for.
+type recoveryPlan struct {
+	keep       []bool
+	kept       int
+	indexed    bool
+	signatures int
+}
+
+// planRecovery reads through a damaged archive, checking the body of each record, to
+// decide which records to keep. Indexes, signatures and ends of archive are not kept,
+// as they may no longer match.
+func planRecovery(r *reader.Reader) (*recoveryPlan, error) {
+	plan := &recoveryPlan{}
+
+	// Whether records may be missing since the last one
+	broken := false
+	skipped := r.Skipped
+	r.Skipped = func(skip reader.Skip) {
+		broken = true
+		if skipped != nil {
+			skipped(skip)
+		}
+	}
+
+	// The first record of the split file being read, if there is one
+	chain := -1
+	settle := func(complete bool) {
+		for i := chain; i < len(plan.keep); i++ {
+			complete = complete && plan.keep[i]
+		}
+		for i := chain; i < len(plan.keep); i++ {
+			plan.keep[i] = complete
+		}
+		chain = -1
+	}
+
+	for {
+		preamble, _, err := r.NextRaw()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil && !errors.Is(err, reader.ErrEncrypted) {
+			// Encrypted records are copied as they are stored, so there's no need to read them.
+			return nil, err
+		}
+		intact, _ := r.Validate()
+
+		continuation := preamble.Rtype == format.RECORD_TYPE_CONTINUE
+		if chain >= 0 && (broken || !continuation) {
+			// The rest of the split file is missing.
+			settle(false)
+		}
+		broken = false
+
+		switch {
+		case continuation && chain < 0:
+			intact = false
+		case preamble.Rtype == format.RECORD_TYPE_INDEX:
+			plan.indexed = true
+			intact = false
+		case preamble.Rtype == format.RECORD_TYPE_SIGNATURE:
+			plan.signatures++
+			intact = false
+		case preamble.Rtype == format.RECORD_TYPE_PARITY:
+			// Parity covers blocks as they were laid out, which the copy doesn't keep.
+			intact = false
+		case preamble.IsEndOfArchive():
+			intact = false
+		}
+		plan.keep = append(plan.keep, intact)
+
+		if preamble.Rtype != format.RECORD_TYPE_CONTROL && preamble.Flags&format.RECORD_FLAG_CONTINUES != 0 {
+			if chain < 0 {
+				chain = len(plan.keep) - 1
+			}
+		} else if chain >= 0 {
+			settle(true)
+		}
+	}
+	if chain >= 0 {
+		settle(false)
+	}
+
+	for _, keep := range plan.keep {
+		if keep {
+			plan.kept++
+		}
+	}
+	return plan, nil
+}
+
+// copyRecovered copies the records that a plan keeps into a new archive, ending each
+// archive afresh, and starting one for records whose start of archive was lost.
+func copyRecovered(r *reader.Reader, w *writer.ArchiveWriter, keep []bool) error {
+	started := false
+	for i := 0; ; i++ {
+		preamble, meta, err := r.NextRaw()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil && !errors.Is(err, reader.ErrEncrypted) {
+			return err
+		}
+		if i >= len(keep) {
+			return ErrArchiveChanged
+		}
+
+		if started && (preamble.IsStartOfArchive() || preamble.IsEndOfArchive()) {
+			if err = w.AppendEnd(); err != nil {
+				return err
+			}
+			started = false
+		}
+		if !keep[i] {
+			continue
+		}
+		if !started && !preamble.IsStartOfArchive() {
+			if err = w.AppendStart("", "recovered without its start of archive"); err != nil {
+				return err
+			}
+		}
+		started = true
+
+		if err = w.CopyRecord(preamble, r.RawMetadata(), meta, r.RawBody()); err != nil {
+			return err
+		}
+	}
+	if started {
+		return w.AppendEnd()
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(recoverCmd)
+}
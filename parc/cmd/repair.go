@@ -0,0 +1,91 @@
+/*
+Copyright © 2022 Morgan Gangwere <morgan.gangwere@gmail.com>
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/indrora/ponzu/ponzu/repair"
+	"github.com/spf13/cobra"
+)
+
+var ErrNotRepaired = errors.New("archive is too damaged to repair; try parc recover")
+
+// repairCmd represents the repair command
+var repairCmd = &cobra.Command{
+	Use:   "repair archive",
+	Short: "Rebuild damaged blocks of a Ponzu archive from its parity records",
+	Long: `Repair finds the damaged blocks of an archive made with parc create --parity,
+using the checksums of its records, and rebuilds them in place from the parity
+records. Nothing is written unless every bit of damage can be repaired.
+
+What can't be repaired can still be got at with parc recover.`,
+	RunE:         repairMain,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+}
+
+func repairMain(cmd *cobra.Command, args []string) error {
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+	flag := os.O_RDWR
+	if dryRun {
+		flag = os.O_RDONLY
+	}
+	fh, err := os.OpenFile(args[0], flag, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer fh.Close()
+
+	info, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+	result, err := repair.Repair(fh, info.Size())
+	if err != nil {
+		return err
+	}
+
+	for _, damage := range result.Found {
+		cmd.Printf("Damaged bytes %d to %d: %v\n", damage.From, damage.To, damage.Err)
+	}
+	if len(result.Damaged) > 0 {
+		for _, damage := range result.Damaged {
+			cmd.PrintErrf("Can't rebuild bytes %d to %d: %v\n", damage.From, damage.To, damage.Err)
+		}
+		return ErrNotRepaired
+	}
+	if len(result.Blocks) == 0 {
+		cmd.Println("No damage found")
+		return nil
+	}
+
+	offsets := make([]uint64, 0, len(result.Blocks))
+	for offset := range result.Blocks {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	if !dryRun {
+		for _, offset := range offsets {
+			if _, err := fh.WriteAt(result.Blocks[offset], int64(offset)); err != nil {
+				return err
+			}
+		}
+		if err := fh.Close(); err != nil {
+			return err
+		}
+	}
+	cmd.Printf("Rebuilt %d blocks from %d parity records\n", len(offsets), result.Parity)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(repairCmd)
+	repairCmd.Flags().BoolP("dry-run", "n", false, "Find and rebuild damaged blocks but don't write them")
+}
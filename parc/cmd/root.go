@@ -59,4 +59,6 @@ func GenDocs() {
 
 func init() {
 	rootCmd.PersistentFlags().BoolP("verbose", "v", false, "Write detailed information to the terminal")
+	rootCmd.PersistentFlags().String("passphrase-file", "", "Read the passphrase to encrypt or decrypt archives with from a file")
+	rootCmd.PersistentFlags().StringArray("identity", nil, "X25519 private key to decrypt archives with, as PEM encoded PKCS #8")
 }
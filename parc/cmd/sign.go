@@ -0,0 +1,161 @@
+/*
+Copyright © 2022 Morgan Gangwere <morgan.gangwere@gmail.com>
+*/
+package cmd
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/indrora/ponzu/ponzu/reader"
+	"github.com/indrora/ponzu/ponzu/writer"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ed25519"
+)
+
+var (
+	ErrNotEd25519Key   = errors.New("not an Ed25519 key")
+	ErrNoEndOfArchive  = errors.New("archive has no end of archive record to sign up to")
+	ErrSeveralArchives = errors.New("only files holding a single archive can be signed")
+)
+
+// signCmd represents the sign command
+var signCmd = &cobra.Command{
+	Use:   "sign archive",
+	Short: "Sign a Ponzu archive with an Ed25519 key",
+	Long: `Sign adds a signature record to the end of an archive, signing every record
+in it. Archives can be signed more than once; each signature also covers the
+ones before it.
+
+Keys are PEM encoded PKCS #8 Ed25519 private keys, such as those made by
+
+	openssl genpkey -algorithm ed25519 -out key.pem
+
+and the matching public key, for parc verify --pubkey, comes from
+
+	openssl pkey -in key.pem -pubout -out key.pub`,
+	RunE:         signMain,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+}
+
+func signMain(cmd *cobra.Command, args []string) error {
+	keyPath, _ := cmd.Flags().GetString("key")
+	key, err := loadPrivateKey(keyPath)
+	if err != nil {
+		return err
+	}
+
+	fh, err := os.OpenFile(args[0], os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer fh.Close()
+
+	end, digest, err := findEnd(reader.NewReader(fh))
+	if err != nil {
+		return err
+	}
+
+	// The signature goes where the end of archive is, and the end of archive (and
+	// anything after it) after that.
+	info, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+	rest, err := io.ReadAll(io.NewSectionReader(fh, int64(end), info.Size()-int64(end)))
+	if err != nil {
+		return err
+	}
+	if _, err = fh.Seek(int64(end), io.SeekStart); err != nil {
+		return err
+	}
+	if err = writer.NewWriter(fh, 0).AppendSignature(key, digest); err != nil {
+		return err
+	}
+	if _, err = fh.Write(rest); err != nil {
+		return err
+	}
+	return fh.Close()
+}
+
+// findEnd reads through an archive to its end of archive record, returning where that
+// is and what a signature in its place would sign.
+func findEnd(r *reader.Reader) (uint64, []byte, error) {
+	var end uint64
+	var digest []byte
+	for {
+		preamble, _, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil && !errors.Is(err, reader.ErrEncrypted) {
+			// Encrypted records are signed as they are stored, so there's no need to read them.
+			return 0, nil, err
+		}
+		if !preamble.IsEndOfArchive() {
+			continue
+		}
+		if digest != nil {
+			return 0, nil, ErrSeveralArchives
+		}
+		end, digest = r.Offset(), r.SignedDigest()
+	}
+	if digest == nil {
+		return 0, nil, ErrNoEndOfArchive
+	}
+	return end, digest, nil
+}
+
+// loadPrivateKey reads a PEM encoded PKCS #8 Ed25519 private key.
+func loadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	if key, ok := key.(ed25519.PrivateKey); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%v: %w", path, ErrNotEd25519Key)
+}
+
+// loadPublicKey reads a PEM encoded PKIX Ed25519 public key.
+func loadPublicKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	if key, ok := key.(ed25519.PublicKey); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%v: %w", path, ErrNotEd25519Key)
+}
+
+func readPEM(path string, blockType string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("%v: expected a PEM encoded %v", path, blockType)
+	}
+	return block.Bytes, nil
+}
+
+func init() {
+	rootCmd.AddCommand(signCmd)
+	signCmd.Flags().StringP("key", "k", "", "Ed25519 private key to sign with, as PEM encoded PKCS #8")
+	signCmd.MarkFlagRequired("key")
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/indrora/ponzu/ponzu/format"
+)
+
+// makeSpecial recreates a FIFO, socket or device node, which this host doesn't have.
+func makeSpecial(dest string, special *format.OSSpecial) error {
+	return fmt.Errorf("%w: %v", ErrUnknownSpecial, special.SpecialType)
+}
@@ -0,0 +1,33 @@
+//go:build unix
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/indrora/ponzu/ponzu/format"
+	"golang.org/x/sys/unix"
+)
+
+// makeSpecial recreates a FIFO, socket or device node. Device nodes can only be made
+// by root.
+func makeSpecial(dest string, special *format.OSSpecial) error {
+	if special.SpecialType != format.SPECIAL_TYPE_MKNOD {
+		return fmt.Errorf("%w: %v", ErrUnknownSpecial, special.SpecialType)
+	}
+
+	switch special.Mode & unix.S_IFMT {
+	case unix.S_IFIFO:
+		return unix.Mkfifo(dest, special.Mode&^unix.S_IFMT)
+	case unix.S_IFCHR, unix.S_IFBLK:
+		if os.Geteuid() != 0 {
+			return ErrNeedsRoot
+		}
+		return unix.Mknod(dest, special.Mode, int(special.Device))
+	case unix.S_IFSOCK:
+		return unix.Mknod(dest, special.Mode, 0)
+	default:
+		return fmt.Errorf("%w: mode %o", ErrUnknownSpecial, special.Mode)
+	}
+}
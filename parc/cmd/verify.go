@@ -4,9 +4,21 @@ Copyright © 2022 Morgan Gangwere <morgan.gangwere@gmail.com>
 package cmd
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"runtime"
 
+	"github.com/indrora/ponzu/ponzu/reader"
 	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ed25519"
+)
+
+var (
+	ErrVerifyFailed = errors.New("one or more archives failed verification")
+	ErrNotSigned    = errors.New("archive is not signed all the way to its end by any of the keys given")
 )
 
 // verifyCmd represents the verify command
@@ -14,23 +26,161 @@ var verifyCmd = &cobra.Command{
 	Use:   "verify",
 	Short: "Verify the integrity of a Ponzu archive",
 	Long: `Verify reads each record within an archive and validates any cryptographic
-hashes contained within it.`,
-	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("verify called")
-	},
-	Args: cobra.MinimumNArgs(1),
+hashes contained within it.
+
+Each record's metadata and data checksums are checked without decompressing
+anything, along with the structure of the archive itself: continuation chains
+must be unbroken and every record must sit between a start and end of archive
+record.
+
+Signatures are checked against the records they sign. Given --pubkey, every
+archive in the file must also end with a good signature by one of the keys
+given, which are PEM encoded Ed25519 public keys (see parc sign): only more
+signatures and an end of archive that matches what was signed may follow it.
+
+Verify exits with a non-zero status if any archive fails.`,
+	RunE:         verifyMain,
+	Args:         cobra.MinimumNArgs(1),
+	SilenceUsage: true,
 }
 
-func init() {
-	rootCmd.AddCommand(verifyCmd)
+// archiveReport is the report for a single archive, as emitted by --json.
+type archiveReport struct {
+	Archive string `json:"archive"`
+	*reader.VerifyReport
+	Error string `json:"error,omitempty"`
+}
+
+func verifyMain(cmd *cobra.Command, args []string) error {
+
+	verbose, _ := rootCmd.Flags().GetBool("verbose")
+	asJson, _ := cmd.Flags().GetBool("json")
+
+	reports := make([]archiveReport, 0, len(args))
+	failed := false
+
+	jobs, _ := cmd.Flags().GetInt("jobs")
+
+	keyPaths, _ := cmd.Flags().GetStringArray("pubkey")
+	keys := make([]ed25519.PublicKey, 0, len(keyPaths))
+	for _, path := range keyPaths {
+		key, err := loadPublicKey(path)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+
+	for _, filename := range args {
+		report := verifyArchive(filename, jobs)
+		if report.VerifyReport != nil && len(keys) > 0 && !report.SignedBy(keys) {
+			report.Errors = append(report.Errors, ErrNotSigned.Error())
+			report.Ok = false
+		}
+		if report.Error != "" || !report.Ok {
+			failed = true
+		}
+		if !asJson {
+			printVerifyReport(cmd.OutOrStdout(), report, verbose)
+		}
+		reports = append(reports, report)
+	}
+
+	if asJson {
+		enc := json.NewEncoder(cmd.OutOrStdout())
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(reports); err != nil {
+			return err
+		}
+	}
 
-	// Here you will define your flags and configuration settings.
+	if failed {
+		return ErrVerifyFailed
+	}
+	return nil
+}
+
+func verifyArchive(filename string, jobs int) archiveReport {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return archiveReport{Archive: filename, Error: err.Error()}
+	}
+	defer fh.Close()
+
+	r, err := newReader(fh, jobs)
+	if err != nil {
+		return archiveReport{Archive: filename, Error: err.Error()}
+	}
+	defer r.Close()
+
+	return archiveReport{
+		Archive:      filename,
+		VerifyReport: r.Verify(),
+	}
+}
+
+// newReader makes a reader for an archive file. With more than one job, the bodies of
+// the records ahead are read on as many goroutines; 0 jobs means one per CPU.
+func newReader(fh *os.File, jobs int) (*reader.Reader, error) {
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+	if jobs == 1 {
+		return reader.NewReader(fh), nil
+	}
+
+	info, err := fh.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r := reader.NewReaderAt(fh, info.Size())
+	r.ReadAhead = jobs
+	return r, nil
+}
 
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// verifyCmd.PersistentFlags().String("foo", "", "A help for foo")
+func printVerifyReport(out io.Writer, report archiveReport, verbose bool) {
+
+	if report.Error != "" {
+		fmt.Fprintf(out, "%v: FAILED (%v)\n", report.Archive, report.Error)
+		return
+	}
+
+	for _, record := range report.Records {
+		if record.Ok() && !verbose {
+			continue
+		}
+		status := "ok"
+		if !record.Ok() {
+			status = "FAILED"
+		}
+		fmt.Fprintf(out, "%v: record %d at offset %d (type %d, flags %d) %v: %v\n",
+			report.Archive, record.Index, record.Offset, record.Type, record.Flags, record.Name, status)
+		for _, e := range record.Errors {
+			fmt.Fprintf(out, "\t%v\n", e)
+		}
+	}
+	if verbose {
+		for _, sig := range report.Signatures {
+			if sig.Ok {
+				fmt.Fprintf(out, "%v: signed by %x\n", report.Archive, sig.PublicKey)
+			}
+		}
+	}
+	for _, e := range report.Errors {
+		fmt.Fprintf(out, "%v: %v\n", report.Archive, e)
+	}
+
+	if report.Ok {
+		fmt.Fprintf(out, "%v: OK (%d records)\n", report.Archive, len(report.Records))
+	} else {
+		fmt.Fprintf(out, "%v: FAILED\n", report.Archive)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
 
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// verifyCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	verifyCmd.Flags().Bool("json", false, "Write the report as JSON")
+	verifyCmd.Flags().StringArray("pubkey", nil, "Require a signature by this Ed25519 public key, PEM encoded; may be given more than once")
+	verifyCmd.Flags().IntP("jobs", "j", 1, "Number of records to check at once (0 for one per CPU)")
 }
@@ -0,0 +1,119 @@
+package archivefs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+
+	"github.com/indrora/ponzu/ponzu/format"
+)
+
+var errNegativeSeek = errors.New("negative position")
+
+// file is an open file. Bodies are streamed out of the archive as they are read;
+// seeking backwards starts the stream over.
+type file struct {
+	fsys  *FS
+	entry *entry
+
+	body   io.ReadCloser
+	read   int64 // how far into the body the stream is
+	offset int64 // where the next Read should come from
+	size   int64 // size of the body, once it is known; -1 until then
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return &fileInfo{f.entry}, nil
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	if f.entry.rtype != format.RECORD_TYPE_FILE {
+		// Specials have nothing in them.
+		return 0, io.EOF
+	}
+
+	if f.body != nil && f.read > f.offset {
+		f.body.Close()
+		f.body = nil
+	}
+	if f.body == nil {
+		body, err := f.open()
+		if err != nil {
+			return 0, &fs.PathError{Op: "read", Path: f.entry.name, Err: err}
+		}
+		f.body, f.read = body, 0
+	}
+	if f.read < f.offset {
+		n, err := io.CopyN(io.Discard, f.body, f.offset-f.read)
+		f.read += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.body.Read(p)
+	f.read += int64(n)
+	f.offset += int64(n)
+	return n, err
+}
+
+// open starts streaming the body from the beginning.
+func (f *file) open() (io.ReadCloser, error) {
+	archive, err := f.fsys.archive.Clone()
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err = archive.Open(f.entry.source); err != nil {
+		return nil, err
+	}
+	return archive.Body(), nil
+}
+
+// Seek only moves where the next Read comes from; the stream catches up when it happens.
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		size, err := f.bodySize()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.entry.name, Err: errNegativeSeek}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// bodySize is the size of the body once decompressed. The size in the metadata is
+// trusted if it is there; if not, the body is read through to find out.
+func (f *file) bodySize() (int64, error) {
+	if f.entry.rtype != format.RECORD_TYPE_FILE {
+		return 0, nil
+	}
+	if f.entry.size > 0 {
+		return f.entry.size, nil
+	}
+	if f.size < 0 {
+		body, err := f.open()
+		if err != nil {
+			return 0, err
+		}
+		defer body.Close()
+		if f.size, err = io.Copy(io.Discard, body); err != nil {
+			return 0, err
+		}
+	}
+	return f.size, nil
+}
+
+func (f *file) Close() error {
+	if f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	return nil
+}
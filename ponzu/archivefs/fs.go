@@ -0,0 +1,352 @@
+/*
+The archivefs package presents a Ponzu archive as a read-only io/fs filesystem, so that
+it can be handed to anything that takes an fs.FS: http.FileServer, template.ParseFS,
+doublestar.Glob and so on.
+
+Names in the filesystem are the names of records in the archive; the archive prefix is
+not included. Directories that are only implied by the names of their contents are
+filled in, and symbolic links are followed as long as they stay within the archive.
+*/
+package archivefs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/indrora/ponzu/ponzu/format/metadata"
+	"github.com/indrora/ponzu/ponzu/reader"
+)
+
+// How many symbolic links will be followed before giving up.
+const maxLinks = 40
+
+var (
+	ErrTooManyLinks = errors.New("too many levels of symbolic links")
+	ErrIsDirectory  = errors.New("is a directory")
+)
+
+// FS is a read-only view of an archive. It is safe for concurrent use.
+type FS struct {
+	archive *reader.Reader
+	entries map[string]*entry
+}
+
+// entry is a single file, directory or link in the filesystem.
+type entry struct {
+	name    string
+	rtype   format.RecordType
+	source  string // the record holding the body; differs from name for hardlinks
+	target  string // symlink and hardlink targets
+	modTime time.Time
+	mode    fs.FileMode
+	size    int64
+	meta    any
+
+	children []*entry
+}
+
+// New reads the headers of every record in the archive to build a filesystem out of it.
+// The index is used to find the records if the archive has one.
+func New(r io.ReaderAt, size int64) (*FS, error) {
+	archive := reader.NewReaderAt(r, size)
+	index, err := archive.Index()
+	if err != nil {
+		return nil, err
+	}
+
+	fsys := &FS{
+		archive: archive,
+		entries: map[string]*entry{
+			".": {name: ".", rtype: format.RECORD_TYPE_DIRECTORY, mode: fs.ModeDir | 0755},
+		},
+	}
+
+	// The last record with a given name wins, which is also the one that Open finds.
+	for i := len(index.Entries) - 1; i >= 0; i-- {
+		name := path.Clean(index.Entries[i].Name)
+		if _, seen := fsys.entries[name]; seen || !fs.ValidPath(name) {
+			continue
+		}
+		_, meta, err := archive.Open(index.Entries[i].Name)
+		if err != nil {
+			return nil, err
+		}
+		if e := newEntry(name, index.Entries[i].Type, meta); e != nil {
+			fsys.entries[name] = e
+		}
+	}
+
+	fsys.resolveHardlinks()
+	fsys.fillDirectories()
+
+	return fsys, nil
+}
+
+// newEntry makes an entry out of a record, or returns nil if it isn't something that
+// belongs in a filesystem.
+func newEntry(name string, rtype format.RecordType, meta any) *entry {
+	e := &entry{
+		name:   name,
+		rtype:  rtype,
+		source: name,
+		meta:   meta,
+	}
+
+	var raw any
+	switch m := meta.(type) {
+	case *format.File:
+		e.modTime, raw = m.ModTime, m.Metadata
+		e.mode = 0644
+	case *format.Directory:
+		e.modTime, raw = m.ModTime, m.Metadata
+		e.mode = fs.ModeDir | 0755
+	case *format.Symlink:
+		e.modTime, raw = m.ModTime, m.Metadata
+		e.mode = fs.ModeSymlink | 0777
+		e.target = m.Target
+	case *format.Hardlink:
+		e.modTime, raw = m.ModTime, m.Metadata
+		e.mode = 0644
+		e.target = path.Clean(m.Target)
+	case *format.OSSpecial:
+		e.modTime, raw = m.ModTime, m.Metadata
+		e.mode = fs.ModeIrregular | 0644
+	default:
+		return nil
+	}
+
+	if rawMap, ok := raw.(map[any]any); ok {
+		if unixMeta, ok := metadata.TransmogrifyCbor[metadata.UNIXMetadata](rawMap); ok {
+			if unixMeta.Mode != nil && rtype != format.RECORD_TYPE_SYMLINK {
+				e.mode = e.mode.Type() | metadata.FileMode(*unixMeta.Mode)
+			}
+			if unixMeta.FileSize != nil {
+				e.size = int64(*unixMeta.FileSize)
+			}
+		}
+	}
+
+	return e
+}
+
+// resolveHardlinks points hardlinks at the body of the file they link to. Links to
+// anything that isn't a file in the archive are dropped.
+func (fsys *FS) resolveHardlinks() {
+	for name, e := range fsys.entries {
+		if e.rtype != format.RECORD_TYPE_HARDLINK {
+			continue
+		}
+		target, ok := fsys.entries[e.target]
+		if !ok || target.rtype != format.RECORD_TYPE_FILE {
+			delete(fsys.entries, name)
+			continue
+		}
+		e.rtype = format.RECORD_TYPE_FILE
+		e.source = target.source
+		e.size = target.size
+		e.mode = target.mode
+	}
+}
+
+// fillDirectories adds any directories that are implied by names, and links every
+// entry to its parent.
+func (fsys *FS) fillDirectories() {
+	names := make([]string, 0, len(fsys.entries))
+	for name := range fsys.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		child := fsys.entries[name]
+		for name != "." {
+			parentName := path.Dir(name)
+			parent, ok := fsys.entries[parentName]
+			if !ok {
+				parent = &entry{name: parentName, rtype: format.RECORD_TYPE_DIRECTORY, mode: fs.ModeDir | 0755}
+				fsys.entries[parentName] = parent
+			} else if !parent.mode.IsDir() {
+				// Something that isn't a directory has things in it; the names win.
+				parent.rtype = format.RECORD_TYPE_DIRECTORY
+				parent.mode = fs.ModeDir | 0755
+			}
+			parent.children = append(parent.children, child)
+			if ok {
+				break
+			}
+			name, child = parentName, parent
+		}
+	}
+
+	for _, e := range fsys.entries {
+		sort.Slice(e.children, func(i, j int) bool {
+			return e.children[i].name < e.children[j].name
+		})
+	}
+}
+
+// lookup finds the entry for a name, following symbolic links along the way. The last
+// part of the name is only followed if follow is set.
+func (fsys *FS) lookup(name string, follow bool) (*entry, error) {
+	if name == "." {
+		return fsys.entries["."], nil
+	}
+
+	links := 0
+	parts := strings.Split(name, "/")
+	current := "."
+	for i := 0; i < len(parts); i++ {
+		next := path.Join(current, parts[i])
+		e, ok := fsys.entries[next]
+		if !ok {
+			return nil, fs.ErrNotExist
+		}
+
+		if e.rtype == format.RECORD_TYPE_SYMLINK && (follow || i < len(parts)-1) {
+			if links++; links > maxLinks {
+				return nil, ErrTooManyLinks
+			}
+			target := path.Join(path.Dir(next), e.target)
+			if path.IsAbs(e.target) || !fs.ValidPath(target) {
+				// Links that leave the archive lead nowhere.
+				return nil, fs.ErrNotExist
+			}
+			// Start over from the target, with whatever was left of the name.
+			parts = append(strings.Split(target, "/"), parts[i+1:]...)
+			current = "."
+			i = -1
+			continue
+		}
+		current = next
+	}
+	return fsys.entries[current], nil
+}
+
+// Open opens the named file or directory for reading, following symbolic links.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	e, err := fsys.lookup(name, true)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if e.mode.IsDir() {
+		return &dir{entry: e}, nil
+	}
+	return &file{fsys: fsys, entry: e, size: -1}, nil
+}
+
+// Stat describes the named file, following symbolic links.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	e, err := fsys.lookup(name, true)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return &fileInfo{e}, nil
+}
+
+// Lstat describes the named file without following a symbolic link at the end of it.
+func (fsys *FS) Lstat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: fs.ErrInvalid}
+	}
+	e, err := fsys.lookup(name, false)
+	if err != nil {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: err}
+	}
+	return &fileInfo{e}, nil
+}
+
+// ReadLink returns the target of the named symbolic link, as written in the archive.
+func (fsys *FS) ReadLink(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	e, err := fsys.lookup(name, false)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	if e.rtype != format.RECORD_TYPE_SYMLINK {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return e.target, nil
+}
+
+// ReadDir lists the named directory, sorted by name.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	e, err := fsys.lookup(name, true)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	if !e.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return dirEntries(e.children), nil
+}
+
+func dirEntries(entries []*entry) []fs.DirEntry {
+	list := make([]fs.DirEntry, len(entries))
+	for i, e := range entries {
+		list[i] = fs.FileInfoToDirEntry(&fileInfo{e})
+	}
+	return list
+}
+
+// fileInfo describes an entry.
+type fileInfo struct {
+	*entry
+}
+
+func (i *fileInfo) Name() string       { return path.Base(i.name) }
+func (i *fileInfo) Size() int64        { return i.size }
+func (i *fileInfo) Mode() fs.FileMode  { return i.mode }
+func (i *fileInfo) ModTime() time.Time { return i.modTime }
+func (i *fileInfo) IsDir() bool        { return i.mode.IsDir() }
+
+// Sys is the record's metadata, as read from the archive.
+func (i *fileInfo) Sys() any { return i.meta }
+
+// dir is an open directory.
+type dir struct {
+	entry  *entry
+	offset int
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) {
+	return &fileInfo{d.entry}, nil
+}
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.entry.name, Err: ErrIsDirectory}
+}
+
+func (d *dir) Close() error {
+	return nil
+}
+
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entry.children[d.offset:]
+	if n > 0 {
+		if len(remaining) == 0 {
+			return nil, io.EOF
+		}
+		if n < len(remaining) {
+			remaining = remaining[:n]
+		}
+	}
+	d.offset += len(remaining)
+	return dirEntries(remaining), nil
+}
@@ -0,0 +1,90 @@
+package archivefs
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"math/rand"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/indrora/ponzu/ponzu/format/metadata"
+	"github.com/indrora/ponzu/ponzu/writer"
+)
+
+func TestFS(t *testing.T) {
+	for _, withIndex := range []bool{true, false} {
+		buff := new(bytes.Buffer)
+		w := writer.NewWriter(buff, 2*format.BLOCK_SIZE)
+		w.WriteIndex = withIndex
+
+		now := time.Now().Truncate(time.Second)
+		big := make([]byte, 5*format.BLOCK_SIZE)
+		rand.Read(big)
+		small := []byte("hello, world")
+
+		appendFile := func(name string, data []byte, mode uint16) {
+			size := uint64(len(data))
+			err := w.AppendStream(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_ZSTD, format.File{
+				Name:     name,
+				ModTime:  now,
+				Metadata: metadata.UNIXMetadata{CommonMetadata: metadata.CommonMetadata{FileSize: &size}, Mode: &mode},
+			}, bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		w.AppendStart("prefix", "")
+		w.AppendBytes(format.RECORD_TYPE_DIRECTORY, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.Directory{File: format.File{Name: "a", ModTime: now}}, nil)
+		appendFile("a/big.bin", big, 0600)
+		appendFile("a/b/small.txt", small, 0644)
+		w.AppendBytes(format.RECORD_TYPE_SYMLINK, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.Symlink{Link: format.Link{File: format.File{Name: "a/link", ModTime: now}, Target: "b/small.txt"}}, nil)
+		w.AppendBytes(format.RECORD_TYPE_HARDLINK, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.Hardlink{Link: format.Link{File: format.File{Name: "hard", ModTime: now}, Target: "a/big.bin"}}, nil)
+		w.AppendEnd()
+		w.Close()
+
+		archive := buff.Bytes()
+		fsys, err := New(bytes.NewReader(archive), int64(len(archive)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = fstest.TestFS(fsys, "a/big.bin", "a/b/small.txt", "a/link", "hard"); err != nil {
+			t.Fatal(err)
+		}
+
+		if data, err := fs.ReadFile(fsys, "a/link"); err != nil || !bytes.Equal(data, small) {
+			t.Errorf("expected the link to lead to small.txt, got %q (%v)", data, err)
+		}
+		if data, err := fs.ReadFile(fsys, "hard"); err != nil || !bytes.Equal(data, big) {
+			t.Errorf("expected the hardlink to have the contents of big.bin (%v)", err)
+		}
+
+		info, err := fs.Stat(fsys, "a/big.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != 0600 || info.Size() != int64(len(big)) || !info.ModTime().Equal(now) {
+			t.Errorf("unexpected stat for a/big.bin: mode %v, size %d, mtime %v", info.Mode(), info.Size(), info.ModTime())
+		}
+
+		// Seeking about in a file that is streamed out of the archive.
+		f, _ := fsys.Open("a/big.bin")
+		seeker := f.(io.ReadSeeker)
+		seeker.Seek(int64(format.BLOCK_SIZE)*3, io.SeekStart)
+		chunk := make([]byte, 100)
+		io.ReadFull(seeker, chunk)
+		if !bytes.Equal(chunk, big[3*format.BLOCK_SIZE:3*format.BLOCK_SIZE+100]) {
+			t.Error("read the wrong thing after seeking forward")
+		}
+		seeker.Seek(10, io.SeekStart)
+		io.ReadFull(seeker, chunk)
+		if !bytes.Equal(chunk, big[10:110]) {
+			t.Error("read the wrong thing after seeking backward")
+		}
+		f.Close()
+	}
+}
@@ -0,0 +1,127 @@
+package compression
+
+import (
+	"io"
+
+	"github.com/andybalholm/brotli"
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// The codecs in the spec.
+
+// longWindow is the window zstd gets in long mode, the same as zstd --long.
+const longWindow = 1 << 27
+
+// lz4Levels are the LZ4 levels by number.
+var lz4Levels = []lz4.CompressionLevel{
+	lz4.Fast, lz4.Level1, lz4.Level2, lz4.Level3, lz4.Level4, lz4.Level5, lz4.Level6, lz4.Level7, lz4.Level8, lz4.Level9,
+}
+
+func init() {
+	Register(format.COMPRESSION_NONE, Codec{"none", newNoneEncoder, newNoneDecoder})
+	Register(format.COMPRESSION_ZSTD, Codec{"zstd", newZstdEncoder, newZstdDecoder})
+	Register(format.COMPRESSION_BROTLI, Codec{"brotli", newBrotliEncoder, newBrotliDecoder})
+	Register(format.COMPRESSION_LZ4, Codec{"lz4", newLZ4Encoder, newLZ4Decoder})
+	Register(format.COMPRESSION_XZ, Codec{"xz", newXZEncoder, newXZDecoder})
+	Register(format.COMPRESSION_DEFLATE, Codec{"deflate", newDeflateEncoder, newDeflateDecoder})
+}
+
+// nopWriteCloser is io.NopCloser for writers.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func newNoneEncoder(w io.Writer, options Options, dict []byte) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func newNoneDecoder(r io.Reader, dict []byte) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil // no compression = passthru
+}
+
+func newZstdEncoder(w io.Writer, options Options, dict []byte) (io.WriteCloser, error) {
+	zopts := []zstd.EOption{}
+	if options.Level != 0 {
+		zopts = append(zopts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(options.Level)))
+	}
+	if options.Long {
+		zopts = append(zopts, zstd.WithWindowSize(longWindow))
+	}
+	if dict != nil {
+		zopts = append(zopts, zstd.WithEncoderDict(dict))
+	}
+	return zstd.NewWriter(w, zopts...)
+}
+
+func newZstdDecoder(r io.Reader, dict []byte) (io.ReadCloser, error) {
+	var decoder *zstd.Decoder
+	var err error
+	if dict != nil {
+		decoder, err = zstd.NewReader(r, zstd.WithDecoderDicts(dict))
+	} else {
+		decoder, err = zstd.NewReader(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
+
+func newBrotliEncoder(w io.Writer, options Options, dict []byte) (io.WriteCloser, error) {
+	quality := brotli.DefaultCompression
+	if options.Level != 0 {
+		quality = options.Level
+	}
+	return brotli.NewWriterOptions(w, brotli.WriterOptions{
+		Quality: quality,
+		LGWin:   options.Window,
+	}), nil
+}
+
+func newBrotliDecoder(r io.Reader, dict []byte) (io.ReadCloser, error) {
+	return io.NopCloser(brotli.NewReader(r)), nil
+}
+
+func newLZ4Encoder(w io.Writer, options Options, dict []byte) (io.WriteCloser, error) {
+	encoder := lz4.NewWriter(w)
+	if options.Level > 0 && options.Level < len(lz4Levels) {
+		if err := encoder.Apply(lz4.CompressionLevelOption(lz4Levels[options.Level])); err != nil {
+			return nil, err
+		}
+	}
+	return encoder, nil
+}
+
+func newLZ4Decoder(r io.Reader, dict []byte) (io.ReadCloser, error) {
+	return io.NopCloser(lz4.NewReader(r)), nil
+}
+
+func newXZEncoder(w io.Writer, options Options, dict []byte) (io.WriteCloser, error) {
+	return xz.NewWriter(w)
+}
+
+func newXZDecoder(r io.Reader, dict []byte) (io.ReadCloser, error) {
+	decoder, err := xz.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(decoder), nil
+}
+
+func newDeflateEncoder(w io.Writer, options Options, dict []byte) (io.WriteCloser, error) {
+	level := flate.DefaultCompression
+	if options.Level != 0 {
+		level = options.Level
+	}
+	return flate.NewWriter(w, level)
+}
+
+func newDeflateDecoder(r io.Reader, dict []byte) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
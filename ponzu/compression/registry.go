@@ -0,0 +1,135 @@
+// Package compression holds the compressors that archive bodies can be compressed
+// with, by compression type. Applications can register codecs of their own, which the
+// reader and writer then use like any other.
+package compression
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/indrora/ponzu/ponzu/format"
+)
+
+var ErrUnknown = errors.New("unknown compression")
+
+// Options tune how bodies are compressed. The zero value leaves everything to the
+// defaults of each codec, and codecs ignore whatever does not apply to them.
+type Options struct {
+	// Level is the zstd level, on the same scale as the zstd command line (1 to 22), the
+	// brotli quality (1 to 11) or the LZ4 or deflate level (1 to 9). 0 is the default
+	// for each. XZ has no levels.
+	Level int
+	// Long gives zstd a 128MB window, like zstd --long. Decompressing with it takes
+	// as much memory.
+	Long bool
+	// Window is the base 2 logarithm of the brotli window size (10 to 24). 0 picks one
+	// to suit the quality.
+	Window int
+}
+
+// NewEncoder starts a compressed stream written to w. dict is the zstd dictionary in
+// effect in the archive, if there is one; codecs with no use for it ignore it. Closing
+// the encoder finishes the stream, but leaves w open.
+type NewEncoder func(w io.Writer, options Options, dict []byte) (io.WriteCloser, error)
+
+// NewDecoder reads a compressed stream from r, with dict as for NewEncoder. Closing
+// the decoder frees whatever it holds, but leaves r alone.
+type NewDecoder func(r io.Reader, dict []byte) (io.ReadCloser, error)
+
+// Codec is a way of compressing bodies.
+type Codec struct {
+	// Name is how the codec is known to people, e.g. on the command line
+	Name       string
+	NewEncoder NewEncoder
+	NewDecoder NewDecoder
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = make(map[format.CompressionType]Codec)
+)
+
+// Register makes a codec available for a compression type. Types of 128 and up are
+// for implementation defined codecs; the rest are for those in the spec.
+//
+// Register is meant to be called from init functions. It panics if a codec is already
+// registered for the type or by the name, or if the codec is incomplete.
+func Register(ctype format.CompressionType, codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	if codec.Name == "" || codec.NewEncoder == nil || codec.NewDecoder == nil {
+		panic(fmt.Sprintf("compression: incomplete codec for type %d", ctype))
+	}
+	if _, dup := codecs[ctype]; dup {
+		panic(fmt.Sprintf("compression: Register called twice for type %d", ctype))
+	}
+	for _, other := range codecs {
+		if other.Name == codec.Name {
+			panic(fmt.Sprintf("compression: Register called twice for name %q", codec.Name))
+		}
+	}
+	codecs[ctype] = codec
+}
+
+// Lookup finds the codec for a compression type.
+func Lookup(ctype format.CompressionType) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	codec, ok := codecs[ctype]
+	return codec, ok
+}
+
+// ByName finds a codec, and its compression type, by name.
+func ByName(name string) (format.CompressionType, Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	for ctype, codec := range codecs {
+		if codec.Name == name {
+			return ctype, codec, true
+		}
+	}
+	return 0, Codec{}, false
+}
+
+// Compress compresses data all at once.
+func Compress(data []byte, ctype format.CompressionType, options Options, dict []byte) ([]byte, error) {
+	if ctype == format.COMPRESSION_NONE {
+		return data, nil
+	}
+
+	buf := new(bytes.Buffer)
+	encoder, err := NewWriter(buf, ctype, options, dict)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = encoder.Write(data); err != nil {
+		encoder.Close()
+		return nil, err
+	}
+	if err = encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// NewWriter compresses a stream written to w. Closing the writer finishes the stream.
+func NewWriter(w io.Writer, ctype format.CompressionType, options Options, dict []byte) (io.WriteCloser, error) {
+	codec, ok := Lookup(ctype)
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknown, ctype)
+	}
+	return codec.NewEncoder(w, options, dict)
+}
+
+// NewReader decompresses a stream. The reader must be closed once it is finished with.
+func NewReader(r io.Reader, ctype format.CompressionType, dict []byte) (io.ReadCloser, error) {
+	codec, ok := Lookup(ctype)
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknown, ctype)
+	}
+	return codec.NewDecoder(r, dict)
+}
@@ -0,0 +1,134 @@
+package compression_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/indrora/ponzu/ponzu/compression"
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/indrora/ponzu/ponzu/reader"
+	"github.com/indrora/ponzu/ponzu/writer"
+)
+
+const COMPRESSION_ROT13 format.CompressionType = 200
+
+// rot13 is a codec that compresses nothing, but can be told apart from none.
+type rot13 struct {
+	w io.Writer
+	r io.Reader
+}
+
+func (c rot13) Write(p []byte) (int, error) {
+	return c.w.Write(rotate(bytes.Clone(p)))
+}
+
+func (c rot13) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	rotate(p[:n])
+	return n, err
+}
+
+func (rot13) Close() error { return nil }
+
+func rotate(p []byte) []byte {
+	for i, b := range p {
+		switch {
+		case b >= 'a' && b <= 'z':
+			p[i] = 'a' + (b-'a'+13)%26
+		case b >= 'A' && b <= 'Z':
+			p[i] = 'A' + (b-'A'+13)%26
+		}
+	}
+	return p
+}
+
+func init() {
+	compression.Register(COMPRESSION_ROT13, compression.Codec{
+		Name: "rot13",
+		NewEncoder: func(w io.Writer, options compression.Options, dict []byte) (io.WriteCloser, error) {
+			return rot13{w: w}, nil
+		},
+		NewDecoder: func(r io.Reader, dict []byte) (io.ReadCloser, error) {
+			return rot13{r: r}, nil
+		},
+	})
+}
+
+func TestRegister(t *testing.T) {
+	if ctype, _, ok := compression.ByName("rot13"); !ok || ctype != COMPRESSION_ROT13 {
+		t.Fatalf("rot13 registered as %d, %v", ctype, ok)
+	}
+
+	data := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog ", 200))
+
+	buff := new(bytes.Buffer)
+	w := writer.NewWriter(buff, 0)
+	w.AppendStart("", "")
+	w.AppendBytes(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, COMPRESSION_ROT13, format.File{Name: "fox"}, data)
+	w.AppendEnd()
+	w.Close()
+
+	if bytes.Contains(buff.Bytes(), data) {
+		t.Error("expected the body to be encoded")
+	}
+
+	r := reader.NewReader(bytes.NewReader(buff.Bytes()))
+	for {
+		preamble, meta, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			t.Fatal("no file in the archive")
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := meta.(*format.File); !ok {
+			continue
+		}
+		if preamble.Compression != COMPRESSION_ROT13 {
+			t.Errorf("file stored with compression %v", preamble.Compression)
+		}
+		out := new(bytes.Buffer)
+		if err := r.CopyAll(out, true); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), data) {
+			t.Error("round trip failed")
+		}
+		break
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	codec, _ := compression.Lookup(format.COMPRESSION_ZSTD)
+	testCases := []struct {
+		name  string
+		ctype format.CompressionType
+		codec compression.Codec
+	}{
+		{"same type", format.COMPRESSION_ZSTD, compression.Codec{Name: "zstd2", NewEncoder: codec.NewEncoder, NewDecoder: codec.NewDecoder}},
+		{"same name", 201, codec},
+		{"incomplete", 202, compression.Codec{Name: "nothing"}},
+	}
+
+	for _, tc := range testCases {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%v: expected Register to panic", tc.name)
+				}
+			}()
+			compression.Register(tc.ctype, tc.codec)
+		}()
+	}
+}
+
+func TestUnknown(t *testing.T) {
+	if _, err := compression.Compress([]byte("data"), 250, compression.Options{}, nil); !errors.Is(err, compression.ErrUnknown) {
+		t.Errorf("expected ErrUnknown compressing, got %v", err)
+	}
+	if _, err := compression.NewReader(bytes.NewReader(nil), 250, nil); !errors.Is(err, compression.ErrUnknown) {
+		t.Errorf("expected ErrUnknown decompressing, got %v", err)
+	}
+}
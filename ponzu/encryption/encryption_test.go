@@ -0,0 +1,126 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/indrora/ponzu/ponzu/format"
+)
+
+func TestStream(t *testing.T) {
+	key, enc, err := NewKey(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(enc.Keys) != 0 {
+		t.Errorf("expected no wrapped keys, got %d", len(enc.Keys))
+	}
+
+	id, _ := NewID()
+	other, _ := NewID()
+	for _, size := range []int{0, 1, segmentSize - 1, segmentSize, segmentSize + 1, 3 * segmentSize} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		sealed, err := key.Seal(data, id, format.RECORD_TYPE_FILE, format.COMPRESSION_NONE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(sealed)) != SealedSize(int64(size)) {
+			t.Errorf("%d bytes: sealed to %d bytes, expected %d", size, len(sealed), SealedSize(int64(size)))
+		}
+
+		opened, err := io.ReadAll(key.NewReader(bytes.NewReader(sealed), id, format.RECORD_TYPE_FILE, format.COMPRESSION_NONE))
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(opened, data) {
+			t.Errorf("%d bytes: round trip failed, got %d bytes", size, len(opened))
+		}
+
+		// Cut off, at a segment boundary if there is one, or read as another sort of record
+		// or as the body of another record
+		type badCase struct {
+			name   string
+			sealed []byte
+			id     []byte
+			rtype  format.RecordType
+		}
+		badCases := []badCase{
+			{"truncated", sealed[:len(sealed)-segmentOver], id, format.RECORD_TYPE_FILE},
+			{"other record type", sealed, id, format.RECORD_TYPE_CONTINUE},
+			{"other record", sealed, other, format.RECORD_TYPE_FILE},
+		}
+		if size > segmentSize {
+			badCases = append(badCases, badCase{"cut at a segment", sealed[:prefixSize+segmentSize+segmentOver], id, format.RECORD_TYPE_FILE})
+		}
+		for _, bad := range badCases {
+			_, err := io.ReadAll(key.NewReader(bytes.NewReader(bad.sealed), bad.id, bad.rtype, format.COMPRESSION_NONE))
+			if !errors.Is(err, ErrDecrypt) {
+				t.Errorf("%d bytes, %v: expected ErrDecrypt, got %v", size, bad.name, err)
+			}
+		}
+	}
+}
+
+func TestUnwrap(t *testing.T) {
+	alice, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	bob, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	key, enc, err := NewKey([]byte("passphrase"), []*ecdh.PublicKey{alice.PublicKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := NewID()
+	sealed, err := key.SealMetadata(id, []byte("metadata"), format.RECORD_TYPE_FILE, format.COMPRESSION_ZSTD)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name       string
+		passphrase []byte
+		identities []*ecdh.PrivateKey
+		err        error
+	}{
+		{"passphrase", []byte("passphrase"), nil, nil},
+		{"identity", nil, []*ecdh.PrivateKey{bob, alice}, nil},
+		{"wrong passphrase", []byte("password"), nil, ErrNoKey},
+		{"wrong identity", nil, []*ecdh.PrivateKey{bob}, ErrNoKey},
+		{"nothing", nil, nil, ErrNoKey},
+	}
+	for _, tc := range testCases {
+		unwrapped, err := Unwrap(enc, tc.passphrase, tc.identities)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%v: expected %v, got %v", tc.name, tc.err, err)
+		}
+		if err != nil {
+			continue
+		}
+		metadata, err := unwrapped.OpenMetadata(sealed, format.RECORD_TYPE_FILE, format.COMPRESSION_ZSTD)
+		if err != nil || string(metadata) != "metadata" {
+			t.Errorf("%v: got %q, %v", tc.name, metadata, err)
+		}
+	}
+
+	// Parameters that would take too long or too much memory aren't tried.
+	for name, change := range map[string]func(*format.WrappedKey){
+		"time":    func(k *format.WrappedKey) { k.Time = 1 << 30 },
+		"memory":  func(k *format.WrappedKey) { k.Memory = 1 << 30 },
+		"threads": func(k *format.WrappedKey) { k.Threads = 255 },
+	} {
+		greedy := *enc
+		greedy.Keys = []format.WrappedKey{enc.Keys[0]}
+		change(&greedy.Keys[0])
+		if _, err := Unwrap(&greedy, []byte("passphrase"), nil); !errors.Is(err, ErrNoKey) {
+			t.Errorf("%v: expected ErrNoKey, got %v", name, err)
+		}
+	}
+
+	if _, err := Unwrap(&format.Encryption{Algorithm: "rot13"}, nil, nil); !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Errorf("expected ErrUnknownAlgorithm, got %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+// Package encryption encrypts the metadata and bodies of archive records with
+// XChaCha20-Poly1305. Each archive has a key of its own, which is kept in the start of
+// archive record wrapped for each passphrase (with Argon2id) or X25519 recipient that
+// can open it.
+//
+// Records stay where they would be unencrypted, each sealed on its own, so encrypted
+// archives keep their block structure and can still be read a record at a time.
+package encryption
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/indrora/ponzu/ponzu/format"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+var (
+	ErrNoKey            = errors.New("no passphrase or identity given opens the archive")
+	ErrDecrypt          = errors.New("decryption failed: wrong key or damaged record")
+	ErrUnknownAlgorithm = errors.New("unknown encryption algorithm")
+)
+
+// Argon2id parameters for passphrases: 3 passes over 64MiB, on 4 threads.
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024 // KiB
+	argonThreads = 4
+
+	// Wrapped keys asking for more than four times any of these are not tried: the
+	// parameters come from the archive, which could otherwise tie up the reader for
+	// as long and in as much memory as it liked.
+	maxArgonTime    = 4 * argonTime
+	maxArgonMemory  = 4 * argonMemory
+	maxArgonThreads = 4 * argonThreads
+
+	saltSize = 16
+)
+
+// Key is the key an archive's records are encrypted with.
+type Key struct {
+	raw []byte
+}
+
+// NewKey makes a new key for an archive, wrapped for the passphrase (if there is one)
+// and each of the recipients. The Encryption returned goes in the start of archive.
+func NewKey(passphrase []byte, recipients []*ecdh.PublicKey) (*Key, *format.Encryption, error) {
+	key := &Key{raw: make([]byte, chacha20poly1305.KeySize)}
+	if _, err := rand.Read(key.raw); err != nil {
+		return nil, nil, err
+	}
+
+	enc := &format.Encryption{Algorithm: format.ENCRYPTION_XCHACHA20POLY1305}
+	if passphrase != nil {
+		wrapped, err := key.wrapPassphrase(passphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+		enc.Keys = append(enc.Keys, *wrapped)
+	}
+	for _, recipient := range recipients {
+		wrapped, err := key.wrapRecipient(recipient)
+		if err != nil {
+			return nil, nil, err
+		}
+		enc.Keys = append(enc.Keys, *wrapped)
+	}
+	return key, enc, nil
+}
+
+// Unwrap recovers the key of an archive with the passphrase, if there is one, or any of
+// the identities: X25519 private keys the archive was encrypted for.
+func Unwrap(enc *format.Encryption, passphrase []byte, identities []*ecdh.PrivateKey) (*Key, error) {
+	if enc.Algorithm != format.ENCRYPTION_XCHACHA20POLY1305 {
+		return nil, fmt.Errorf("%w %q", ErrUnknownAlgorithm, enc.Algorithm)
+	}
+	for i := range enc.Keys {
+		wrapped := &enc.Keys[i]
+		switch wrapped.Type {
+		case format.KEY_TYPE_ARGON2ID:
+			if passphrase == nil || wrapped.Time == 0 || wrapped.Threads == 0 ||
+				wrapped.Time > maxArgonTime || wrapped.Memory > maxArgonMemory || wrapped.Threads > maxArgonThreads {
+				continue
+			}
+			kek := argon2.IDKey(passphrase, wrapped.Salt, wrapped.Time, wrapped.Memory, wrapped.Threads, chacha20poly1305.KeySize)
+			if key, err := unseal(kek, wrapped.Key); err == nil {
+				return key, nil
+			}
+		case format.KEY_TYPE_X25519:
+			ephemeral, err := ecdh.X25519().NewPublicKey(wrapped.Ephemeral)
+			if err != nil {
+				continue
+			}
+			for _, identity := range identities {
+				kek, err := agree(identity, ephemeral, ephemeral, identity.PublicKey())
+				if err != nil {
+					continue
+				}
+				if key, err := unseal(kek, wrapped.Key); err == nil {
+					return key, nil
+				}
+			}
+		}
+	}
+	return nil, ErrNoKey
+}
+
+func (key *Key) wrapPassphrase(passphrase []byte) (*format.WrappedKey, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	kek := argon2.IDKey(passphrase, salt, argonTime, argonMemory, argonThreads, chacha20poly1305.KeySize)
+	sealed, err := key.seal(kek)
+	if err != nil {
+		return nil, err
+	}
+	return &format.WrappedKey{
+		Type:    format.KEY_TYPE_ARGON2ID,
+		Salt:    salt,
+		Time:    argonTime,
+		Memory:  argonMemory,
+		Threads: argonThreads,
+		Key:     sealed,
+	}, nil
+}
+
+func (key *Key) wrapRecipient(recipient *ecdh.PublicKey) (*format.WrappedKey, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	kek, err := agree(ephemeral, recipient, ephemeral.PublicKey(), recipient)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := key.seal(kek)
+	if err != nil {
+		return nil, err
+	}
+	return &format.WrappedKey{
+		Type:      format.KEY_TYPE_X25519,
+		Ephemeral: ephemeral.PublicKey().Bytes(),
+		Key:       sealed,
+	}, nil
+}
+
+// agree works out the key that wraps an archive key for a recipient, from the X25519
+// shared secret of one side's private key and the other's public key. Both the
+// ephemeral and the recipient's public keys go into it, so it is only good for them.
+func agree(private *ecdh.PrivateKey, public *ecdh.PublicKey, ephemeral *ecdh.PublicKey, recipient *ecdh.PublicKey) ([]byte, error) {
+	shared, err := private.ECDH(public)
+	if err != nil {
+		return nil, err
+	}
+	salt := append(ephemeral.Bytes(), recipient.Bytes()...)
+	kek := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte("ponzu x25519")), kek); err != nil {
+		return nil, err
+	}
+	return kek, nil
+}
+
+// seal wraps the key with another: a random nonce followed by the sealed key.
+func (key *Key) seal(kek []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(kek)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(key.raw)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, key.raw, []byte("ponzu key")), nil
+}
+
+// unseal is the other side of seal.
+func unseal(kek []byte, sealed []byte) (*Key, error) {
+	aead, err := chacha20poly1305.NewX(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	raw, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte("ponzu key"))
+	if err != nil || len(raw) != chacha20poly1305.KeySize {
+		return nil, ErrDecrypt
+	}
+	return &Key{raw: raw}, nil
+}
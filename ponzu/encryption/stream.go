@@ -0,0 +1,263 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+
+	"github.com/indrora/ponzu/ponzu/format"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Bodies are sealed in segments of this much plaintext, following the STREAM
+// construction: each segment's nonce is a random prefix for the body, the number of
+// the segment, and whether it is the last one, so segments can be neither reordered
+// nor cut off.
+const segmentSize = 64 * 1024
+
+const (
+	prefixSize  = chacha20poly1305.NonceSizeX - 5
+	segmentOver = chacha20poly1305.Overhead
+)
+
+// IDSize is the size of the random ID of an encrypted record, which is also the nonce
+// its metadata is sealed with.
+const IDSize = chacha20poly1305.NonceSizeX
+
+// NewID makes the ID for a record about to be encrypted.
+func NewID() ([]byte, error) {
+	id := make([]byte, IDSize)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// ID is the ID of a record, from its sealed metadata. It is nil if the metadata is too
+// short to have one.
+func ID(sealedMetadata []byte) []byte {
+	if len(sealedMetadata) < IDSize {
+		return nil
+	}
+	return sealedMetadata[:IDSize]
+}
+
+// additionalData ties what is sealed to the kind of record it is in, so that it can't
+// be passed off as something else. A body is tied to the ID of its record as well, so
+// that it can't be moved under the metadata of another.
+func additionalData(kind string, rtype format.RecordType, compression format.CompressionType, id []byte) []byte {
+	ad := append([]byte("ponzu "+kind), byte(rtype), byte(compression))
+	return append(ad, id...)
+}
+
+func (key *Key) aead() cipher.AEAD {
+	aead, err := chacha20poly1305.NewX(key.raw)
+	if err != nil {
+		// The key is always the right size.
+		panic(err)
+	}
+	return aead
+}
+
+// SealMetadata encrypts the metadata of a record: the ID of the record, which is the
+// nonce, followed by the sealed metadata. The ID must be one from NewID.
+func (key *Key) SealMetadata(id []byte, metadata []byte, rtype format.RecordType, compression format.CompressionType) ([]byte, error) {
+	aead := key.aead()
+	sealed := make([]byte, 0, len(id)+len(metadata)+aead.Overhead())
+	sealed = append(sealed, id...)
+	return aead.Seal(sealed, id, metadata, additionalData("metadata", rtype, compression, nil)), nil
+}
+
+// OpenMetadata decrypts metadata sealed with SealMetadata.
+func (key *Key) OpenMetadata(sealed []byte, rtype format.RecordType, compression format.CompressionType) ([]byte, error) {
+	aead := key.aead()
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	metadata, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData("metadata", rtype, compression, nil))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return metadata, nil
+}
+
+// Seal encrypts the whole body of a record at once, as NewWriter would.
+func (key *Key) Seal(data []byte, id []byte, rtype format.RecordType, compression format.CompressionType) ([]byte, error) {
+	buff := bytes.NewBuffer(make([]byte, 0, SealedSize(int64(len(data)))))
+	w := key.NewWriter(buff, id, rtype, compression)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+// SealedSize is how long a body of n bytes is once it is sealed.
+func SealedSize(n int64) int64 {
+	// A full last segment is the last one; there is never an empty one after it.
+	segments := (n + segmentSize - 1) / segmentSize
+	if segments == 0 {
+		segments = 1
+	}
+	return prefixSize + n + segments*segmentOver
+}
+
+// NewWriter encrypts the body of a record with the given ID as it is written to w.
+// Closing the writer seals the last segment, but leaves w open.
+func (key *Key) NewWriter(w io.Writer, id []byte, rtype format.RecordType, compression format.CompressionType) io.WriteCloser {
+	return &sealer{
+		aead: key.aead(),
+		w:    w,
+		ad:   additionalData("data", rtype, compression, id),
+		buf:  make([]byte, 0, segmentSize+segmentOver),
+	}
+}
+
+// NewReader decrypts the body of the record with the given ID as it is read from r. A
+// body that has been tampered with, cut short, sealed with another key or taken from
+// another record gives ErrDecrypt.
+func (key *Key) NewReader(r io.Reader, id []byte, rtype format.RecordType, compression format.CompressionType) io.Reader {
+	return &opener{
+		aead: key.aead(),
+		r:    r,
+		ad:   additionalData("data", rtype, compression, id),
+		buf:  make([]byte, segmentSize+segmentOver+1),
+	}
+}
+
+// nonce is the nonce of a segment.
+func nonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[prefixSize:], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+type sealer struct {
+	aead    cipher.AEAD
+	w       io.Writer
+	ad      []byte
+	prefix  []byte
+	counter uint32
+	buf     []byte // plaintext of the current segment
+	err     error
+}
+
+func (s *sealer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 && s.err == nil {
+		if len(s.buf) == segmentSize {
+			// Only seal a full segment once there is more to come, as it might be the last.
+			s.err = s.flush(false)
+			continue
+		}
+		n := copy(s.buf[len(s.buf):segmentSize], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		written += n
+		p = p[n:]
+	}
+	return written, s.err
+}
+
+// flush seals the current segment and writes it out.
+func (s *sealer) flush(last bool) error {
+	if s.prefix == nil {
+		s.prefix = make([]byte, prefixSize)
+		if _, err := rand.Read(s.prefix); err != nil {
+			return err
+		}
+		if _, err := s.w.Write(s.prefix); err != nil {
+			return err
+		}
+	}
+	sealed := s.aead.Seal(s.buf[:0], nonce(s.prefix, s.counter, last), s.buf, s.ad)
+	s.counter++
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(sealed)
+	return err
+}
+
+func (s *sealer) Close() error {
+	if s.err != nil {
+		return s.err
+	}
+	s.err = s.flush(true)
+	if s.err == nil {
+		s.err = io.ErrClosedPipe
+		return nil
+	}
+	return s.err
+}
+
+type opener struct {
+	aead    cipher.AEAD
+	r       io.Reader
+	ad      []byte
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	plain   []byte // what is left of the current segment
+	next    []byte // the first byte of the next segment, if it has been read
+	last    bool
+	err     error
+}
+
+func (o *opener) Read(p []byte) (int, error) {
+	for len(o.plain) == 0 && o.err == nil {
+		if o.last {
+			o.err = io.EOF
+			break
+		}
+		o.err = o.open()
+	}
+	if len(o.plain) > 0 {
+		n := copy(p, o.plain)
+		o.plain = o.plain[n:]
+		return n, nil
+	}
+	return 0, o.err
+}
+
+// open reads and decrypts the next segment. Whether it is the last is found by trying
+// to read one byte past it.
+func (o *opener) open() error {
+	if o.prefix == nil {
+		o.prefix = make([]byte, prefixSize)
+		if _, err := io.ReadFull(o.r, o.prefix); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrDecrypt
+		} else if err != nil {
+			return err
+		}
+	}
+
+	n := copy(o.buf, o.next)
+	m, err := io.ReadFull(o.r, o.buf[n:])
+	n += m
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	segment := o.buf[:n]
+	o.next = nil
+	if n == len(o.buf) {
+		segment = o.buf[:n-1]
+		o.next = []byte{o.buf[n-1]}
+	} else {
+		o.last = true
+	}
+
+	plain, err := o.aead.Open(segment[:0], nonce(o.prefix, o.counter, o.last), segment, o.ad)
+	if err != nil {
+		return ErrDecrypt
+	}
+	o.counter++
+	o.plain = plain
+	return nil
+}
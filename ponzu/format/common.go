@@ -60,15 +60,10 @@ func NewPreamble(
 	bcount := uint64(0)
 	modulo := uint16(0)
 
-	if length == 0 {
-		bcount = 0
-		modulo = 0
-	} else if length > 1 && length <= uint64(BLOCK_SIZE) {
-		bcount = 1 // always a minimum of 1
-		modulo = uint16(length)
-	} else {
-		bcount = 1 + (length / uint64(BLOCK_SIZE))
-		modulo = uint16(length % uint64(BLOCK_SIZE))
+	if length != 0 {
+		// The final block is always counted, even when it is completely full.
+		bcount = (length + BLOCK_SIZE - 1) / BLOCK_SIZE
+		modulo = uint16(length - ((bcount - 1) * BLOCK_SIZE))
 	}
 
 	return Preamble{
@@ -114,6 +109,16 @@ func ReadPreamble(r io.Reader) (*Preamble, error) {
 
 }
 
+// IsStartOfArchive is true for a start of archive record, whatever else it is flagged with.
+func (p *Preamble) IsStartOfArchive() bool {
+	return p.Rtype == RECORD_TYPE_CONTROL && p.Flags&RECORD_FLAG_CONTROL_START != 0
+}
+
+// IsEndOfArchive is true for an end of archive record, whatever else it is flagged with.
+func (p *Preamble) IsEndOfArchive() bool {
+	return p.Rtype == RECORD_TYPE_CONTROL && p.Flags&RECORD_FLAG_CONTROL_END != 0
+}
+
 const BLOCK_SIZE uint64 = 4096
 
 const (
@@ -127,19 +132,39 @@ const (
 	RECORD_TYPE_CONTINUE    RecordType = 127
 )
 
+// Implementation defined record types (> 127)
+const (
+	// Index of the records in an archive, written just before the end of archive.
+	RECORD_TYPE_INDEX RecordType = 128
+	// Signature over the records before it, written just before the end of archive.
+	RECORD_TYPE_SIGNATURE RecordType = 129
+	// Reed-Solomon parity over the blocks before it, written every so many blocks.
+	RECORD_TYPE_PARITY RecordType = 130
+)
+
 const (
 	RECORD_FLAG_NONE          RecordFlags = 0b00
 	RECORD_FLAG_CONTROL_START RecordFlags = 0b1
 	RECORD_FLAG_CONTROL_END   RecordFlags = 0b10
 	RECORD_FLAG_CONTINUES     RecordFlags = 0b10
+
+	// On a start of archive: the archive was written on the fly, and records in it
+	// may carry an all-zero data checksum.
+	RECORD_FLAG_CONTROL_STREAMED RecordFlags = 0b100
+
+	// The metadata and body of the record are encrypted with the key of the archive.
+	RECORD_FLAG_ENCRYPTED RecordFlags = 0x100
 )
 
 type CompressionType uint8
 
 const (
-	COMPRESSION_NONE   CompressionType = 0
-	COMPRESSION_ZSTD   CompressionType = 1
-	COMPRESSION_BROTLI CompressionType = 3
+	COMPRESSION_NONE    CompressionType = 0
+	COMPRESSION_ZSTD    CompressionType = 1
+	COMPRESSION_BROTLI  CompressionType = 3 // 2 is reserved: the spec once gave it to Brotli, but archives have always used 3
+	COMPRESSION_LZ4     CompressionType = 4
+	COMPRESSION_XZ      CompressionType = 5
+	COMPRESSION_DEFLATE CompressionType = 6
 )
 
 const (
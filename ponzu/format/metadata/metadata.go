@@ -1,9 +1,18 @@
 package metadata
 
 import (
+	"errors"
+	"io/fs"
+	"os"
 	"time"
 
 	"github.com/fxamacker/cbor/v2"
+	"github.com/indrora/ponzu/ponzu/format"
+)
+
+var (
+	ErrUnknownUser  = errors.New("no such user")
+	ErrUnknownGroup = errors.New("no such group")
 )
 
 func MakePointer[T any](x T) *T {
@@ -46,7 +55,7 @@ type UNIXMetadata struct {
 type LinuxMetadata struct {
 	UNIXMetadata
 	SelinuxLabel   *string `cbor:"selinux_label,omitempty"`
-	SelinuxContext *string `cbor:"selinux_context.omitempty"`
+	SelinuxContext *string `cbor:"selinux_context,omitempty"`
 	Capabilities   *uint64 `cbor:"caps,omitempty"`
 }
 
@@ -69,6 +78,51 @@ type DarwinMetadata struct {
 	UNIXMetadata
 }
 
+// Decode turns the metadata map of a record into the metadata type used by the host
+// that wrote the archive. Archives from generic or unknown hosts only get the common
+// metadata, so that nothing about the file's attributes is inferred from them.
+func Decode(host string, raw any) any {
+	rawMap, ok := raw.(map[any]any)
+	if !ok {
+		return nil
+	}
+
+	var meta any
+	switch host {
+	case format.HOST_OS_LINUX, format.HOST_OS_SELINUX:
+		meta, ok = TransmogrifyCbor[LinuxMetadata](rawMap)
+	case format.HOST_OS_UNIX:
+		meta, ok = TransmogrifyCbor[UNIXMetadata](rawMap)
+	case format.HOST_OS_POSIX:
+		meta, ok = TransmogrifyCbor[POSIXMetadata](rawMap)
+	case format.HOST_OS_DARWIN:
+		meta, ok = TransmogrifyCbor[DarwinMetadata](rawMap)
+	case format.HOST_OS_NT:
+		meta, ok = TransmogrifyCbor[WinNTMetadata](rawMap)
+	default:
+		meta, ok = TransmogrifyCbor[CommonMetadata](rawMap)
+	}
+	if !ok {
+		return nil
+	}
+	return meta
+}
+
+// GetMetadataForPath collects the metadata for a file, without following symbolic links.
+// What is collected depends on the host; see GetMetadata.
 func GetMetadataForPath(filepath string) (any, error) {
-	return CommonMetadata{}, nil
+	info, err := os.Lstat(filepath)
+	if err != nil {
+		return nil, err
+	}
+	return GetMetadata(filepath, info)
+}
+
+// commonMetadata fills in the metadata that every host knows about.
+func commonMetadata(info fs.FileInfo) CommonMetadata {
+	common := CommonMetadata{}
+	if info.Mode().IsRegular() {
+		common.FileSize = MakePointer(uint64(info.Size()))
+	}
+	return common
 }
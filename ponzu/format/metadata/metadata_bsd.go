@@ -0,0 +1,17 @@
+//go:build unix && !linux && !darwin
+
+package metadata
+
+import (
+	"io/fs"
+
+	"github.com/indrora/ponzu/ponzu/format"
+)
+
+// Host is the kind of host that GetMetadata collects metadata for.
+const Host = format.HOST_OS_UNIX
+
+// GetMetadata collects the metadata for a file as UNIXMetadata.
+func GetMetadata(filepath string, info fs.FileInfo) (any, error) {
+	return unixMetadata(filepath, info), nil
+}
@@ -0,0 +1,17 @@
+//go:build darwin
+
+package metadata
+
+import (
+	"io/fs"
+
+	"github.com/indrora/ponzu/ponzu/format"
+)
+
+// Host is the kind of host that GetMetadata collects metadata for.
+const Host = format.HOST_OS_DARWIN
+
+// GetMetadata collects the metadata for a file as DarwinMetadata.
+func GetMetadata(filepath string, info fs.FileInfo) (any, error) {
+	return DarwinMetadata{UNIXMetadata: unixMetadata(filepath, info)}, nil
+}
@@ -0,0 +1,62 @@
+//go:build linux
+
+package metadata
+
+import (
+	"encoding/binary"
+	"io/fs"
+	"strings"
+
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/pkg/xattr"
+)
+
+// Host is the kind of host that GetMetadata collects metadata for.
+const Host = format.HOST_OS_LINUX
+
+const xattrCapability = "security.capability"
+
+// GetMetadata collects the metadata for a file as LinuxMetadata: the UNIX metadata,
+// along with the SELinux label and file capabilities if it has them.
+//
+// The SELinux label is kept out of the extended attributes, as it is recorded on its
+// own. File capabilities are left in, as the permitted set is all that fits in caps.
+func GetMetadata(filepath string, info fs.FileInfo) (any, error) {
+	meta := LinuxMetadata{
+		UNIXMetadata: unixMetadata(filepath, info, xattrSelinux),
+	}
+
+	if label, err := xattr.LGet(filepath, xattrSelinux); err == nil && len(label) > 0 {
+		meta.SelinuxLabel = MakePointer(strings.TrimRight(string(label), "\x00"))
+	}
+	if meta.Xattribs != nil {
+		if caps, ok := decodeCapabilities((*meta.Xattribs)[xattrCapability]); ok {
+			meta.Capabilities = &caps
+		}
+	}
+
+	return meta, nil
+}
+
+// decodeCapabilities pulls the permitted set out of a security.capability attribute
+// (struct vfs_cap_data, which is little-endian).
+func decodeCapabilities(data []byte) (uint64, bool) {
+	const (
+		revisionMask = 0xFF000000
+		revision1    = 0x01000000
+	)
+
+	if len(data) < 8 {
+		return 0, false
+	}
+	magic := binary.LittleEndian.Uint32(data[0:4])
+	caps := uint64(binary.LittleEndian.Uint32(data[4:8]))
+	if magic&revisionMask != revision1 {
+		// Revisions 2 and 3 carry a second set of 32 capabilities.
+		if len(data) < 16 {
+			return 0, false
+		}
+		caps |= uint64(binary.LittleEndian.Uint32(data[12:16])) << 32
+	}
+	return caps, true
+}
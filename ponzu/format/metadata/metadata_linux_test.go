@@ -0,0 +1,111 @@
+package metadata
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/pkg/xattr"
+)
+
+func TestGetMetadataLinux(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "thing.txt")
+	if err := os.WriteFile(fname, []byte("hello"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(fname, 0640|os.ModeSetgid)
+	hasXattr := xattr.LSet(fname, "user.ponzu", []byte("value")) == nil
+
+	raw, err := GetMetadataForPath(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, ok := raw.(LinuxMetadata)
+	if !ok {
+		t.Fatalf("expected LinuxMetadata, got %T", raw)
+	}
+
+	if meta.FileSize == nil || *meta.FileSize != 5 {
+		t.Error("expected the file size to be filled in")
+	}
+	if meta.Mode == nil || *meta.Mode != 0o2640 {
+		t.Errorf("expected mode 2640, got %v", meta.Mode)
+	}
+	if me, err := user.Current(); err == nil && (meta.Owner == nil || *meta.Owner != me.Username) {
+		t.Errorf("expected owner %v, got %v", me.Username, meta.Owner)
+	}
+	if hasXattr && (meta.Xattribs == nil || string((*meta.Xattribs)["user.ponzu"]) != "value") {
+		t.Error("expected the extended attribute to be collected")
+	}
+}
+
+func TestDecodeCapabilities(t *testing.T) {
+	// cap_net_bind_service (10) and cap_mac_admin (33), revision 2, effective.
+	data := []byte{
+		0x01, 0x00, 0x00, 0x02,
+		0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+	caps, ok := decodeCapabilities(data)
+	if !ok || caps != 1<<10|1<<33 {
+		t.Errorf("unexpected capabilities %x", caps)
+	}
+	if _, ok = decodeCapabilities(data[:4]); ok {
+		t.Error("expected a short attribute to be rejected")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	dir := t.TempDir()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	os.WriteFile(source, []byte("hello"), 0600)
+	os.WriteFile(dest, []byte("hello"), 0644)
+	os.Chmod(source, 0700|os.ModeSticky)
+
+	collected, err := GetMetadataForPath(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Go through CBOR, as the reader would.
+	encoded, _ := cbor.Marshal(collected)
+	var raw any
+	cbor.Unmarshal(encoded, &raw)
+
+	// A generic archive never has anything applied.
+	if err = Restore(dest, Decode(format.HOST_OS_GENERIC, raw), true); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(dest); info.Mode() != 0644 {
+		t.Errorf("expected a universe archive to leave the mode alone, got %v", info.Mode())
+	}
+
+	if err = Restore(dest, Decode(format.HOST_OS_LINUX, raw), false); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(dest); info.Mode() != 0700|os.ModeSticky {
+		t.Errorf("expected the mode to be restored, got %v", info.Mode())
+	}
+
+	// Attributes go on before the file is made read-only, which would stop anyone but
+	// root setting them.
+	if err = xattr.LSet(source, "user.ponzu", []byte("cheese")); err != nil {
+		t.Skip("can't set user attributes here:", err)
+	}
+	os.Chmod(source, 0444)
+	os.Chmod(dest, 0644)
+	collected, _ = GetMetadataForPath(source)
+	encoded, _ = cbor.Marshal(collected)
+	cbor.Unmarshal(encoded, &raw)
+	if err = Restore(dest, Decode(format.HOST_OS_LINUX, raw), false); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := xattr.LGet(dest, "user.ponzu"); err != nil || string(value) != "cheese" {
+		t.Errorf("expected the attribute to be restored, got %q, %v", value, err)
+	}
+	if info, _ := os.Stat(dest); info.Mode() != 0444 {
+		t.Errorf("expected the mode to be restored, got %v", info.Mode())
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !unix
+
+package metadata
+
+import (
+	"io/fs"
+
+	"github.com/indrora/ponzu/ponzu/format"
+)
+
+// Host is the kind of host that GetMetadata collects metadata for.
+const Host = format.HOST_OS_GENERIC
+
+// GetMetadata collects the metadata for a file. Nothing is known about this host,
+// so that is only the common metadata.
+func GetMetadata(filepath string, info fs.FileInfo) (any, error) {
+	return commonMetadata(info), nil
+}
+
+// Restore puts the metadata of a record back onto a file that has been extracted.
+// There is nothing this host knows how to restore.
+func Restore(filepath string, meta any, owner bool) error {
+	return nil
+}
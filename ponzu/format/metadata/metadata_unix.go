@@ -0,0 +1,184 @@
+//go:build unix
+
+package metadata
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/xattr"
+)
+
+const xattrSelinux = "security.selinux"
+
+// Looking up users and groups means reading (at least) /etc/passwd and /etc/group,
+// so the answers are kept around: archives tend to have a lot of files with the
+// same owner.
+var (
+	namesLock  sync.Mutex
+	userNames  = map[uint32]string{}
+	groupNames = map[uint32]string{}
+)
+
+// userName finds the name of a user. If the user has no name, the numeric ID is used.
+func userName(uid uint32) string {
+	namesLock.Lock()
+	defer namesLock.Unlock()
+
+	name, ok := userNames[uid]
+	if !ok {
+		name = strconv.FormatUint(uint64(uid), 10)
+		if u, err := user.LookupId(name); err == nil {
+			name = u.Username
+		}
+		userNames[uid] = name
+	}
+	return name
+}
+
+// groupName finds the name of a group. If the group has no name, the numeric ID is used.
+func groupName(gid uint32) string {
+	namesLock.Lock()
+	defer namesLock.Unlock()
+
+	name, ok := groupNames[gid]
+	if !ok {
+		name = strconv.FormatUint(uint64(gid), 10)
+		if g, err := user.LookupGroupId(name); err == nil {
+			name = g.Name
+		}
+		groupNames[gid] = name
+	}
+	return name
+}
+
+// unixMetadata fills in the owner, group, mode and extended attributes of a file.
+// Attributes named in skip are left out.
+func unixMetadata(filepath string, info fs.FileInfo, skip ...string) UNIXMetadata {
+	meta := UNIXMetadata{
+		CommonMetadata: commonMetadata(info),
+	}
+
+	if info.Mode()&fs.ModeSymlink == 0 {
+		// Links don't have a mode of their own worth speaking of.
+		meta.Mode = MakePointer(UnixMode(info.Mode()))
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		meta.Owner = MakePointer(userName(uint32(stat.Uid)))
+		meta.Group = MakePointer(groupName(uint32(stat.Gid)))
+	}
+
+	if attrs := readXattrs(filepath, skip); len(attrs) > 0 {
+		meta.Xattribs = &attrs
+	}
+	return meta
+}
+
+// readXattrs reads the extended attributes of a file, without following links.
+// Extended attributes are collected on a best-effort basis: a filesystem that doesn't
+// support them, or an attribute that can't be read, is not worth failing over.
+func readXattrs(filepath string, skip []string) map[string][]byte {
+	names, err := xattr.LList(filepath)
+	if err != nil {
+		return nil
+	}
+
+	attrs := make(map[string][]byte, len(names))
+names:
+	for _, name := range names {
+		for _, s := range skip {
+			if name == s {
+				continue names
+			}
+		}
+		if value, err := xattr.LGet(filepath, name); err == nil {
+			attrs[name] = value
+		}
+	}
+	return attrs
+}
+
+// Restore puts the metadata of a record back onto a file that has been extracted:
+// the owner and group (only if owner is set, as it generally takes root to give a
+// file away), mode, extended attributes and SELinux label. Links are never followed.
+//
+// Everything that can be restored is; the errors from whatever couldn't be are
+// joined together and returned.
+func Restore(filepath string, meta any, owner bool) error {
+	var unixMeta *UNIXMetadata
+	var label *string
+	switch m := meta.(type) {
+	case *UNIXMetadata:
+		unixMeta = m
+	case *LinuxMetadata:
+		unixMeta, label = &m.UNIXMetadata, m.SelinuxLabel
+	case *POSIXMetadata:
+		unixMeta = &m.UNIXMetadata
+	case *DarwinMetadata:
+		unixMeta = &m.UNIXMetadata
+	default:
+		// Nothing that can be applied here.
+		return nil
+	}
+
+	info, err := os.Lstat(filepath)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	// Ownership goes first: changing it clears setuid bits and file capabilities. The
+	// mode goes last, as once a file is read-only only root can set its attributes.
+	if owner && (unixMeta.Owner != nil || unixMeta.Group != nil) {
+		if err := restoreOwner(filepath, unixMeta.Owner, unixMeta.Group); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if unixMeta.Xattribs != nil {
+		for name, value := range *unixMeta.Xattribs {
+			if err := xattr.LSet(filepath, name, value); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if label != nil {
+		// Not every system has SELinux; there is nothing to be done about that.
+		if err := xattr.LSet(filepath, xattrSelinux, []byte(*label)); err != nil && !errors.Is(err, syscall.ENOTSUP) {
+			errs = append(errs, err)
+		}
+	}
+	if unixMeta.Mode != nil && info.Mode()&fs.ModeSymlink == 0 {
+		if err := os.Chmod(filepath, FileMode(*unixMeta.Mode)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// restoreOwner changes the owner and group of a file by name, falling back to reading
+// the name as a numeric ID if there's no user or group by that name.
+func restoreOwner(filepath string, owner *string, group *string) error {
+	uid, gid := -1, -1
+	if owner != nil {
+		if u, err := user.Lookup(*owner); err == nil {
+			uid, _ = strconv.Atoi(u.Uid)
+		} else if uid, err = strconv.Atoi(*owner); err != nil {
+			return fmt.Errorf("%w: %v", ErrUnknownUser, *owner)
+		}
+	}
+	if group != nil {
+		if g, err := user.LookupGroup(*group); err == nil {
+			gid, _ = strconv.Atoi(g.Gid)
+		} else if gid, err = strconv.Atoi(*group); err != nil {
+			return fmt.Errorf("%w: %v", ErrUnknownGroup, *group)
+		}
+	}
+	return os.Lchown(filepath, uid, gid)
+}
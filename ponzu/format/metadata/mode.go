@@ -0,0 +1,40 @@
+package metadata
+
+import "io/fs"
+
+// Bits of a UNIX (chmod compatible) mode that aren't plain permissions.
+const (
+	modeSetuid = 0o4000
+	modeSetgid = 0o2000
+	modeSticky = 0o1000
+)
+
+// UnixMode converts the permission bits of a Go file mode to a chmod compatible mode.
+func UnixMode(mode fs.FileMode) uint16 {
+	unixMode := uint16(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		unixMode |= modeSetuid
+	}
+	if mode&fs.ModeSetgid != 0 {
+		unixMode |= modeSetgid
+	}
+	if mode&fs.ModeSticky != 0 {
+		unixMode |= modeSticky
+	}
+	return unixMode
+}
+
+// FileMode converts a chmod compatible mode to the permission bits of a Go file mode.
+func FileMode(unixMode uint16) fs.FileMode {
+	mode := fs.FileMode(unixMode) & fs.ModePerm
+	if unixMode&modeSetuid != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if unixMode&modeSetgid != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if unixMode&modeSticky != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
@@ -29,6 +29,101 @@ type StartOfArchive struct {
 	Prefix string `cbor:"2,keyasint"`
 	// Comment for the archive (open text field)
 	Comment string `cbor:"3,keyasint"`
+	// How the records in the archive are encrypted, if they are
+	Encryption *Encryption `cbor:"4,keyasint,omitempty"`
+}
+
+// The only encryption algorithm there is, for now.
+const ENCRYPTION_XCHACHA20POLY1305 = "xchacha20poly1305"
+
+// Ways the key of an encrypted archive can be wrapped.
+const (
+	// Argon2id, from a passphrase
+	KEY_TYPE_ARGON2ID = "argon2id"
+	// X25519, for a recipient's public key
+	KEY_TYPE_X25519 = "x25519"
+)
+
+// Encryption describes how the records of an archive are encrypted. Every record but
+// control and signature records is encrypted with the same key, which is kept here
+// wrapped once for each passphrase or recipient that can open the archive.
+type Encryption struct {
+	RecordBase
+	Algorithm string       `cbor:"0,keyasint"`
+	Keys      []WrappedKey `cbor:"1,keyasint"`
+}
+
+// A WrappedKey is the key of an archive, sealed with a key of its own. Only the fields
+// for its type are set: Argon2id keys have a salt and cost parameters, and X25519 keys
+// the public half of the ephemeral key the recipient's key is agreed with.
+type WrappedKey struct {
+	Type      string `cbor:"0,keyasint"`
+	Salt      []byte `cbor:"1,keyasint,omitempty"`
+	Time      uint32 `cbor:"2,keyasint,omitempty"`
+	Memory    uint32 `cbor:"3,keyasint,omitempty"`
+	Threads   uint8  `cbor:"4,keyasint,omitempty"`
+	Ephemeral []byte `cbor:"5,keyasint,omitempty"`
+	// The nonce, followed by the sealed key
+	Key []byte `cbor:"6,keyasint"`
+}
+
+// All archives end with an End of Archive record. Every field is optional.
+type EndOfArchive struct {
+	RecordBase
+	// Block number of the index record, if there is one. Block 0 is always the
+	// start of the archive, so 0 means there is no index.
+	Index uint64 `cbor:"0,keyasint,omitempty"`
+	// How many records there are from the start of archive up to this one, leaving
+	// out signature records, and how many data blocks they take up
+	Records    uint64 `cbor:"1,keyasint,omitempty"`
+	DataBlocks uint64 `cbor:"2,keyasint,omitempty"`
+	// Root of a BLAKE2b-512 Merkle tree with a leaf for each of those records: its
+	// metadata checksum followed by its data checksum, as in its preamble
+	MerkleRoot []byte `cbor:"3,keyasint,omitempty"`
+}
+
+// The Index record body maps the names in an archive to the blocks where their records start.
+type Index struct {
+	RecordBase
+	Entries []IndexEntry `cbor:"0,keyasint"`
+	// Block numbers of any zstd dictionary records, in order.
+	Dictionaries []uint64 `cbor:"1,keyasint,omitempty"`
+}
+
+type IndexEntry struct {
+	_     struct{}   `cbor:",toarray"`
+	Name  string     // name of the record
+	Block uint64     // block number the record's preamble starts on
+	Type  RecordType // type of the record
+}
+
+// The only signature algorithm there is, for now.
+const SIGNATURE_ED25519 = "ed25519"
+
+// A Signature record signs the BLAKE2b-512 digest of the preambles of every record
+// before it in the archive, from the start of archive on. It has no body.
+type Signature struct {
+	RecordBase
+	Algorithm string `cbor:"0,keyasint"`
+	PublicKey []byte `cbor:"1,keyasint"`
+	Signature []byte `cbor:"2,keyasint"`
+}
+
+// The only parity algorithm there is, for now: Reed-Solomon over GF(2^8), with the
+// Cauchy matrix of the parity package.
+const PARITY_REED_SOLOMON = "reed-solomon"
+
+// A Parity record holds parity over a run of blocks before it, from which damaged blocks
+// in the run can be rebuilt. Block n of the run is dealt to stripe n mod Stripes, and
+// the body is the Shards parity blocks of each stripe in turn.
+type Parity struct {
+	RecordBase
+	Algorithm string `cbor:"0,keyasint"`
+	// How many blocks before this record the run starts, and how many blocks long it is
+	Before  uint64 `cbor:"1,keyasint"`
+	Blocks  uint64 `cbor:"2,keyasint"`
+	Stripes uint32 `cbor:"3,keyasint"`
+	Shards  uint8  `cbor:"4,keyasint"`
 }
 
 type File struct {
@@ -48,9 +143,52 @@ type Hardlink struct{ Link }
 type Directory struct{ File }
 type ZstdDictionary struct{ RecordBase }
 
+// The only kind of OS special record there is, for now: something made with mknod(2).
+const SPECIAL_TYPE_MKNOD = "mknod"
+
+// OSSpecial is a FIFO, device node or socket. Mode is the full mode given to mknod,
+// including the type of file; Device is the dev_t for device nodes.
 type OSSpecial struct {
 	File
 	SpecialType string `cbor:"-1, keyasint"`
 	Mode        uint32 `cbor:"mknodMode"`
 	Device      uint32 `cbor:"mknodDev"`
 }
+
+// RecordName returns the name of a file-like record (a File, Directory, link or
+// OS special), if it has one. Both values and pointers are accepted.
+func RecordName(record any) (string, bool) {
+	switch r := record.(type) {
+	case File:
+		return r.Name, true
+	case Directory:
+		return r.Name, true
+	case Symlink:
+		return r.Name, true
+	case Hardlink:
+		return r.Name, true
+	case OSSpecial:
+		return r.Name, true
+	case *File:
+		if r != nil {
+			return r.Name, true
+		}
+	case *Directory:
+		if r != nil {
+			return r.Name, true
+		}
+	case *Symlink:
+		if r != nil {
+			return r.Name, true
+		}
+	case *Hardlink:
+		if r != nil {
+			return r.Name, true
+		}
+	case *OSSpecial:
+		if r != nil {
+			return r.Name, true
+		}
+	}
+	return "", false
+}
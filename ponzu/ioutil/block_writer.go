@@ -11,6 +11,7 @@ type BlockWriter struct {
 	writer              io.Writer
 	writtenSinceRealign uint64
 	bsize               uint64
+	offset              uint64
 }
 
 func NewBlockWriter(destination io.Writer, blockSize uint64) *BlockWriter {
@@ -25,6 +26,7 @@ func NewBlockWriter(destination io.Writer, blockSize uint64) *BlockWriter {
 func (k *BlockWriter) Write(p []byte) (n int, err error) {
 	written, err := k.writer.Write(p)
 	k.writtenSinceRealign += uint64(written)
+	k.offset += uint64(written)
 	return written, err
 }
 
@@ -49,7 +51,8 @@ func (k *BlockWriter) Align() error {
 		toWrite := k.bsize - k.writtenSinceRealign
 
 		empty := bytes.Repeat([]byte{0}, int(toWrite))
-		_, err := k.writer.Write(empty)
+		n, err := k.writer.Write(empty)
+		k.offset += uint64(n)
 		if err != nil {
 			return errors.Wrap(err, "Failed to finish out block")
 		}
@@ -58,6 +61,18 @@ func (k *BlockWriter) Align() error {
 	return nil
 }
 
+// Offset is the number of bytes written to the destination so far, including padding.
+func (k *BlockWriter) Offset() uint64 {
+	return k.offset
+}
+
+// Reset sets the offset back to what it was, for when whatever was written past it has
+// been thrown away. The offset must be on a block boundary.
+func (k *BlockWriter) Reset(offset uint64) {
+	k.offset = offset
+	k.writtenSinceRealign = 0
+}
+
 func (k *BlockWriter) Close() error {
 	k.Align()
 
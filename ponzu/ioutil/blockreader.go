@@ -10,6 +10,7 @@ type BlockReader struct {
 	reader       *bufio.Reader
 	ChunkSize    uint64
 	realignBytes uint64
+	offset       uint64
 }
 
 func NewBlockReader(reader io.Reader, chunkSize uint64) *BlockReader {
@@ -25,6 +26,7 @@ func (br *BlockReader) Read(b []byte) (int, error) {
 	read, err := br.reader.Read(b)
 
 	br.realignBytes += uint64(read)
+	br.offset += uint64(read)
 
 	return read, err
 }
@@ -41,7 +43,8 @@ func (br *BlockReader) Realign() error {
 		// Read out the remaining bytes
 
 		buf := make([]byte, br.ChunkSize-br.realignBytes)
-		_, err := io.ReadFull(br.reader, buf)
+		n, err := io.ReadFull(br.reader, buf)
+		br.offset += uint64(n)
 		if err != nil && err != io.EOF {
 			return err
 		}
@@ -53,10 +56,16 @@ func (br *BlockReader) Realign() error {
 
 }
 
+// Offset is the number of bytes consumed from the underlying reader so far.
+func (br *BlockReader) Offset() uint64 {
+	return br.offset
+}
+
 func (br *BlockReader) ReadBlock() ([]byte, error) {
 
 	buffer := new(bytes.Buffer)
 	n, err := io.CopyN(buffer, br.reader, int64(br.ChunkSize))
+	br.offset += uint64(n)
 	if err == io.EOF {
 		if n == 0 {
 			return nil, io.EOF
@@ -0,0 +1,64 @@
+package ioutil
+
+import (
+	"golang.org/x/crypto/blake2b"
+)
+
+// MerkleTree builds a BLAKE2b-512 Merkle tree one leaf at a time, holding on to no
+// more than the roots of its full subtrees.
+//
+// Leaves are hashed as BLAKE2b(0x00 || leaf) and nodes as BLAKE2b(0x01 || left ||
+// right), and a tree of n leaves splits at the largest power of two below n, as in
+// RFC 6962. Moving, dropping or adding a leaf anywhere changes the root.
+type MerkleTree struct {
+	subtrees []subtree // largest first
+	leaves   uint64
+}
+
+type subtree struct {
+	height int
+	hash   []byte
+}
+
+// Add adds a leaf to the tree, made of the given parts one after another.
+func (t *MerkleTree) Add(parts ...[]byte) {
+	h, _ := blake2b.New512(nil)
+	h.Write([]byte{0})
+	for _, part := range parts {
+		h.Write(part)
+	}
+	t.subtrees = append(t.subtrees, subtree{hash: h.Sum(nil)})
+	t.leaves++
+
+	// Two subtrees of the same height make one of the next.
+	for n := len(t.subtrees); n > 1 && t.subtrees[n-2].height == t.subtrees[n-1].height; n-- {
+		left, right := t.subtrees[n-2], t.subtrees[n-1]
+		t.subtrees = append(t.subtrees[:n-2], subtree{height: left.height + 1, hash: node(left.hash, right.hash)})
+	}
+}
+
+// Len is how many leaves have been added.
+func (t *MerkleTree) Len() uint64 {
+	return t.leaves
+}
+
+// Root is the root of the tree so far. The root of an empty tree is BLAKE2b of nothing.
+func (t *MerkleTree) Root() []byte {
+	if len(t.subtrees) == 0 {
+		sum := blake2b.Sum512(nil)
+		return sum[:]
+	}
+	root := t.subtrees[len(t.subtrees)-1].hash
+	for i := len(t.subtrees) - 2; i >= 0; i-- {
+		root = node(t.subtrees[i].hash, root)
+	}
+	return root
+}
+
+func node(left []byte, right []byte) []byte {
+	h, _ := blake2b.New512(nil)
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
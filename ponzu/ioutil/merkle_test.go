@@ -0,0 +1,59 @@
+package ioutil_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/indrora/ponzu/ponzu/ioutil"
+	"golang.org/x/crypto/blake2b"
+)
+
+// merkleRoot is the RFC 6962 Merkle tree hash, worked out the slow way.
+func merkleRoot(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		sum := blake2b.Sum512(nil)
+		return sum[:]
+	}
+	if len(leaves) == 1 {
+		sum := blake2b.Sum512(append([]byte{0}, leaves[0]...))
+		return sum[:]
+	}
+	k := 1
+	for k*2 < len(leaves) {
+		k *= 2
+	}
+	node := append([]byte{1}, merkleRoot(leaves[:k])...)
+	sum := blake2b.Sum512(append(node, merkleRoot(leaves[k:])...))
+	return sum[:]
+}
+
+func TestMerkleTree(t *testing.T) {
+	leaves := [][]byte{}
+	for n := 0; n <= 33; n++ {
+		tree := new(ioutil.MerkleTree)
+		for _, leaf := range leaves {
+			// Parts of a leaf are hashed as one
+			tree.Add(leaf[:1], leaf[1:])
+		}
+		if tree.Len() != uint64(n) {
+			t.Errorf("%d leaves: Len is %d", n, tree.Len())
+		}
+		if !bytes.Equal(tree.Root(), merkleRoot(leaves)) {
+			t.Errorf("%d leaves: root does not match", n)
+		}
+		leaves = append(leaves, []byte(fmt.Sprintf("leaf %d", n)))
+	}
+
+	// Swapping two leaves changes the root.
+	a, b := new(ioutil.MerkleTree), new(ioutil.MerkleTree)
+	a.Add([]byte("one"))
+	a.Add([]byte("two"))
+	a.Add([]byte("three"))
+	b.Add([]byte("one"))
+	b.Add([]byte("three"))
+	b.Add([]byte("two"))
+	if bytes.Equal(a.Root(), b.Root()) {
+		t.Error("expected reordered leaves to change the root")
+	}
+}
@@ -0,0 +1,86 @@
+package parity
+
+// Arithmetic in GF(2^8), with the polynomial x^8 + x^4 + x^3 + x^2 + 1 (0x11d) and
+// generator 2, as most Reed-Solomon codes over bytes use.
+
+var (
+	gfExp [512]byte
+	gfLog [256]byte
+	// gfMul[a][b] is a times b, so that multiplying a block by a constant is a lookup
+	// per byte.
+	gfMul [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMul[a][b] = gfExp[int(gfLog[a])+int(gfLog[b])]
+		}
+	}
+}
+
+// gfInv is the inverse of a, which must not be 0.
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// mulAdd adds c times src to dst.
+func mulAdd(dst []byte, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	table := &gfMul[c]
+	for i, b := range src {
+		dst[i] ^= table[b]
+	}
+}
+
+// invert inverts a square matrix in place, returning false if it can't be inverted.
+func invert(m [][]byte) bool {
+	n := len(m)
+	inv := make([][]byte, n)
+	for i := range inv {
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && m[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return false
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+
+		scale := gfInv(m[col][col])
+		for i := 0; i < n; i++ {
+			m[col][i] = gfMul[scale][m[col][i]]
+			inv[col][i] = gfMul[scale][inv[col][i]]
+		}
+		for row := 0; row < n; row++ {
+			if row == col || m[row][col] == 0 {
+				continue
+			}
+			factor := m[row][col]
+			mulAdd(m[row], m[col], factor)
+			mulAdd(inv[row], inv[col], factor)
+		}
+	}
+	copy(m, inv)
+	return true
+}
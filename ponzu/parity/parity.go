@@ -0,0 +1,289 @@
+// Package parity works out Reed-Solomon parity over runs of blocks of an archive, and
+// rebuilds damaged blocks from it.
+//
+// A run of blocks is dealt into stripes, block n to stripe n mod the number of stripes,
+// so that a stretch of damaged blocks is spread over all of them. Each stripe holds up
+// to 256 blocks, data and parity together, and up to as many damaged blocks as it has
+// parity blocks can be rebuilt in each one.
+package parity
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/indrora/ponzu/ponzu/format"
+)
+
+const (
+	blockSize = int(format.BLOCK_SIZE)
+	// MaxShards is the most parity blocks a stripe can have.
+	MaxShards = 128
+	// maxTries is the most sets of blocks that Correct tries rebuilding in a stripe.
+	maxTries = 1 << 16
+)
+
+var (
+	ErrShards     = errors.New("parity blocks per stripe must be from 1 to 128")
+	ErrFull       = errors.New("too many blocks for the parity to cover")
+	ErrTooDamaged = errors.New("too much is damaged to rebuild")
+)
+
+// Stripes is how many stripes a run of blocks is dealt into, with the given number of
+// parity blocks in each stripe.
+func Stripes(blocks int, shards int) int {
+	per := 256 - shards
+	if blocks <= per {
+		return 1
+	}
+	return (blocks + per - 1) / per
+}
+
+// coefficient is what data block i of a stripe is multiplied by for parity block j. The
+// coefficients make a Cauchy matrix, 1/(x_j + y_i) with x_j = 255 - j and y_i = i, any
+// square submatrix of which can be inverted.
+func coefficient(j int, i int) byte {
+	return gfInv(byte(255-j) ^ byte(i))
+}
+
+// Encoder works out the parity of blocks as they are written to it.
+type Encoder struct {
+	stripes int
+	shards  int
+	parity  []byte
+	blocks  int
+	// What has been written of the next block
+	block []byte
+	fill  int
+}
+
+// NewEncoder makes an Encoder for up to the given number of blocks, with shards parity
+// blocks for each stripe.
+func NewEncoder(blocks int, shards int) (*Encoder, error) {
+	if shards < 1 || shards > MaxShards {
+		return nil, ErrShards
+	}
+	stripes := Stripes(blocks, shards)
+	return &Encoder{
+		stripes: stripes,
+		shards:  shards,
+		parity:  make([]byte, stripes*shards*blockSize),
+		block:   make([]byte, blockSize),
+	}, nil
+}
+
+// Write adds blocks to the parity. Only whole blocks count: the rest is held on to
+// until the block is filled.
+func (e *Encoder) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if e.fill == 0 && len(p) >= blockSize {
+			if err := e.add(p[:blockSize]); err != nil {
+				return n - len(p), err
+			}
+			p = p[blockSize:]
+			continue
+		}
+		c := copy(e.block[e.fill:], p)
+		e.fill += c
+		p = p[c:]
+		if e.fill == blockSize {
+			e.fill = 0
+			if err := e.add(e.block); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (e *Encoder) add(block []byte) error {
+	stripe, i := e.blocks%e.stripes, e.blocks/e.stripes
+	if i >= 256-e.shards {
+		return ErrFull
+	}
+	for j := 0; j < e.shards; j++ {
+		mulAdd(e.parityBlock(stripe, j), block, coefficient(j, i))
+	}
+	e.blocks++
+	return nil
+}
+
+func (e *Encoder) parityBlock(stripe int, j int) []byte {
+	start := (stripe*e.shards + j) * blockSize
+	return e.parity[start : start+blockSize]
+}
+
+// Blocks is how many whole blocks have been written.
+func (e *Encoder) Blocks() int {
+	return e.blocks
+}
+
+// Stripes is how many stripes the blocks are dealt into.
+func (e *Encoder) Stripes() int {
+	return e.stripes
+}
+
+// Parity is the parity of the blocks written so far: the parity blocks of each stripe
+// in turn.
+func (e *Encoder) Parity() []byte {
+	return e.parity
+}
+
+// Correct finds and rebuilds the damaged blocks of a stripe from its parity blocks,
+// which are taken to be intact, returning which of the data blocks it changed. data
+// holds the blocks of the stripe in order (for stripe s, blocks s, s + stripes, ... of
+// the run), and suspects the indexes in data of any that are thought to be damaged.
+//
+// If no more blocks are suspected of damage than there are parity blocks, those are
+// rebuilt. Otherwise it looks for the fewest blocks, among the suspects or else among
+// them all, that once rebuilt make the stripe agree with every parity block, so that
+// there is always a parity block left over to check the result with.
+func Correct(data [][]byte, parity [][]byte, suspects []int) ([]int, error) {
+	syndromes := make([][]byte, len(parity))
+	for j := range parity {
+		syndromes[j] = bytes.Clone(parity[j])
+		for i, block := range data {
+			mulAdd(syndromes[j], block, coefficient(j, i))
+		}
+	}
+	// Only the bytes where the stripe disagrees with its parity need looking at.
+	s := &stripe{data: data, syndromes: syndromes}
+	for p := 0; p < blockSize; p++ {
+		for j := range syndromes {
+			if syndromes[j][p] != 0 {
+				s.bytes = append(s.bytes, p)
+				break
+			}
+		}
+	}
+	if len(s.bytes) == 0 {
+		return nil, nil
+	}
+
+	if len(suspects) > 0 && len(suspects) <= len(parity) {
+		if changed := s.rebuild(suspects); changed != nil {
+			return changed, nil
+		}
+	}
+	tries := 0
+	if len(suspects) > len(parity) {
+		if changed := s.search(suspects, &tries); changed != nil {
+			return changed, nil
+		}
+	}
+	all := make([]int, len(data))
+	for i := range all {
+		all[i] = i
+	}
+	if changed := s.search(all, &tries); changed != nil {
+		return changed, nil
+	}
+	return nil, ErrTooDamaged
+}
+
+// stripe is a stripe that disagrees with its parity: the syndromes are the parity of
+// the differences between its blocks as they are and as they should be, and bytes the
+// offsets in the blocks where they are not all 0.
+type stripe struct {
+	data      [][]byte
+	syndromes [][]byte
+	bytes     []int
+}
+
+// search tries rebuilding ever larger sets of the candidates, up to one fewer than
+// there are parity blocks, until one makes the stripe agree with its parity.
+func (s *stripe) search(candidates []int, tries *int) []int {
+	for size := 1; size < len(s.syndromes) && size <= len(candidates); size++ {
+		picks := make([]int, size)
+		for i := range picks {
+			picks[i] = i
+		}
+		for {
+			if *tries++; *tries > maxTries {
+				return nil
+			}
+			set := make([]int, size)
+			for i, pick := range picks {
+				set[i] = candidates[pick]
+			}
+			if changed := s.rebuild(set); changed != nil {
+				return changed
+			}
+
+			// On to the next set of picks, in order
+			i := size - 1
+			for i >= 0 && picks[i] == len(candidates)-size+i {
+				i--
+			}
+			if i < 0 {
+				break
+			}
+			picks[i]++
+			for i++; i < size; i++ {
+				picks[i] = picks[i-1] + 1
+			}
+		}
+	}
+	return nil
+}
+
+// rebuild works out what the given blocks must have been for the stripe to agree with
+// the first as many parity blocks, checking the result against the rest. If it
+// agrees, the blocks are rebuilt and those that changed returned; otherwise it returns
+// nil and leaves the data alone.
+func (s *stripe) rebuild(set []int) []int {
+	t := len(set)
+	m := make([][]byte, t)
+	for j := range m {
+		m[j] = make([]byte, t)
+		for c, i := range set {
+			m[j][c] = coefficient(j, i)
+		}
+	}
+	if !invert(m) {
+		return nil
+	}
+
+	// It's the differences that are solved for, checking each byte against the rest of
+	// the parity blocks as it goes, which gives up on a wrong set quickly.
+	diffs := make([][]byte, t)
+	for c := range diffs {
+		diffs[c] = make([]byte, blockSize)
+	}
+	for _, p := range s.bytes {
+		for c := range diffs {
+			for j := 0; j < t; j++ {
+				diffs[c][p] ^= gfMul[m[c][j]][s.syndromes[j][p]]
+			}
+		}
+		for j := t; j < len(s.syndromes); j++ {
+			sum := byte(0)
+			for c, i := range set {
+				sum ^= gfMul[coefficient(j, i)][diffs[c][p]]
+			}
+			if sum != s.syndromes[j][p] {
+				return nil
+			}
+		}
+	}
+
+	changed := []int{}
+	for c, i := range set {
+		if !zero(diffs[c]) {
+			for _, p := range s.bytes {
+				s.data[i][p] ^= diffs[c][p]
+			}
+			changed = append(changed, i)
+		}
+	}
+	return changed
+}
+
+func zero(block []byte) bool {
+	for _, b := range block {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
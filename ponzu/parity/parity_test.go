@@ -0,0 +1,83 @@
+package parity
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestCorrect(t *testing.T) {
+	const shards = 4
+	random := rand.New(rand.NewSource(1))
+
+	blocks := make([][]byte, 300)
+	e, err := NewEncoder(len(blocks), shards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := range blocks {
+		blocks[n] = make([]byte, blockSize)
+		random.Read(blocks[n])
+		// Written in odd sizes, as a block writer would
+		e.Write(blocks[n][:100])
+		e.Write(blocks[n][100:])
+	}
+	if e.Blocks() != len(blocks) || e.Stripes() != 2 || len(e.Parity()) != 2*shards*blockSize {
+		t.Fatalf("unexpected encoder: %d blocks, %d stripes, %d bytes of parity", e.Blocks(), e.Stripes(), len(e.Parity()))
+	}
+
+	// stripe is the first stripe as it is now, after damage
+	stripe := func(damaged map[int]bool) (data [][]byte, parity [][]byte) {
+		for n := 0; n < len(blocks); n += 2 {
+			block := bytes.Clone(blocks[n])
+			if damaged[len(data)] {
+				random.Read(block[random.Intn(blockSize/2):])
+			}
+			data = append(data, block)
+		}
+		for j := 0; j < shards; j++ {
+			parity = append(parity, e.Parity()[j*blockSize:(j+1)*blockSize])
+		}
+		return data, parity
+	}
+	check := func(name string, data [][]byte) {
+		for i, block := range data {
+			if !bytes.Equal(block, blocks[2*i]) {
+				t.Errorf("%v: block %d not rebuilt", name, i)
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		damaged  []int
+		suspects []int
+	}{
+		{"clean", nil, nil},
+		{"suspected", []int{3, 40, 41, 149}, []int{3, 40, 41, 149}},
+		{"some of the suspects", []int{40}, []int{3, 40, 41, 149}},
+		{"unsuspected", []int{7, 120}, nil},
+		{"among many suspects", []int{10, 20, 30}, []int{5, 10, 15, 20, 25, 30, 35}},
+	} {
+		damaged := map[int]bool{}
+		for _, i := range tc.damaged {
+			damaged[i] = true
+		}
+		data, parity := stripe(damaged)
+		changed, err := Correct(data, parity, tc.suspects)
+		if err != nil {
+			t.Errorf("%v: %v", tc.name, err)
+			continue
+		}
+		if len(changed) != len(tc.damaged) {
+			t.Errorf("%v: expected %v to change, got %v", tc.name, tc.damaged, changed)
+		}
+		check(tc.name, data)
+	}
+
+	// More damage than there is parity can't be rebuilt.
+	data, parity := stripe(map[int]bool{1: true, 2: true, 3: true, 4: true, 5: true})
+	if _, err := Correct(data, parity, []int{1, 2, 3, 4, 5}); err != ErrTooDamaged {
+		t.Errorf("expected ErrTooDamaged, got %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package reader
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+	"io"
+
+	"github.com/indrora/ponzu/ponzu/format"
+	"golang.org/x/crypto/blake2b"
+)
+
+var ErrBodyClosed = errors.New("body has been closed")
+
+// body streams the body of a record, and any continuations of it, decompressed.
+type body struct {
+	reader *Reader
+
+	raw   io.Reader     // the stored body of the current record, through the hash
+	data  io.ReadCloser // and decompressed
+	hash  hash.Hash
+	ahead *ahead // if the body of the current record was read ahead instead
+	err   error
+}
+
+// Body returns the body of the current record as a stream, decompressed. Continuation
+// records are followed, so all of a file comes out of it.
+//
+// The checksum of each record is checked as the end of it is reached; a mismatch is
+// returned from the Read that gets there as ErrHashMismatch.
+//
+// Reading the body moves the reader along: Next carries on from wherever reading it
+// stopped. If the body is closed before the end, any continuations that are left are
+// returned by Next like any other record.
+func (reader *Reader) Body() io.ReadCloser {
+	if reader.lastPreamble == nil {
+		return &body{err: ErrState}
+	}
+	return &body{reader: reader}
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, b.err
+	}
+	for b.err == nil {
+		if b.data == nil {
+			if b.err = b.open(); b.err != nil {
+				break
+			}
+		}
+
+		n, err := b.data.Read(p)
+		if err == io.EOF {
+			// That's the end of this record, but not necessarily of the body.
+			err = b.next()
+		}
+		if err != nil {
+			b.err = err
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+	return 0, b.err
+}
+
+// open starts reading the body of the current record.
+func (b *body) open() error {
+	if b.ahead = b.reader.readAhead(true); b.ahead != nil {
+		if b.ahead.err != nil {
+			return b.ahead.err
+		}
+		b.data = io.NopCloser(bytes.NewReader(b.ahead.data))
+		return nil
+	}
+
+	b.hash, _ = blake2b.New512(nil)
+	b.raw = io.TeeReader(b.reader.rawBody(), b.hash)
+
+	if !b.reader.HasBody() {
+		// Nothing to decompress, and some decompressors don't take kindly to that.
+		b.data = io.NopCloser(b.raw)
+		return nil
+	}
+
+	var err error
+	b.data, err = b.reader.getDecompressor(b.raw, b.reader.lastPreamble)
+	return err
+}
+
+// next finishes off the current record, checking its checksum, and moves on to the
+// continuation record that follows it if there is one. At the end of the chain,
+// io.EOF is returned.
+func (b *body) next() error {
+	reader := b.reader
+	preamble := reader.lastPreamble
+	if err := b.finish(); err != nil {
+		return err
+	}
+	reader.lastPreamble = nil
+	reader.body = nil
+
+	// Control records reuse the CONTINUES bit for CONTROL_END.
+	if preamble.Rtype == format.RECORD_TYPE_CONTROL || preamble.Flags&format.RECORD_FLAG_CONTINUES == 0 {
+		return io.EOF
+	}
+
+	next, _, err := reader.Next()
+	if err != nil {
+		return err
+	} else if next.Rtype != format.RECORD_TYPE_CONTINUE {
+		return ErrExpectedContinue
+	}
+	return nil
+}
+
+// finish checks the checksum of the current record and moves the reader past it.
+func (b *body) finish() error {
+	b.data.Close()
+	b.data = nil
+
+	if ahead := b.ahead; ahead != nil {
+		b.ahead = nil
+		if ahead.sumErr != nil {
+			return ahead.sumErr
+		}
+		return b.reader.skipBody()
+	}
+
+	// Decompressors may stop short of the end of the record; the hash needs all of it.
+	if _, err := io.Copy(io.Discard, b.raw); err != nil {
+		return err
+	}
+	if err := b.reader.checkDataChecksum(b.hash.Sum(nil)); err != nil {
+		return err
+	}
+	return b.reader.stream.Realign()
+}
+
+func (b *body) Close() error {
+	if b.data != nil {
+		b.data.Close()
+		b.data = nil
+	}
+	if b.err == nil || b.err == io.EOF {
+		b.err = ErrBodyClosed
+	}
+	return nil
+}
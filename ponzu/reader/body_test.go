@@ -0,0 +1,92 @@
+package reader_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/indrora/ponzu/ponzu/reader"
+	"github.com/indrora/ponzu/ponzu/writer"
+)
+
+func TestBody(t *testing.T) {
+	data := make([]byte, int(3.5*float32(format.BLOCK_SIZE)))
+	rand.Read(data)
+
+	for _, compression := range []format.CompressionType{format.COMPRESSION_NONE, format.COMPRESSION_ZSTD, format.COMPRESSION_BROTLI} {
+		buff := new(bytes.Buffer)
+		w := writer.NewWriter(buff, 2*format.BLOCK_SIZE)
+		w.AppendStart("", "")
+		w.AppendStream(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, compression, format.File{Name: "foo", ModTime: time.Now()}, bytes.NewReader(data))
+		w.AppendBytes(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, compression, format.File{Name: "bar", ModTime: time.Now()}, []byte("bar"))
+		w.AppendEnd()
+		w.Close()
+		archive := buff.Bytes()
+
+		r := reader.NewReader(bytes.NewReader(archive))
+		r.Next()
+		r.Next()
+		out, err := io.ReadAll(io.LimitReader(r.Body(), int64(len(data))+1))
+		if err != nil {
+			t.Fatalf("compression %v: %v", compression, err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("compression %v: round trip failed, got %d bytes", compression, len(out))
+		}
+		if _, meta, err := r.Next(); err != nil || meta.(*format.File).Name != "bar" {
+			t.Errorf("compression %v: expected bar after the body, got %v", compression, err)
+		}
+
+		// Stopping partway through a body leaves the rest to be skipped.
+		r = reader.NewReader(bytes.NewReader(archive))
+		r.Next()
+		r.Next()
+		body := r.Body()
+		io.ReadFull(body, make([]byte, 100))
+		body.Close()
+		for {
+			preamble, meta, err := r.Next()
+			if err != nil {
+				t.Fatalf("compression %v: failed to carry on after a partial read: %v", compression, err)
+			}
+			if preamble.Rtype == format.RECORD_TYPE_CONTINUE {
+				continue
+			}
+			if meta.(*format.File).Name != "bar" {
+				t.Errorf("compression %v: expected bar after the body", compression)
+			}
+			break
+		}
+	}
+}
+
+func TestBodyHashMismatch(t *testing.T) {
+	data := make([]byte, 2*format.BLOCK_SIZE)
+	rand.Read(data)
+
+	buff := new(bytes.Buffer)
+	w := writer.NewWriter(buff, 2*format.BLOCK_SIZE)
+	w.AppendStart("", "")
+	w.AppendStream(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.File{Name: "foo"}, bytes.NewReader(data))
+	w.AppendEnd()
+	w.Close()
+
+	// Flip a byte in the body of the continuation record.
+	archive := buff.Bytes()
+	archive[4*format.BLOCK_SIZE+10] ^= 0xFF
+
+	r := reader.NewReader(bytes.NewReader(archive))
+	r.Next()
+	r.Next()
+	out, err := io.ReadAll(r.Body())
+	if !errors.Is(err, reader.ErrHashMismatch) {
+		t.Errorf("expected a hash mismatch, got %v", err)
+	}
+	if len(out) != len(data) {
+		t.Errorf("expected all of the body to be read before the mismatch, got %d bytes", len(out))
+	}
+}
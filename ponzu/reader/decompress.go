@@ -1,35 +1,30 @@
 package reader
 
 import (
-	"errors"
 	"io"
 
-	"github.com/andybalholm/brotli"
+	"github.com/indrora/ponzu/ponzu/compression"
+	"github.com/indrora/ponzu/ponzu/encryption"
 	"github.com/indrora/ponzu/ponzu/format"
-	"github.com/klauspost/compress/zstd"
 )
 
-var (
-	errUnknownCompressionType = errors.New("unknown compression")
-)
-
-func (reader *Reader) getDecompressor(compressedReader io.Reader, dcType format.CompressionType) (io.Reader, error) {
-
-	switch dcType {
-	case format.COMPRESSION_NONE:
-		return compressedReader, nil // no compression = passthru
-	case format.COMPRESSION_BROTLI:
-		return brotli.NewReader(compressedReader), nil
-	case format.COMPRESSION_ZSTD:
+// getDecompressor wraps a stored body in whatever decrypts and decompresses it. The
+// decompressor must be closed once it is finished with.
+func (reader *Reader) getDecompressor(compressedReader io.Reader, preamble *format.Preamble) (io.ReadCloser, error) {
+	if preamble.Flags&format.RECORD_FLAG_ENCRYPTED != 0 && reader.key == nil {
+		return nil, reader.noKey()
+	}
+	return newDecompressor(compressedReader, preamble, encryption.ID(reader.raw), reader.zstdDict, reader.key)
+}
 
-		if reader.zstdDict != nil {
-			return zstd.NewReader(compressedReader, zstd.WithDecoderDicts(reader.zstdDict))
-		} else {
-			return zstd.NewReader(compressedReader)
+// newDecompressor is getDecompressor for a given record ID, zstd dictionary and key,
+// any of which may be nil.
+func newDecompressor(compressedReader io.Reader, preamble *format.Preamble, id []byte, dict []byte, key *encryption.Key) (io.ReadCloser, error) {
+	if preamble.Flags&format.RECORD_FLAG_ENCRYPTED != 0 {
+		if key == nil {
+			return nil, ErrEncrypted
 		}
-
-	default:
-		return nil, errUnknownCompressionType
+		compressedReader = key.NewReader(compressedReader, id, preamble.Rtype, preamble.Compression)
 	}
-
+	return compression.NewReader(compressedReader, preamble.Compression, dict)
 }
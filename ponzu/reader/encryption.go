@@ -0,0 +1,62 @@
+package reader
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/indrora/ponzu/ponzu/encryption"
+	"github.com/indrora/ponzu/ponzu/format"
+)
+
+var ErrEncrypted = errors.New("record is encrypted, and there is no key to open it")
+
+// unwrapKey finds the key of the archive that has just started, from the metadata of
+// its start of archive record. The key is kept if the archive is the one it came from.
+func (reader *Reader) unwrapKey(raw []byte, metadata any) {
+	if reader.soa != nil && bytes.Equal(raw, reader.soa) {
+		return
+	}
+	reader.soa = bytes.Clone(raw)
+	reader.key, reader.keyErr = nil, nil
+
+	if soa, ok := metadata.(*format.StartOfArchive); ok && soa.Encryption != nil {
+		reader.key, reader.keyErr = encryption.Unwrap(soa.Encryption, reader.Passphrase, reader.Identities)
+	}
+}
+
+// findKey reads the start of the archive for its key, for readers that have gone
+// straight to somewhere past it.
+func (reader *Reader) findKey() {
+	if reader.soa != nil || reader.ra == nil {
+		return
+	}
+	scan := NewReaderAt(reader.ra, reader.size)
+	scan.useKeyOf(reader)
+	scan.readRecord()
+	reader.useKeyOf(scan)
+}
+
+// useKeyOf takes the keys and key of another reader over the same archive.
+func (reader *Reader) useKeyOf(other *Reader) {
+	reader.Passphrase = other.Passphrase
+	reader.Identities = other.Identities
+	reader.key, reader.keyErr, reader.soa = other.key, other.keyErr, other.soa
+}
+
+// openMetadata decrypts the metadata of an encrypted record.
+func (reader *Reader) openMetadata(preamble *format.Preamble, sealed []byte) ([]byte, error) {
+	if reader.key == nil {
+		return nil, reader.noKey()
+	}
+	return reader.key.OpenMetadata(sealed, preamble.Rtype, preamble.Compression)
+}
+
+// noKey is the error for an encrypted record that can't be opened, saying why if the
+// reason is known.
+func (reader *Reader) noKey() error {
+	if reader.keyErr != nil {
+		return fmt.Errorf("%w: %w", ErrEncrypted, reader.keyErr)
+	}
+	return ErrEncrypted
+}
@@ -0,0 +1,206 @@
+package reader_test
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/indrora/ponzu/ponzu/encryption"
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/indrora/ponzu/ponzu/reader"
+	"github.com/indrora/ponzu/ponzu/writer"
+)
+
+func TestEncryption(t *testing.T) {
+	identity, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	stranger, _ := ecdh.X25519().GenerateKey(rand.Reader)
+
+	// Several segments of the encrypted stream, split over continuation records
+	big := make([]byte, 300*1024)
+	rand.Read(big)
+	small := []byte("a little secret")
+
+	build := func(t *testing.T, out io.Writer, jobs int, passphrase []byte) {
+		setup := func(w *writer.ArchiveWriter) {
+			w.Jobs = jobs
+			w.WriteIndex = true
+			w.Passphrase = passphrase
+			w.Recipients = []*ecdh.PublicKey{identity.PublicKey()}
+		}
+		buildArchive(t, out, 32, setup, func(w *writer.ArchiveWriter) error {
+			if err := w.AppendStream(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_ZSTD, format.File{Name: "big-secret"}, bytes.NewReader(big)); err != nil {
+				return err
+			}
+			return w.AppendBytes(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.File{Name: "small-secret"}, small)
+		})
+	}
+
+	read := func(t *testing.T, r *reader.Reader) map[string][]byte {
+		files := map[string][]byte{}
+		for {
+			_, meta, err := r.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if file, ok := meta.(*format.File); ok {
+				out := new(bytes.Buffer)
+				if err = r.CopyAll(out, true); err != nil {
+					t.Fatalf("%v: %v", file.Name, err)
+				}
+				files[file.Name] = out.Bytes()
+			}
+		}
+		return files
+	}
+
+	check := func(t *testing.T, files map[string][]byte) {
+		if !bytes.Equal(files["big-secret"], big) || !bytes.Equal(files["small-secret"], small) {
+			t.Errorf("round trip failed, got %d files", len(files))
+		}
+	}
+
+	// An archive file, so that the body of the big file is written straight into it
+	path := filepath.Join(t.TempDir(), "secret.pzarc")
+	fh, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	build(t, fh, 1, []byte("correct horse battery staple"))
+	fh.Close()
+	archive, _ := os.ReadFile(path)
+
+	if bytes.Contains(archive, []byte("secret")) {
+		t.Error("names or data found unencrypted in the archive")
+	}
+	if uint64(len(archive))%format.BLOCK_SIZE != 0 {
+		t.Errorf("archive is %d bytes, not a whole number of blocks", len(archive))
+	}
+
+	t.Run("passphrase", func(t *testing.T) {
+		r := reader.NewReader(bytes.NewReader(archive))
+		r.Passphrase = []byte("correct horse battery staple")
+		check(t, read(t, r))
+	})
+
+	t.Run("identity", func(t *testing.T) {
+		r := reader.NewReader(bytes.NewReader(archive))
+		r.Identities = []*ecdh.PrivateKey{stranger, identity}
+		check(t, read(t, r))
+	})
+
+	t.Run("pipeline", func(t *testing.T) {
+		buff := new(bytes.Buffer)
+		build(t, buff, 4, nil)
+		r := reader.NewReader(buff)
+		r.Identities = []*ecdh.PrivateKey{identity}
+		check(t, read(t, r))
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		r := reader.NewReader(bytes.NewReader(archive))
+		r.Passphrase = []byte("incorrect horse")
+		r.Identities = []*ecdh.PrivateKey{stranger}
+		if _, _, err := r.Next(); err != nil {
+			t.Fatalf("the start of archive is not encrypted, but got %v", err)
+		}
+		_, _, err := r.Next()
+		if !errors.Is(err, reader.ErrEncrypted) || !errors.Is(err, encryption.ErrNoKey) {
+			t.Errorf("expected ErrEncrypted and ErrNoKey, got %v", err)
+		}
+	})
+
+	t.Run("verify without a key", func(t *testing.T) {
+		report := reader.NewReader(bytes.NewReader(archive)).Verify()
+		if !report.Ok {
+			t.Errorf("expected the archive to verify, got %+v", report)
+		}
+
+		damaged := bytes.Clone(archive)
+		damaged[3*format.BLOCK_SIZE+100] ^= 1
+		if reader.NewReader(bytes.NewReader(damaged)).Verify().Ok {
+			t.Error("expected a damaged archive not to verify")
+		}
+	})
+
+	t.Run("open", func(t *testing.T) {
+		r := reader.NewReaderAt(bytes.NewReader(archive), int64(len(archive)))
+		r.ReadAhead = 4
+		defer r.Close()
+		r.Identities = []*ecdh.PrivateKey{identity}
+		if _, _, err := r.Open("small-secret"); err != nil {
+			t.Fatal(err)
+		}
+		out := new(bytes.Buffer)
+		if err := r.CopyAll(out, true); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), small) {
+			t.Errorf("expected %q, got %q", small, out.Bytes())
+		}
+		if _, _, err := r.Open("big-secret"); err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r.Body())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, big) {
+			t.Errorf("got %d bytes of the big file back, expected %d", len(data), len(big))
+		}
+	})
+
+	t.Run("swapped bodies", func(t *testing.T) {
+		buff := new(bytes.Buffer)
+		buildArchive(t, buff, 2, func(w *writer.ArchiveWriter) {
+			w.Passphrase = []byte("correct horse battery staple")
+		}, func(w *writer.ArchiveWriter) error {
+			for _, name := range []string{"one", "two"} {
+				if err := w.AppendBytes(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.File{Name: name}, []byte("the secret of "+name)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		archive := buff.Bytes()
+
+		// Swap the bodies of the two files, and their checksums with them, so that only
+		// the encryption can tell.
+		var files []int
+		var preambles []*format.Preamble
+		for offset := 0; offset < len(archive); offset += int(format.BLOCK_SIZE) {
+			preamble, err := format.ReadPreamble(bytes.NewReader(archive[offset:]))
+			if err == nil && bytes.Equal(preamble.Magic[:], format.PREAMBLE_BYTES[:]) && preamble.Rtype == format.RECORD_TYPE_FILE {
+				files = append(files, offset)
+				preambles = append(preambles, preamble)
+			}
+		}
+		if len(files) != 2 {
+			t.Fatalf("expected two files, found %d", len(files))
+		}
+		preambles[0].DataChecksum, preambles[1].DataChecksum = preambles[1].DataChecksum, preambles[0].DataChecksum
+		one, two := files[0]+int(format.BLOCK_SIZE), files[1]+int(format.BLOCK_SIZE)
+		body := bytes.Clone(archive[one : one+int(format.BLOCK_SIZE)])
+		copy(archive[one:], archive[two:two+int(format.BLOCK_SIZE)])
+		copy(archive[two:], body)
+		for i, offset := range files {
+			copy(archive[offset:], preambles[i].ToBytes())
+		}
+
+		r := reader.NewReader(bytes.NewReader(archive))
+		r.Passphrase = []byte("correct horse battery staple")
+		r.Next()
+		if _, _, err := r.Next(); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.CopyAll(io.Discard, true); !errors.Is(err, encryption.ErrDecrypt) {
+			t.Errorf("expected ErrDecrypt, got %v", err)
+		}
+	})
+}
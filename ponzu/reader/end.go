@@ -0,0 +1,55 @@
+package reader
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/indrora/ponzu/ponzu/format"
+)
+
+var (
+	ErrEndMismatch  = errors.New("records do not match the end of archive")
+	ErrEndUnchecked = errors.New("end of archive can only be checked reading the archive from its start")
+)
+
+// addToTree adds a record to the Merkle tree of the archive. Signatures are left out,
+// as they can be added to an archive after it is written, as is the end of archive.
+func (reader *Reader) addToTree(preamble *format.Preamble) {
+	if reader.tree == nil || preamble.Rtype == format.RECORD_TYPE_SIGNATURE {
+		return
+	}
+	if preamble.IsEndOfArchive() {
+		return
+	}
+	reader.tree.Add(preamble.MetadataChecksum[:], preamble.DataChecksum[:])
+	reader.dataBlocks += preamble.DataLen
+}
+
+// CheckEnd checks the end of archive record, from the current record, against the
+// records read since the start of the archive: how many there were, how many data
+// blocks they had and the root of the Merkle tree over their checksums. A record that
+// was dropped, added or moved shows up here even if each one is fine on its own.
+//
+// End of archive records that predate these checks have nothing to check, and pass.
+func (reader *Reader) CheckEnd(eoa *format.EndOfArchive) error {
+	if eoa.Records == 0 && eoa.DataBlocks == 0 && eoa.MerkleRoot == nil {
+		return nil
+	}
+	if reader.tree == nil {
+		return ErrEndUnchecked
+	}
+	if eoa.Records != reader.tree.Len() || eoa.DataBlocks != reader.dataBlocks {
+		return fmt.Errorf("%w: expected %d records of %d data blocks, found %d of %d", ErrEndMismatch, eoa.Records, eoa.DataBlocks, reader.tree.Len(), reader.dataBlocks)
+	}
+	if !bytes.Equal(eoa.MerkleRoot, reader.tree.Root()) {
+		return fmt.Errorf("%w: Merkle root differs", ErrEndMismatch)
+	}
+	return nil
+}
+
+// endMatches is whether an end of archive accounts for exactly the records read since
+// the start of the archive. Unlike CheckEnd, ones that predate the checks don't pass.
+func (reader *Reader) endMatches(eoa *format.EndOfArchive) bool {
+	return reader.tree != nil && eoa.Records == reader.tree.Len() && eoa.DataBlocks == reader.dataBlocks && bytes.Equal(eoa.MerkleRoot, reader.tree.Root())
+}
@@ -0,0 +1,98 @@
+package reader_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/indrora/ponzu/ponzu/reader"
+	"github.com/indrora/ponzu/ponzu/writer"
+)
+
+func TestCheckEnd(t *testing.T) {
+	build := func(jobs int, streamed bool) []byte {
+		buff := new(bytes.Buffer)
+		setup := func(w *writer.ArchiveWriter) {
+			w.Jobs = jobs
+			w.Streamed = streamed
+		}
+		buildArchive(t, buff, 2, setup, func(w *writer.ArchiveWriter) error {
+			for i := 0; i < 3; i++ {
+				if err := w.AppendBytes(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.File{Name: fmt.Sprint(i)}, bytes.Repeat([]byte{byte(i)}, 100)); err != nil {
+					return err
+				}
+			}
+			return w.AppendStream(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_ZSTD, format.File{Name: "stream"}, bytes.NewReader(make([]byte, 3*format.BLOCK_SIZE)))
+		})
+		return buff.Bytes()
+	}
+
+	// walk reads the archive with Next, returning the end of archive and the first error.
+	walk := func(archive []byte) (*format.EndOfArchive, error) {
+		r := reader.NewReader(bytes.NewReader(archive))
+		var eoa *format.EndOfArchive
+		for {
+			_, meta, err := r.Next()
+			if errors.Is(err, io.EOF) {
+				return eoa, nil
+			} else if err != nil {
+				return eoa, err
+			}
+			if end, ok := meta.(*format.EndOfArchive); ok {
+				eoa = end
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		jobs     int
+		streamed bool
+	}{{1, false}, {4, false}, {1, true}} {
+		archive := build(tc.jobs, tc.streamed)
+		eoa, err := walk(archive)
+		if err != nil {
+			t.Fatalf("%+v: %v", tc, err)
+		}
+		// The start of archive, three files and the streamed one, which continues twice
+		// (and in a streamed archive, ends with an empty continuation)
+		records := uint64(7)
+		if tc.streamed {
+			records++
+		}
+		if eoa == nil || eoa.Records != records || eoa.DataBlocks != 6 || len(eoa.MerkleRoot) != 64 {
+			t.Errorf("%+v: unexpected end of archive %+v", tc, eoa)
+		}
+		if report := reader.NewReader(bytes.NewReader(archive)).Verify(); !report.Ok {
+			t.Errorf("%+v: expected the archive to verify, got %+v", tc, report)
+		}
+	}
+
+	archive := build(1, false)
+	block := int(format.BLOCK_SIZE)
+	// Each small file is a header block and a body block, from block 1 on.
+	file := func(i int) []byte { return archive[(1+2*i)*block : (3+2*i)*block] }
+
+	dropped := bytes.Join([][]byte{archive[:3*block], archive[5*block:]}, nil)
+	swapped := bytes.Join([][]byte{archive[:block], file(1), file(0), archive[5*block:]}, nil)
+	added := bytes.Join([][]byte{archive[:3*block], file(0), archive[3*block:]}, nil)
+
+	for name, damaged := range map[string][]byte{"dropped": dropped, "swapped": swapped, "added": added} {
+		// Every record is fine on its own; only the end of archive can tell.
+		if _, err := walk(damaged); !errors.Is(err, reader.ErrEndMismatch) {
+			t.Errorf("%v: expected ErrEndMismatch from Next, got %v", name, err)
+		}
+		report := reader.NewReader(bytes.NewReader(damaged)).Verify()
+		last := report.Records[len(report.Records)-1]
+		if report.Ok || last.Type != format.RECORD_TYPE_CONTROL || len(last.Errors) != 1 {
+			t.Errorf("%v: expected the end of archive to fail verification, got %+v", name, report)
+		}
+	}
+
+	// Without the end of archive, the archive is truncated.
+	if _, err := walk(archive[:len(archive)-block]); !errors.Is(err, reader.ErrMissingEnd) {
+		t.Errorf("expected ErrMissingEnd, got %v", err)
+	}
+}
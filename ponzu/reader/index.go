@@ -0,0 +1,233 @@
+package reader
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/indrora/ponzu/ponzu/ioutil"
+)
+
+var (
+	ErrNotSeekable = errors.New("reader does not support random access")
+	ErrNotFound    = fmt.Errorf("record %w", fs.ErrNotExist)
+	ErrBadIndex    = errors.New("index record is damaged")
+
+	errNoIndex = errors.New("archive has no index")
+)
+
+// NewReaderAt makes a Reader with random access to the archive, which allows for
+// Index and Open to be used. Next still starts at the beginning of the archive.
+func NewReaderAt(r io.ReaderAt, size int64) *Reader {
+	reader := NewReader(io.NewSectionReader(r, 0, size))
+	reader.ra = r
+	reader.size = size
+	return reader
+}
+
+// Clone makes a new Reader over the same archive, sharing the index if it has already
+// been read. The clone starts at the beginning of the archive, and can be used
+// alongside the original (and any other clones) from another goroutine.
+func (reader *Reader) Clone() (*Reader, error) {
+	if reader.ra == nil {
+		return nil, ErrNotSeekable
+	}
+	clone := NewReaderAt(reader.ra, reader.size)
+	clone.index = reader.index
+	clone.names = reader.names
+	clone.useKeyOf(reader)
+	return clone, nil
+}
+
+// seek moves the reader to the given byte offset, dropping whatever record it was in.
+func (reader *Reader) seek(offset uint64) error {
+	if err := reader.jump(offset); err != nil {
+		return err
+	}
+	// What came before is no longer known; CheckHardlink falls back to the index, and
+	// signatures and the end of archive can't be checked.
+	reader.files = nil
+	reader.chain = nil
+	reader.tree = nil
+	reader.inArchive = false
+	reader.resume = offset
+	return nil
+}
+
+// jump moves the reader to the given byte offset, as seek does, but without forgetting
+// what it has seen so far. It is for moving forward over bodies that need not be read.
+func (reader *Reader) jump(offset uint64) error {
+	if reader.ra == nil {
+		return ErrNotSeekable
+	}
+	if offset > uint64(reader.size) {
+		return fmt.Errorf("%w: offset %d is past the end of the archive", io.ErrUnexpectedEOF, offset)
+	}
+
+	reader.stream = ioutil.NewBlockReader(io.NewSectionReader(reader.ra, int64(offset), reader.size-int64(offset)), format.BLOCK_SIZE)
+	reader.base = offset
+	reader.lastPreamble = nil
+	reader.body = nil
+	return nil
+}
+
+// Index returns the index of the archive. If the archive ends with an index record,
+// that is used; otherwise the whole archive is scanned to build one.
+//
+// This moves the reader: call Open (or start over) before using Next again.
+func (reader *Reader) Index() (*format.Index, error) {
+	if reader.index != nil {
+		return reader.index, nil
+	}
+	if reader.ra == nil {
+		return nil, ErrNotSeekable
+	}
+	// The index, and the records it leads to, may need the key from the start.
+	reader.findKey()
+
+	index, err := reader.readIndex()
+	if err != nil {
+		// A missing or damaged index just means doing things the slow way.
+		if index, err = reader.scanIndex(); err != nil {
+			return nil, err
+		}
+	}
+
+	reader.index = index
+	reader.names = make(map[string]format.IndexEntry, len(index.Entries))
+	for _, entry := range index.Entries {
+		// Later records with the same name replace earlier ones.
+		reader.names[path.Clean(entry.Name)] = entry
+	}
+	return index, nil
+}
+
+// readIndex reads the index record pointed to by the end of archive record, which
+// must be the last block of the archive.
+func (reader *Reader) readIndex() (*format.Index, error) {
+	blocks := uint64(reader.size) / format.BLOCK_SIZE
+	if blocks == 0 {
+		return nil, errNoIndex
+	}
+
+	if err := reader.seek((blocks - 1) * format.BLOCK_SIZE); err != nil {
+		return nil, err
+	}
+	preamble, meta, err := reader.readRecord()
+	if err != nil {
+		return nil, err
+	}
+	eoa, ok := meta.(*format.EndOfArchive)
+	if preamble.Rtype != format.RECORD_TYPE_CONTROL || !ok || eoa.Index == 0 {
+		return nil, errNoIndex
+	}
+
+	if err = reader.seek(eoa.Index * format.BLOCK_SIZE); err != nil {
+		return nil, err
+	}
+	if preamble, _, err = reader.readRecord(); err != nil {
+		return nil, err
+	} else if preamble.Rtype != format.RECORD_TYPE_INDEX {
+		return nil, ErrBadIndex
+	}
+
+	body, err := reader.GetBody(true)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, errors.Join(ErrBadIndex, err)
+	}
+	index := new(format.Index)
+	if err = cbor.Unmarshal(body, index); err != nil {
+		return nil, errors.Join(ErrBadIndex, err)
+	}
+	return index, nil
+}
+
+// scanIndex builds an index by reading every record header in the archive.
+func (reader *Reader) scanIndex() (*format.Index, error) {
+	if err := reader.seek(0); err != nil {
+		return nil, err
+	}
+
+	index := new(format.Index)
+	for {
+		preamble, meta, err := reader.readRecord()
+		if preamble == nil && errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		block := reader.offset / format.BLOCK_SIZE
+		if preamble.Rtype == format.RECORD_TYPE_ZDICTIONARY {
+			index.Dictionaries = append(index.Dictionaries, block)
+		} else if name, ok := format.RecordName(meta); ok && preamble.Rtype != format.RECORD_TYPE_CONTINUE {
+			index.Entries = append(index.Entries, format.IndexEntry{
+				Name:  name,
+				Block: block,
+				Type:  preamble.Rtype,
+			})
+		}
+	}
+	return index, nil
+}
+
+// Open moves the reader straight to the record with the given name and reads its
+// header, as Next would. The body can then be read with CopyAll and friends, and
+// calling Next carries on from there.
+func (reader *Reader) Open(name string) (*format.Preamble, any, error) {
+	if _, err := reader.Index(); err != nil {
+		return nil, nil, err
+	}
+
+	entry, ok := reader.names[path.Clean(name)]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %v", ErrNotFound, name)
+	}
+	if err := reader.loadDictionary(entry.Block); err != nil {
+		return nil, nil, err
+	}
+	if err := reader.seek(entry.Block * format.BLOCK_SIZE); err != nil {
+		return nil, nil, err
+	}
+	return reader.Next()
+}
+
+// loadDictionary makes sure the zstd dictionary in effect at the given block is loaded.
+func (reader *Reader) loadDictionary(block uint64) error {
+	dictBlock := uint64(0)
+	for _, d := range reader.index.Dictionaries {
+		if d < block {
+			dictBlock = d
+		}
+	}
+
+	if dictBlock == reader.dictBlock {
+		return nil
+	} else if dictBlock == 0 {
+		reader.zstdDict = nil
+		reader.dictBlock = 0
+		return nil
+	}
+
+	if err := reader.seek(dictBlock * format.BLOCK_SIZE); err != nil {
+		return err
+	}
+	preamble, _, err := reader.readRecord()
+	if err != nil {
+		return err
+	} else if preamble.Rtype != format.RECORD_TYPE_ZDICTIONARY {
+		return ErrBadIndex
+	}
+	buff := new(bytes.Buffer)
+	if err = reader.CopyAll(buff, true); err != nil {
+		return fmt.Errorf("failed to read zstd dictionary: %w", err)
+	}
+	reader.zstdDict = buff.Bytes()
+	reader.dictBlock = dictBlock
+	return nil
+}
@@ -0,0 +1,119 @@
+package reader_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/indrora/ponzu/ponzu/reader"
+	"github.com/indrora/ponzu/ponzu/writer"
+)
+
+func TestOpen(t *testing.T) {
+	for _, withIndex := range []bool{true, false} {
+
+		buff := new(bytes.Buffer)
+		w := writer.NewWriter(buff, 2*format.BLOCK_SIZE)
+		w.WriteIndex = withIndex
+
+		files := make(map[string][]byte)
+
+		w.AppendStart("", "")
+		for i := 0; i < 10; i++ {
+			name := fmt.Sprintf("dir/file%d", i)
+			files[name] = make([]byte, rand.Intn(int(3*format.BLOCK_SIZE)))
+			rand.Read(files[name])
+			err := w.AppendStream(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_ZSTD, format.File{Name: name}, bytes.NewReader(files[name]))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		w.AppendEnd()
+		w.Close()
+
+		archive := buff.Bytes()
+
+		// The end of archive record points at the index, if there is one.
+		eoaReader := reader.NewReader(bytes.NewReader(archive[len(archive)-int(format.BLOCK_SIZE):]))
+		_, eoa, err := eoaReader.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if withIndex && (eoa == nil || eoa.(*format.EndOfArchive).Index == 0) {
+			t.Error("expected the end of archive record to point at the index")
+		} else if !withIndex && (eoa == nil || eoa.(*format.EndOfArchive).Index != 0) {
+			t.Error("expected the end of archive record not to point at an index")
+		}
+
+		r := reader.NewReaderAt(bytes.NewReader(archive), int64(len(archive)))
+
+		index, err := r.Index()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(index.Entries) != len(files) {
+			t.Errorf("index has %d entries, expected %d", len(index.Entries), len(files))
+		}
+
+		for _, i := range rand.Perm(len(files)) {
+			name := fmt.Sprintf("dir/file%d", i)
+			preamble, meta, err := r.Open(name)
+			if err != nil {
+				t.Fatalf("failed to open %v: %v", name, err)
+			}
+			if preamble.Rtype != format.RECORD_TYPE_FILE || meta.(*format.File).Name != name {
+				t.Fatalf("opened the wrong record for %v", name)
+			}
+			body := new(bytes.Buffer)
+			if err = r.CopyAll(body, true); err != nil {
+				t.Fatalf("failed to read %v: %v", name, err)
+			}
+			if !bytes.Equal(body.Bytes(), files[name]) {
+				t.Errorf("index=%v: body of %v doesn't match", withIndex, name)
+			}
+		}
+
+		if _, _, err = r.Open("nope"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("expected a missing name to not exist, got %v", err)
+		}
+	}
+}
+
+// A DataLen that wraps around when it is made into an offset must not send a random
+// access reader back to the start of the archive, round and round.
+func TestWrappingDataLen(t *testing.T) {
+	buff := new(bytes.Buffer)
+	buildArchive(t, buff, 2, nil, func(w *writer.ArchiveWriter) error {
+		for i := 0; i < 3; i++ {
+			if err := w.AppendBytes(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.File{Name: fmt.Sprintf("file%d", i)}, []byte("data")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	archive := buff.Bytes()
+	// Point the first file's body at 8KiB short of 2^64 bytes on
+	preamble, _ := format.ReadPreamble(bytes.NewReader(archive[format.BLOCK_SIZE:]))
+	preamble.DataLen = 1<<52 - 2
+	copy(archive[format.BLOCK_SIZE:], preamble.ToBytes())
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := reader.NewReaderAt(bytes.NewReader(archive), int64(len(archive))).Index()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("scanning for the index never finished")
+	}
+}
@@ -0,0 +1,47 @@
+package reader
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+
+	"github.com/indrora/ponzu/ponzu/format"
+)
+
+var ErrHardlinkTarget = errors.New("hardlink target is not a file earlier in the archive")
+
+// trackFiles keeps note of the files in the current archive, so that hardlinks can be
+// checked against them.
+func (reader *Reader) trackFiles(preamble *format.Preamble, meta any) {
+	switch {
+	case preamble.IsStartOfArchive():
+		reader.files = make(map[string]struct{})
+	case preamble.Rtype == format.RECORD_TYPE_FILE:
+		if file, ok := meta.(*format.File); ok {
+			if reader.files == nil {
+				reader.files = make(map[string]struct{})
+			}
+			reader.files[path.Clean(file.Name)] = struct{}{}
+		}
+	}
+}
+
+// CheckHardlink makes sure that a hardlink points at a file that came before it in the
+// archive, as the spec requires, and returns the cleaned up name of that file.
+//
+// A reader that has jumped about with Open uses the index to find out what came first.
+func (reader *Reader) CheckHardlink(link *format.Hardlink) (string, error) {
+	target := path.Clean(link.Target)
+	if path.IsAbs(link.Target) || !fs.ValidPath(target) {
+		return "", fmt.Errorf("%w: %v", ErrHardlinkTarget, link.Target)
+	}
+
+	if _, ok := reader.files[target]; ok {
+		return target, nil
+	}
+	if entry, ok := reader.names[target]; ok && entry.Type == format.RECORD_TYPE_FILE && entry.Block*format.BLOCK_SIZE < reader.offset {
+		return target, nil
+	}
+	return "", fmt.Errorf("%w: %v", ErrHardlinkTarget, link.Target)
+}
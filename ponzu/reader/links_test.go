@@ -0,0 +1,69 @@
+package reader_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/indrora/ponzu/ponzu/reader"
+	"github.com/indrora/ponzu/ponzu/writer"
+)
+
+func TestCheckHardlink(t *testing.T) {
+	hardlink := func(name, target string) format.Hardlink {
+		return format.Hardlink{Link: format.Link{File: format.File{Name: name, ModTime: time.Now()}, Target: target}}
+	}
+
+	buff := new(bytes.Buffer)
+	w := writer.NewWriter(buff, 2*format.BLOCK_SIZE)
+	w.AppendStart("", "")
+	w.AppendBytes(format.RECORD_TYPE_HARDLINK, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, hardlink("early", "a/file"), nil)
+	w.AppendBytes(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.File{Name: "a/file", ModTime: time.Now()}, []byte("hello"))
+	w.AppendBytes(format.RECORD_TYPE_HARDLINK, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, hardlink("good", "a/./file"), nil)
+	w.AppendBytes(format.RECORD_TYPE_HARDLINK, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, hardlink("absolute", "/a/file"), nil)
+	w.AppendEnd()
+	w.Close()
+	archive := buff.Bytes()
+
+	expected := map[string]bool{"early": false, "good": true, "absolute": false}
+	// Reading through from the start is the same whether or not the reader can seek.
+	for _, r := range []*reader.Reader{
+		reader.NewReader(bytes.NewReader(archive)),
+		reader.NewReaderAt(bytes.NewReader(archive), int64(len(archive))),
+	} {
+		for {
+			_, meta, err := r.Next()
+			if err != nil {
+				break
+			}
+			link, ok := meta.(*format.Hardlink)
+			if !ok {
+				continue
+			}
+			target, err := r.CheckHardlink(link)
+			if expected[link.Name] && (err != nil || target != "a/file") {
+				t.Errorf("expected %v to be fine, got %q, %v", link.Name, target, err)
+			} else if !expected[link.Name] && !errors.Is(err, reader.ErrHardlinkTarget) {
+				t.Errorf("expected %v to be rejected, got %v", link.Name, err)
+			}
+		}
+	}
+
+	// Random access has to come to the same conclusion.
+	r := reader.NewReaderAt(bytes.NewReader(archive), int64(len(archive)))
+	for name, ok := range expected {
+		_, meta, err := r.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = r.CheckHardlink(meta.(*format.Hardlink)); (err == nil) != ok {
+			t.Errorf("random access: unexpected result for %v: %v", name, err)
+		}
+	}
+
+	if report := reader.NewReader(bytes.NewReader(archive)).Verify(); report.Ok {
+		t.Error("expected verify to complain about the hardlinks")
+	}
+}
@@ -1,27 +1,37 @@
 package reader
 
 import (
-	"fmt"
-
 	"github.com/fxamacker/cbor/v2"
 	"github.com/indrora/ponzu/ponzu/format"
 )
 
+// unmarshalMetadata decodes the metadata of a record, or gives nil if it is of no
+// known sort.
 func unmarshalMetadata(preamble *format.Preamble, data []byte) any {
 
 	switch preamble.Rtype {
 	case format.RECORD_TYPE_CONTROL:
-		if preamble.Flags == format.RECORD_FLAG_CONTROL_START {
+		if preamble.IsStartOfArchive() {
 			return unmarshalOrNil[format.StartOfArchive](data)
+		} else if preamble.IsEndOfArchive() {
+			return unmarshalOrNil[format.EndOfArchive](data)
 		}
 	case format.RECORD_TYPE_DIRECTORY:
 		return unmarshalOrNil[format.Directory](data)
 	case format.RECORD_TYPE_FILE:
 		return unmarshalOrNil[format.File](data)
+	case format.RECORD_TYPE_SYMLINK:
+		return unmarshalOrNil[format.Symlink](data)
+	case format.RECORD_TYPE_HARDLINK:
+		return unmarshalOrNil[format.Hardlink](data)
 	case format.RECORD_TYPE_CONTINUE:
 		return nil // Continue blocks never have metadata.
 	case format.RECORD_TYPE_OS_SPECIAL:
 		return unmarshalOrNil[format.OSSpecial](data)
+	case format.RECORD_TYPE_SIGNATURE:
+		return unmarshalOrNil[format.Signature](data)
+	case format.RECORD_TYPE_PARITY:
+		return unmarshalOrNil[format.Parity](data)
 	default:
 		return nil
 	}
@@ -32,10 +42,7 @@ func unmarshalMetadata(preamble *format.Preamble, data []byte) any {
 func unmarshalOrNil[T any](data []byte) *T {
 	ret := new(T)
 	if err := cbor.Unmarshal(data, ret); err == nil {
-
 		return ret
-	} else {
-		fmt.Println("xxx: couldn't unmarshal: ", err)
 	}
 	return nil
 
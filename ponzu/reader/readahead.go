@@ -0,0 +1,217 @@
+package reader
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/indrora/ponzu/ponzu/encryption"
+	"github.com/indrora/ponzu/ponzu/format"
+	"golang.org/x/crypto/blake2b"
+)
+
+// ahead is the body of a record that has been read ahead of the reader.
+type ahead struct {
+	offset   uint64 // of the record's preamble
+	preamble *format.Preamble
+	id       []byte // of the record, if it is encrypted
+
+	data   []byte // decompressed, if the bodies are being decompressed
+	sumErr error  // from checking the checksum
+	err    error  // if the body could not be read or decompressed
+
+	done chan struct{}
+}
+
+// readAhead reads the records past the current one, checking (and decompressing) their
+// bodies on a pool of goroutines. The bodies come out in the order they are in the
+// archive.
+type readAhead struct {
+	decompress bool
+	results    chan *ahead
+	slots      chan struct{}
+	stop       chan struct{}
+
+	next *ahead // the next result, if it has been taken off results already
+	last uint64 // offset of the last result used
+}
+
+// Close stops any reading ahead. The archive itself is left open.
+func (reader *Reader) Close() error {
+	reader.stopReadAhead()
+	return nil
+}
+
+func (reader *Reader) stopReadAhead() {
+	if reader.ahead != nil {
+		close(reader.ahead.stop)
+		reader.ahead = nil
+	}
+}
+
+// readAhead returns the body of the current record, if it is being read ahead.
+// If reading ahead is not on, or the reader has gone somewhere the read ahead did not,
+// nil is returned and the body should be read as usual.
+func (reader *Reader) readAhead(decompress bool) *ahead {
+	if reader.ReadAhead <= 1 || reader.ra == nil || !reader.HasBody() {
+		return nil
+	}
+
+	offset := reader.offset
+	ra := reader.ahead
+	if ra == nil || ra.decompress != decompress || offset < ra.last {
+		reader.stopReadAhead()
+		ra = reader.startReadAhead(offset, decompress)
+	}
+
+	for {
+		if ra.next == nil {
+			next, ok := <-ra.results
+			if !ok {
+				return nil
+			}
+			ra.next = next
+		}
+
+		if ra.next.offset < offset {
+			// passed over without being read
+			ra.next = nil
+			continue
+		} else if ra.next.offset > offset {
+			return nil
+		}
+
+		res := ra.next
+		ra.next = nil
+		ra.last = offset
+		<-res.done
+		return res
+	}
+}
+
+// startReadAhead starts reading ahead from the record at the given offset.
+func (reader *Reader) startReadAhead(offset uint64, decompress bool) *readAhead {
+	ra := &readAhead{
+		decompress: decompress,
+		results:    make(chan *ahead, reader.ReadAhead),
+		slots:      make(chan struct{}, reader.ReadAhead),
+		stop:       make(chan struct{}),
+		last:       offset,
+	}
+
+	// The read ahead has a reader of its own to find the records with.
+	scan := NewReaderAt(reader.ra, reader.size)
+	scan.zstdDict = reader.zstdDict
+	scan.streamed = reader.streamed
+	scan.useKeyOf(reader)
+
+	reader.ahead = ra
+	go ra.scan(scan, offset)
+	return ra
+}
+
+// scan finds each record with a body and hands it to a goroutine to be read.
+func (ra *readAhead) scan(scan *Reader, offset uint64) {
+	defer close(ra.results)
+
+	if err := scan.jump(offset); err != nil {
+		return
+	}
+
+	// The bodies of a dictionary and its continuations, which later records need
+	var dictionary []*ahead
+
+	for {
+		preamble, _, _ := scan.readRecord()
+		if preamble == nil || scan.lastPreamble == nil {
+			// Nowhere to go from here; the reader can find out what is wrong for itself.
+			return
+		}
+		if !scan.HasBody() {
+			continue
+		}
+
+		res := &ahead{
+			offset:   scan.offset,
+			preamble: preamble,
+			id:       encryption.ID(scan.raw),
+			done:     make(chan struct{}),
+		}
+		body := io.NewSectionReader(scan.ra, int64(scan.bodyOffset), bodyLength(preamble))
+		dict, streamed, key := scan.zstdDict, scan.streamed, scan.key
+
+		select {
+		case ra.slots <- struct{}{}:
+		case <-ra.stop:
+			return
+		}
+		go func() {
+			res.read(body, dict, key, streamed, ra.decompress)
+			<-ra.slots
+			close(res.done)
+		}()
+
+		select {
+		case ra.results <- res:
+		case <-ra.stop:
+			return
+		}
+
+		if !ra.decompress {
+			continue
+		}
+		if preamble.Rtype == format.RECORD_TYPE_ZDICTIONARY {
+			dictionary = []*ahead{res}
+		} else if dictionary != nil && preamble.Rtype == format.RECORD_TYPE_CONTINUE {
+			dictionary = append(dictionary, res)
+		} else {
+			continue
+		}
+
+		if preamble.Flags&format.RECORD_FLAG_CONTINUES == 0 {
+			// That's the whole dictionary; everything after it is compressed with it.
+			buff := new(bytes.Buffer)
+			for _, part := range dictionary {
+				<-part.done
+				if part.err != nil {
+					return
+				}
+				buff.Write(part.data)
+			}
+			scan.zstdDict = buff.Bytes()
+			dictionary = nil
+		}
+	}
+}
+
+// read reads the body, checking it against its checksum and decompressing it if asked to.
+func (res *ahead) read(body io.Reader, dict []byte, key *encryption.Key, streamed bool, decompress bool) {
+	hash, _ := blake2b.New512(nil)
+	tee := io.TeeReader(body, hash)
+
+	if decompress {
+		decompressor, err := newDecompressor(tee, res.preamble, res.id, dict, key)
+		if err == nil {
+			res.data, err = io.ReadAll(decompressor)
+			decompressor.Close()
+		}
+		if err != nil {
+			res.err = err
+			return
+		}
+	}
+
+	// Decompressors may stop short of the end of the record.
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		res.err = err
+		return
+	}
+	res.sumErr = checkChecksum(res.preamble, streamed, hash.Sum(nil))
+}
+
+// skipBody moves the reader past the body of the current record, which has been read
+// ahead. A body that runs past the end of the archive takes the rest of it, as it does
+// when it is read.
+func (reader *Reader) skipBody() error {
+	end, _ := reader.bodyEnd()
+	return reader.jump(end)
+}
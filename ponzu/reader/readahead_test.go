@@ -0,0 +1,89 @@
+package reader_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/indrora/ponzu/ponzu/reader"
+	"github.com/indrora/ponzu/ponzu/writer"
+)
+
+func TestReadAhead(t *testing.T) {
+	buff := new(bytes.Buffer)
+	// chunks are one block, so most files are spread over several records.
+	w := writer.NewWriter(buff, 2*format.BLOCK_SIZE)
+
+	files := make(map[string][]byte)
+	w.AppendStart("", "")
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("file%d", i)
+		files[name] = make([]byte, rand.Intn(int(5*format.BLOCK_SIZE)))
+		rand.Read(files[name][:len(files[name])/2])
+		compression := []format.CompressionType{format.COMPRESSION_NONE, format.COMPRESSION_ZSTD, format.COMPRESSION_BROTLI}[i%3]
+		w.AppendStream(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, compression, format.File{Name: name}, bytes.NewReader(files[name]))
+		w.AppendBytes(format.RECORD_TYPE_DIRECTORY, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.Directory{File: format.File{Name: fmt.Sprintf("dir%d", i)}}, nil)
+	}
+	w.AppendEnd()
+	w.Close()
+	archive := buff.Bytes()
+
+	open := func(archive []byte) *reader.Reader {
+		r := reader.NewReaderAt(bytes.NewReader(archive), int64(len(archive)))
+		r.ReadAhead = 4
+		return r
+	}
+
+	for _, useBody := range []bool{false, true} {
+		r := open(archive)
+		seen := 0
+		err := r.Walk(func(preamble *format.Preamble, meta any) error {
+			file, ok := meta.(*format.File)
+			if !ok {
+				return nil
+			}
+			out := new(bytes.Buffer)
+			if useBody {
+				if _, err := io.Copy(out, r.Body()); err != nil {
+					return err
+				}
+			} else if err := r.CopyAll(out, true); err != nil && err != io.EOF {
+				return err
+			}
+			if !bytes.Equal(out.Bytes(), files[file.Name]) {
+				t.Errorf("body %v: %v did not round trip", useBody, file.Name)
+			}
+			seen++
+			return nil
+		})
+		r.Close()
+		if err != nil {
+			t.Fatalf("body %v: %v", useBody, err)
+		}
+		if seen != len(files) {
+			t.Errorf("body %v: read %d files, expected %d", useBody, seen, len(files))
+		}
+	}
+
+	// Verifying ahead finds the same as verifying one record at a time, including when
+	// a body claims to run past the end of the archive.
+	corrupt := bytes.Clone(archive)
+	for i := 0; i < 5; i++ {
+		corrupt[rand.Intn(len(corrupt))] ^= 0xFF
+	}
+	overlong := bytes.Clone(archive)
+	// The top of the DataLen of the first file, after the magic, type, compression and flags
+	overlong[format.BLOCK_SIZE+16] ^= 0xFF
+	for _, a := range [][]byte{archive, corrupt, overlong} {
+		expected := reader.NewReader(bytes.NewReader(a)).Verify()
+		r := open(a)
+		if report := r.Verify(); !reflect.DeepEqual(report, expected) {
+			t.Errorf("reading ahead gave a different report:\n%+v\nexpected\n%+v", report, expected)
+		}
+		r.Close()
+	}
+}
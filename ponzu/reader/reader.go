@@ -2,12 +2,14 @@ package reader
 
 import (
 	"bytes"
+	"crypto/ecdh"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 
-	"github.com/davecgh/go-spew/spew"
+	"github.com/indrora/ponzu/ponzu/encryption"
 	"github.com/indrora/ponzu/ponzu/format"
 	"github.com/indrora/ponzu/ponzu/ioutil"
 	"golang.org/x/crypto/blake2b"
@@ -37,8 +39,69 @@ const (
 type Reader struct {
 	stream       *ioutil.BlockReader
 	lastPreamble *format.Preamble
+	offset       uint64
+	bodyOffset   uint64
+	body         io.Reader // what is left of the current record's body, once reading it has begun
 
 	zstdDict []byte
+
+	// Random access, for readers made with NewReaderAt
+	ra        io.ReaderAt
+	size      int64
+	base      uint64
+	index     *format.Index
+	names     map[string]format.IndexEntry
+	dictBlock uint64
+
+	// Files seen so far in the current archive, which hardlinks may point to
+	files map[string]struct{}
+	// Whether the current archive is streamed, and so may skip data checksums
+	streamed bool
+	// Digest of the preambles read since the start of the archive, and what it was
+	// before the current record; nil if the reader did not see them all
+	chain  hash.Hash
+	signed []byte
+	// Merkle tree of the records read since the start of the archive, and their data
+	// blocks, to check against the end of archive; nil if the reader did not see them all
+	tree       *ioutil.MerkleTree
+	dataBlocks uint64
+	// Whether the reader is between a start and end of archive it has seen
+	inArchive bool
+
+	// ReadAhead is how many records past the current one to read at once, checking and
+	// decompressing their bodies in the background. It only has an effect on readers
+	// made with NewReaderAt; up to 1, bodies are read as they are asked for.
+	//
+	// Bodies that are read ahead are held in memory until they are used, and readers
+	// that read ahead should be closed once finished with.
+	ReadAhead int
+	ahead     *readAhead
+
+	// Passphrase and Identities (X25519 private keys) are tried in turn to open
+	// encrypted archives. Without one that fits, the metadata of encrypted records
+	// can't be read and Next returns ErrEncrypted for them; their checksums can still
+	// be checked with Verify.
+	Passphrase []byte
+	Identities []*ecdh.PrivateKey
+	// The key of the current archive, or why there isn't one, and the start of archive
+	// it came from
+	key    *encryption.Key
+	keyErr error
+	soa    []byte
+
+	// Salvage has Next carry on past damaged records instead of stopping at them,
+	// scanning forward block by block for the next intact record header, and telling
+	// Skipped, if it is set, about each stretch it passes over. It only has an effect on
+	// readers made with NewReaderAt.
+	//
+	// A record stored inside the body of another, such as an uncompressed archive
+	// inside an archive, can't be told apart from the archive's own records by the scan.
+	Salvage bool
+	Skipped func(skip Skip)
+	// Where to scan from after damage: the end of the last header read intact
+	resume uint64
+	// The metadata of the current record as it is stored
+	raw []byte
 }
 
 func NewReader(reader io.Reader) *Reader {
@@ -50,17 +113,80 @@ func NewReader(reader io.Reader) *Reader {
 
 func (reader *Reader) Next() (*format.Preamble, interface{}, error) {
 
-	if reader.lastPreamble != nil {
+	inArchive := reader.inArchive
+	mPreamble, metadata, err := reader.nextRecord()
+	if mPreamble == nil && inArchive && errors.Is(err, io.EOF) {
+		return nil, nil, errors.Join(ErrMissingEnd, io.ErrUnexpectedEOF)
+	} else if err != nil {
+		return mPreamble, metadata, err
+	}
+
+	switch mPreamble.Rtype {
+
+	case format.RECORD_TYPE_CONTROL:
+		if eoa, ok := metadata.(*format.EndOfArchive); ok {
+			if err := reader.CheckEnd(eoa); err != nil && !errors.Is(err, ErrEndUnchecked) {
+				return mPreamble, metadata, err
+			}
+		}
+	case format.RECORD_TYPE_DIRECTORY:
+	case format.RECORD_TYPE_HARDLINK:
+	case format.RECORD_TYPE_SYMLINK:
+	case format.RECORD_TYPE_OS_SPECIAL:
+		if mPreamble.DataLen != 0 {
+			return mPreamble, metadata, fmt.Errorf("%w: expected 0, got %v", ErrUnexpectedData, mPreamble.DataLen)
+		}
+	case format.RECORD_TYPE_ZDICTIONARY:
+		// Special case: we are going to consume the zstd dictionary and then return the next frame afterwards
+		dictBlock := reader.offset / format.BLOCK_SIZE
+		buff := new(bytes.Buffer)
+		err := reader.CopyAll(buff, true)
+		if err != nil && err != io.EOF {
+			return nil, nil, fmt.Errorf("failed to read zstd dictionary: %w", err)
+		} else {
+			reader.zstdDict = buff.Bytes()
+			reader.dictBlock = dictBlock
+			return reader.Next()
+		}
+
+	default:
+
+	}
+
+	return mPreamble, metadata, nil
+
+}
+
+// readRecord skips whatever is left of the current record and reads the preamble and
+// metadata of the one that follows it.
+//
+// If the metadata fails its checksum, the preamble is still returned (and kept) so that
+// the body can be skipped over on the next call.
+func (reader *Reader) readRecord() (*format.Preamble, any, error) {
+
+	if reader.lastPreamble != nil && reader.ra != nil {
+		// With random access, jump straight past whatever is left of the body.
+		end, ok := reader.bodyEnd()
+		if !ok {
+			return nil, nil, errors.Join(fmt.Errorf("%w: body at offset %d runs past the end of the archive", io.ErrUnexpectedEOF, reader.bodyOffset), ErrExpectedHeader)
+		}
+		if err := reader.jump(end); err != nil {
+			return nil, nil, errors.Join(err, ErrExpectedHeader)
+		}
+	} else if reader.lastPreamble != nil {
 		// we have a previous header!
 		// exhaust any data
-		reader.CopyTo(io.Discard, false)
+		io.Copy(io.Discard, reader.rawBody())
 		reader.stream.Realign()
 		reader.lastPreamble = nil
 
 	}
+	reader.body = nil
+	reader.raw = nil
 
 	var err error
 
+	reader.offset = reader.base + reader.stream.Offset()
 	mPreamble := &format.Preamble{}
 
 	if err = binary.Read(reader.stream, binary.BigEndian, mPreamble); err != nil {
@@ -70,9 +196,9 @@ func (reader *Reader) Next() (*format.Preamble, interface{}, error) {
 	// verify preamble magic
 
 	if !bytes.Equal(mPreamble.Magic[:], format.PREAMBLE_BYTES[:]) {
-		spew.Dump(mPreamble)
 		return nil, nil, ErrExpectedHeader
 	}
+	reader.addToChain(mPreamble)
 
 	// Parse from the preamble the metadata.
 	cborData := new(bytes.Buffer)
@@ -82,56 +208,55 @@ func (reader *Reader) Next() (*format.Preamble, interface{}, error) {
 	reader.stream.Realign()
 
 	if n != int64(mPreamble.MetadataLength) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		return mPreamble, nil, fmt.Errorf("%w: tried reading %v bytes, only got %v of metadata", err, mPreamble.MetadataLength, n)
 	} else if err != nil {
 		return mPreamble, nil, err
 	}
 
+	reader.lastPreamble = mPreamble
+	reader.bodyOffset = reader.base + reader.stream.Offset()
+
 	cborDataBytes := cborData.Bytes()
 	metaHashCheck := blake2b.Sum512(cborDataBytes)
 
 	if !bytes.Equal(metaHashCheck[:], mPreamble.MetadataChecksum[:]) {
 		return mPreamble, nil, fmt.Errorf("%w: metadata checksum failed, expected %x, got %x ", ErrHashMismatch, mPreamble.MetadataChecksum, metaHashCheck)
 	}
+	reader.raw = cborDataBytes
+	reader.resume = reader.bodyOffset
+
+	if mPreamble.Flags&format.RECORD_FLAG_ENCRYPTED != 0 && mPreamble.Rtype != format.RECORD_TYPE_CONTROL && len(cborDataBytes) > 0 {
+		if cborDataBytes, err = reader.openMetadata(mPreamble, cborDataBytes); err != nil {
+			return mPreamble, nil, err
+		}
+	}
 
 	var metadata any = nil
 
 	if len(cborDataBytes) > 0 {
 		metadata = unmarshalMetadata(mPreamble, cborDataBytes)
 	}
-
-	reader.lastPreamble = mPreamble
-
-	switch mPreamble.Rtype {
-
-	case format.RECORD_TYPE_CONTROL:
-	case format.RECORD_TYPE_DIRECTORY:
-	case format.RECORD_TYPE_HARDLINK:
-	case format.RECORD_TYPE_SYMLINK:
-	case format.RECORD_TYPE_OS_SPECIAL:
-		if mPreamble.DataLen != 0 {
-			return mPreamble, metadata, fmt.Errorf("%w: expected 0, got %v", ErrUnexpectedData, mPreamble.DataLen)
-		}
-	case format.RECORD_TYPE_ZDICTIONARY:
-		// Special case: we are going to consume the zstd dictionary and then return the next frame afterwards
-		spew.Dump(mPreamble)
-		buff := new(bytes.Buffer)
-		fmt.Println("calling CopyAll")
-		err := reader.CopyAll(buff, true)
-		if err != nil && err != io.EOF {
-			fmt.Println("Failed to copy all data for zstd dictionary:", err)
-			return nil, nil, err
-		} else {
-			reader.zstdDict = buff.Bytes()
-			return reader.Next()
-		}
-
-	default:
-
+	reader.trackFiles(mPreamble, metadata)
+	if mPreamble.IsStartOfArchive() {
+		reader.streamed = mPreamble.Flags&format.RECORD_FLAG_CONTROL_STREAMED != 0
+		reader.unwrapKey(cborDataBytes, metadata)
 	}
 
 	return mPreamble, metadata, nil
+}
 
+// Offset is the position in the archive, in bytes, of the preamble of the current record.
+func (reader *Reader) Offset() uint64 {
+	return reader.offset
+}
+
+// ZstdDict is the zstd dictionary in effect at the current record, or nil if there
+// isn't one.
+func (reader *Reader) ZstdDict() []byte {
+	return reader.zstdDict
 }
 
 func (reader *Reader) HasBody() bool {
@@ -142,20 +267,17 @@ func (reader *Reader) HasBody() bool {
 	}
 }
 
+// Validate checks the body of the current record against its checksum and consumes it.
+// The checksum covers the body as stored, so nothing is decompressed.
+// Continuation records are not followed; each one is validated on its own.
 func (reader *Reader) Validate() (bool, error) {
 	if !reader.HasBody() {
+		reader.lastPreamble = nil
 		return true, nil
 	}
 
-	// Hack: since the checksum is calculated after compression, we don't care.
-	reader.lastPreamble.Compression = format.COMPRESSION_NONE
-
-	err := reader.CopyAll(io.Discard, true)
-	if err == ErrHashMismatch {
-		return false, err
-	}
-	// CopyTo returns io.EOF when
-	if err != io.EOF {
+	err := reader.copyBody(io.Discard, true, false)
+	if err != nil {
 		return false, err
 	}
 	return true, nil
@@ -178,7 +300,15 @@ func (reader *Reader) GetBody(validate bool) ([]byte, error) {
 	return body.Bytes(), errors.Join(err, err2)
 }
 
+// CopyTo decompresses the body of the current record into the writer.
+// If there is no body, io.EOF is returned.
 func (reader *Reader) CopyTo(writer io.Writer, validate bool) error {
+	return reader.copyBody(writer, validate, true)
+}
+
+// copyBody copies the body of the current record into the writer, optionally
+// decompressing it on the way.
+func (reader *Reader) copyBody(writer io.Writer, validate bool, decompress bool) error {
 
 	// if there is no body, we clean up the header and leave.
 
@@ -191,26 +321,27 @@ func (reader *Reader) CopyTo(writer io.Writer, validate bool) error {
 
 	}
 
-	// Otherwise, we're going to fill up our buffer.
-
-	bodyLen := (reader.lastPreamble.DataLen * format.BLOCK_SIZE)
-	if reader.lastPreamble.Modulo != 0 {
-		bodyLen = bodyLen - (format.BLOCK_SIZE - uint64(reader.lastPreamble.Modulo))
+	if ahead := reader.readAhead(decompress); ahead != nil {
+		return reader.copyAhead(ahead, writer, validate)
 	}
 
-	// Get a limited reader
-	dataReader := io.LimitReader(reader.stream, int64(bodyLen))
+	// Otherwise, we're going to fill up our buffer.
 
 	// set up the tee: This allows us to compute the checksum in-situ, while the read is happening
 	// at no performance penalty.
 	hash, _ := blake2b.New512(nil)
 	// tee from the limited reader to the hash function glub glub
-	tee := io.TeeReader(dataReader, hash)
-	// Wrap it in our decompression function (in the simple case, this is null, otherwise this is a zstd/brotli decompressor)
-	dataReader, err = reader.getDecompressor(tee, reader.lastPreamble.Compression)
+	tee := io.TeeReader(reader.rawBody(), hash)
+	var dataReader io.Reader = tee
+	if decompress {
+		// Wrap it in our decompression function (in the simple case, this is null, otherwise this is a zstd/brotli decompressor)
+		decompressor, err := reader.getDecompressor(tee, reader.lastPreamble)
 
-	if err != nil {
-		return err
+		if err != nil {
+			return err
+		}
+		defer decompressor.Close()
+		dataReader = decompressor
 	}
 
 	_, err = io.Copy(writer, dataReader)
@@ -221,15 +352,21 @@ func (reader *Reader) CopyTo(writer io.Writer, validate bool) error {
 
 	}
 
+	// Decompressors may stop short of the end of the record (e.g. trailing padding
+	// in the final frame); make sure the whole body goes through the hash.
+	if _, err = io.Copy(io.Discard, tee); err != nil {
+		return err
+	}
+
 	checksum := hash.Sum(nil)
 
 	alignerr := reader.stream.Realign()
 	// if we've been asked to validate the checksum, do it now
 
 	if validate {
-		if !bytes.Equal(checksum, reader.lastPreamble.DataChecksum[:]) {
+		if err = reader.checkDataChecksum(checksum); err != nil {
 			reader.lastPreamble = nil
-			return ErrHashMismatch
+			return err
 		}
 	}
 
@@ -237,8 +374,76 @@ func (reader *Reader) CopyTo(writer io.Writer, validate bool) error {
 	return errors.Join(err, alignerr)
 }
 
+// copyAhead is copyBody for a body that has been read ahead.
+func (reader *Reader) copyAhead(ahead *ahead, writer io.Writer, validate bool) error {
+	if ahead.err != nil {
+		return ahead.err
+	}
+	if ahead.data != nil {
+		if _, err := writer.Write(ahead.data); err != nil {
+			return err
+		}
+	}
+
+	err := reader.skipBody()
+	if validate && ahead.sumErr != nil {
+		reader.lastPreamble = nil
+		return ahead.sumErr
+	}
+	return err
+}
+
+// rawBody is the body of the current record as it is stored. Reading from it picks up
+// wherever the last read of the body left off.
+func (reader *Reader) rawBody() io.Reader {
+	if reader.body == nil {
+		reader.body = io.LimitReader(reader.stream, bodyLength(reader.lastPreamble))
+	}
+	return reader.body
+}
+
+// bodyEnd is the offset just past the body of the current record, for readers with
+// random access. A body that would run past the end of the archive (or wrap around, as
+// DataLen is not covered by any checksum) gives the end of the archive and false.
+func (reader *Reader) bodyEnd() (uint64, bool) {
+	size := uint64(reader.size)
+	if reader.bodyOffset > size {
+		return size, false
+	}
+	if reader.lastPreamble.DataLen > (size-reader.bodyOffset)/format.BLOCK_SIZE {
+		return size, false
+	}
+	return reader.bodyOffset + reader.lastPreamble.DataLen*format.BLOCK_SIZE, true
+}
+
+// bodyLength is the length in bytes of a body as it is stored, without padding.
+func bodyLength(preamble *format.Preamble) int64 {
+	bodyLen := (preamble.DataLen * format.BLOCK_SIZE)
+	if preamble.Modulo != 0 {
+		bodyLen = bodyLen - (format.BLOCK_SIZE - uint64(preamble.Modulo))
+	}
+	return int64(bodyLen)
+}
+
+// checkDataChecksum compares the checksum of a body against the current preamble.
+func (reader *Reader) checkDataChecksum(checksum []byte) error {
+	return checkChecksum(reader.lastPreamble, reader.streamed, checksum)
+}
+
+func checkChecksum(preamble *format.Preamble, streamed bool, checksum []byte) error {
+	// Streamed archives are allowed to leave the checksum out (as all zeroes).
+	if streamed && preamble.DataChecksum == [64]byte{} {
+		return nil
+	}
+	if !bytes.Equal(checksum, preamble.DataChecksum[:]) {
+		return ErrHashMismatch
+	}
+	return nil
+}
+
+// CopyAll copies the body of the current record, and the bodies of any continuation
+// records that follow it, to the writer.
 func (reader *Reader) CopyAll(writer io.Writer, validate bool) error {
-	fmt.Println("xxx: copyAll")
 more:
 
 	if reader.lastPreamble == nil {
@@ -248,7 +453,6 @@ more:
 	continues := reader.lastPreamble.Flags&format.RECORD_FLAG_CONTINUES == format.RECORD_FLAG_CONTINUES
 
 	err := reader.CopyTo(writer, validate)
-	fmt.Println("xxx: copy err: ", err)
 	if err != nil && err != io.EOF {
 		return err
 	}
@@ -257,7 +461,7 @@ more:
 		tPre, _, err := reader.Next()
 		if err != nil {
 			return err
-		} else if tPre.Rtype != format.RECORD_TYPE_CONTINUE || tPre.Flags&format.RECORD_FLAG_CONTINUES == 0 {
+		} else if tPre.Rtype != format.RECORD_TYPE_CONTINUE {
 			return ErrExpectedContinue
 		}
 		goto more
@@ -0,0 +1,203 @@
+package reader_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/indrora/ponzu/ponzu/reader"
+	"github.com/indrora/ponzu/ponzu/writer"
+)
+
+// buildArchive writes an archive to out with a buffer of so many blocks. setup, if
+// given, sets the writer up before the archive starts, and add appends the records
+// that go between the start and end of archive. Any error fails the test.
+func buildArchive(t *testing.T, out io.Writer, blocks uint64, setup func(w *writer.ArchiveWriter), add func(w *writer.ArchiveWriter) error) {
+	t.Helper()
+	w := writer.NewWriter(out, blocks*format.BLOCK_SIZE)
+	if setup != nil {
+		setup(w)
+	}
+	if err := w.AppendStart("", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := add(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AppendEnd(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Round trip a file that is split over several continuation records.
+func TestCopyAllContinues(t *testing.T) {
+
+	for _, compression := range []format.CompressionType{
+		format.COMPRESSION_NONE,
+		format.COMPRESSION_ZSTD,
+		format.COMPRESSION_BROTLI,
+		format.COMPRESSION_LZ4,
+		format.COMPRESSION_XZ,
+		format.COMPRESSION_DEFLATE,
+	} {
+
+		buff := new(bytes.Buffer)
+		// chunks are half of the read buffer, so this is one block per record.
+		w := writer.NewWriter(buff, 2*format.BLOCK_SIZE)
+
+		data := make([]byte, int(3.5*float32(format.BLOCK_SIZE)))
+		rand.Read(data)
+
+		w.AppendStart("", "")
+		err := w.AppendStream(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, compression, format.File{Name: "foo", ModTime: time.Now()}, bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.AppendEnd()
+		w.Close()
+
+		r := reader.NewReader(buff)
+
+		if _, _, err := r.Next(); err != nil {
+			t.Fatalf("failed to read start of archive: %v", err)
+		}
+		preamble, meta, err := r.Next()
+		if err != nil {
+			t.Fatalf("failed to read file record: %v", err)
+		}
+		if preamble.Rtype != format.RECORD_TYPE_FILE {
+			t.Fatalf("expected a file record, got %v", preamble.Rtype)
+		}
+		if meta.(*format.File).Name != "foo" {
+			t.Errorf("wrong file name: %v", meta.(*format.File).Name)
+		}
+
+		out := new(bytes.Buffer)
+		if err = r.CopyAll(out, true); err != nil {
+			t.Fatalf("compression %v: failed to copy: %v", compression, err)
+		}
+		if !bytes.Equal(out.Bytes(), data) {
+			t.Errorf("compression %v: round trip failed, got %d bytes, expected %d", compression, out.Len(), len(data))
+		}
+
+		preamble, _, err = r.Next()
+		if err != nil {
+			t.Fatalf("failed to read end of archive: %v", err)
+		}
+		if preamble.Rtype != format.RECORD_TYPE_CONTROL || preamble.Flags != format.RECORD_FLAG_CONTROL_END {
+			t.Errorf("expected end of archive, got type %v flags %v", preamble.Rtype, preamble.Flags)
+		}
+	}
+}
+
+// A body that fills its last block exactly must not claim an extra block.
+func TestExactBlockBody(t *testing.T) {
+	buff := new(bytes.Buffer)
+	w := writer.NewWriter(buff, 0)
+
+	data := make([]byte, 2*format.BLOCK_SIZE)
+	rand.Read(data)
+	w.AppendBytes(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.File{Name: "exact"}, data)
+	w.AppendEnd()
+	w.Close()
+
+	r := reader.NewReader(buff)
+	preamble, _, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preamble.DataLen != 2 || preamble.Modulo != uint16(format.BLOCK_SIZE) {
+		t.Errorf("expected 2 full blocks, got %d blocks, modulo %d", preamble.DataLen, preamble.Modulo)
+	}
+	body, err := r.GetBody(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, data) {
+		t.Error("body does not match")
+	}
+	if preamble, _, err = r.Next(); err != nil || preamble.Flags != format.RECORD_FLAG_CONTROL_END {
+		t.Errorf("expected end of archive after body, got %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	buff := new(bytes.Buffer)
+	w := writer.NewWriter(buff, 2*format.BLOCK_SIZE)
+
+	data := make([]byte, 3*format.BLOCK_SIZE)
+	rand.Read(data)
+
+	w.AppendStart("", "")
+	w.AppendStream(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_ZSTD, format.File{Name: "foo"}, bytes.NewReader(data))
+	w.AppendEnd()
+	w.Close()
+
+	archive := buff.Bytes()
+
+	report := reader.NewReader(bytes.NewReader(archive)).Verify()
+	if !report.Ok {
+		t.Fatalf("expected a clean archive to verify: %+v", report)
+	}
+	if report.Records[1].Name != "foo" {
+		t.Errorf("expected record 1 to be foo, got %q", report.Records[1].Name)
+	}
+
+	// Flip a byte in the body of the file record.
+	corrupt := bytes.Clone(archive)
+	corrupt[report.Records[1].Offset+format.BLOCK_SIZE] ^= 0xFF
+
+	report = reader.NewReader(bytes.NewReader(corrupt)).Verify()
+	if report.Ok {
+		t.Fatal("expected a corrupted archive to fail")
+	}
+	if report.Records[1].DataOK {
+		t.Error("expected the data checksum of record 1 to fail")
+	}
+	if !report.Records[2].Ok() {
+		t.Error("expected verification to carry on past the bad record")
+	}
+
+	// Chop off the end of archive record.
+	report = reader.NewReader(bytes.NewReader(archive[:len(archive)-int(format.BLOCK_SIZE)])).Verify()
+	if report.Ok || len(report.Errors) == 0 {
+		t.Error("expected a truncated archive to fail")
+	}
+}
+
+// Streamed archives may leave data checksums out; nothing else may.
+func TestStreamedChecksum(t *testing.T) {
+	for _, streamed := range []bool{false, true} {
+		buff := new(bytes.Buffer)
+		w := writer.NewWriter(buff, 2*format.BLOCK_SIZE)
+		w.Streamed = streamed
+
+		w.AppendStart("", "")
+		w.AppendBytes(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.File{Name: "foo"}, []byte("hello"))
+		w.AppendEnd()
+		w.Close()
+
+		// Zero out the data checksum of the file record, which comes after the magic,
+		// type, compression, flags, length and modulo.
+		archive := buff.Bytes()
+		checksum := format.BLOCK_SIZE + 6 + 1 + 1 + 2 + 8 + 2
+		copy(archive[checksum:checksum+64], make([]byte, 64))
+
+		// The end of archive accounts for the checksum as it was written, so put a bare
+		// one in its place, as a writer that left the checksum out would have.
+		end := new(bytes.Buffer)
+		writer.NewWriter(end, 0).AppendBytes(format.RECORD_TYPE_CONTROL, format.RECORD_FLAG_CONTROL_END, format.COMPRESSION_NONE, nil, nil)
+		archive = append(archive[:len(archive)-int(format.BLOCK_SIZE)], end.Bytes()...)
+
+		report := reader.NewReader(bytes.NewReader(archive)).Verify()
+		if report.Ok != streamed {
+			t.Errorf("streamed %v: expected ok to be %v: %+v", streamed, streamed, report)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package reader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/indrora/ponzu/ponzu/format"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Skip is a stretch of a damaged archive that a salvaging reader passed over.
+type Skip struct {
+	// From is where the damage was found, and To where the next intact record (or
+	// the end of the archive) is, both as byte offsets.
+	From, To uint64
+	// Err is what was wrong at From.
+	Err error
+}
+
+// nextRecord is readRecord, which in salvage mode carries on past damaged records to
+// the next intact one.
+func (reader *Reader) nextRecord() (*format.Preamble, any, error) {
+	preamble, metadata, err := reader.readRecord()
+
+	floor := uint64(0)
+	for reader.Salvage && reader.ra != nil && damaged(preamble, err) {
+		// Scan from the end of the last header that was intact: if what was wrong is
+		// the length of the body after it, the next record is somewhere in there.
+		start := reader.resume
+		if start < floor {
+			start = floor
+		}
+		next := reader.findRecord(start)
+		floor = next + format.BLOCK_SIZE
+
+		from := reader.offset
+		if from < start || from >= next {
+			from = start
+		}
+		if reader.Skipped != nil {
+			reader.Skipped(Skip{From: from, To: next, Err: err})
+		}
+
+		if err := reader.seek(next); err != nil {
+			return nil, nil, err
+		}
+		preamble, metadata, err = reader.readRecord()
+	}
+	return preamble, metadata, err
+}
+
+// damaged is whether an error from readRecord is down to damage that salvage mode can
+// skip over, rather than the end of the archive or a record that can't be decrypted.
+func damaged(preamble *format.Preamble, err error) bool {
+	if err == nil {
+		return false
+	}
+	if preamble == nil {
+		// Not even a preamble: the magic is wrong, or the archive stops partway through one.
+		return !errors.Is(err, io.EOF)
+	}
+	return errors.Is(err, ErrHashMismatch) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// findRecord looks for the first intact record header on a block boundary from offset
+// on: one with the magic and metadata that matches its checksum. It returns the offset
+// of that record, or the size of the archive if there are no more.
+func (reader *Reader) findRecord(offset uint64) uint64 {
+	size := uint64(reader.size)
+	header := make([]byte, binary.Size(format.Preamble{}))
+
+	for ; offset+uint64(len(header)) <= size; offset += format.BLOCK_SIZE {
+		if n, _ := reader.ra.ReadAt(header, int64(offset)); n < len(header) || !bytes.HasPrefix(header, format.PREAMBLE_BYTES) {
+			continue
+		}
+		preamble := &format.Preamble{}
+		binary.Read(bytes.NewReader(header), binary.BigEndian, preamble)
+
+		metadata := make([]byte, preamble.MetadataLength)
+		if n, _ := reader.ra.ReadAt(metadata, int64(offset)+int64(len(header))); n < len(metadata) {
+			continue
+		}
+		if blake2b.Sum512(metadata) == preamble.MetadataChecksum {
+			return offset
+		}
+	}
+	return size
+}
+
+// NextRaw moves to the next record as Next does, for copying records from one archive
+// to another as they are stored: every record is returned as it comes, zstd
+// dictionaries included, and nothing is checked past the record's own header. Records
+// whose metadata can't be decrypted come back with ErrEncrypted, as from Next.
+//
+// RawMetadata and RawBody give the metadata and body of the record as they are stored.
+func (reader *Reader) NextRaw() (*format.Preamble, any, error) {
+	return reader.nextRecord()
+}
+
+// RawMetadata is the metadata of the current record as it is stored, still encrypted
+// if the record is.
+func (reader *Reader) RawMetadata() []byte {
+	return reader.raw
+}
+
+// RawBody is the body of the current record as it is stored: compressed, encrypted if
+// the record is, and not checked against its checksum. Reading it moves the reader
+// through the body as CopyTo does.
+func (reader *Reader) RawBody() io.Reader {
+	if !reader.HasBody() {
+		return bytes.NewReader(nil)
+	}
+	return reader.rawBody()
+}
@@ -0,0 +1,114 @@
+package reader_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/indrora/ponzu/ponzu/reader"
+	"github.com/indrora/ponzu/ponzu/writer"
+)
+
+func TestSalvage(t *testing.T) {
+	buff := new(bytes.Buffer)
+	w := writer.NewWriter(buff, 0)
+	w.AppendStart("", "")
+	names := []string{}
+	for i := 0; i < 6; i++ {
+		names = append(names, fmt.Sprint(i))
+		w.AppendBytes(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.File{Name: names[i]}, bytes.Repeat([]byte{byte(i)}, 100))
+	}
+	w.AppendEnd()
+	w.Close()
+	archive := buff.Bytes()
+
+	block := uint64(format.BLOCK_SIZE)
+	// Each file is a header block and a body block, from block 1 on.
+	header := func(i int) uint64 { return (1 + 2*uint64(i)) * block }
+	dataLen := func(damaged []byte, i int, blocks uint64) {
+		binary.BigEndian.PutUint64(damaged[header(i)+10:], blocks)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		damage func([]byte)
+		names  []string
+		skips  []reader.Skip
+	}{
+		{
+			name:   "magic",
+			damage: func(d []byte) { d[header(2)] = 'X' },
+			names:  []string{"0", "1", "3", "4", "5"},
+			skips:  []reader.Skip{{From: header(2), To: header(3)}},
+		},
+		{
+			name:   "metadata",
+			damage: func(d []byte) { d[header(2)+160] ^= 1 },
+			names:  []string{"0", "1", "3", "4", "5"},
+			skips:  []reader.Skip{{From: header(2), To: header(3)}},
+		},
+		{
+			// The record after the first is found again by scanning its body.
+			name:   "body length",
+			damage: func(d []byte) { dataLen(d, 1, 2) },
+			names:  names,
+			skips:  []reader.Skip{{From: header(1) + block, To: header(2)}},
+		},
+		{
+			name:   "body length past the end",
+			damage: func(d []byte) { dataLen(d, 4, 1<<40) },
+			names:  names,
+			skips:  []reader.Skip{{From: header(4) + block, To: header(5)}},
+		},
+		{
+			name:   "two places",
+			damage: func(d []byte) { d[header(0)] = 0; d[header(3)+160] ^= 1 },
+			names:  []string{"1", "2", "4", "5"},
+			skips:  []reader.Skip{{From: header(0), To: header(1)}, {From: header(3), To: header(4)}},
+		},
+	} {
+		damaged := bytes.Clone(archive)
+		tc.damage(damaged)
+
+		if err := reader.NewReader(bytes.NewReader(damaged)).Walk(func(*format.Preamble, any) error { return nil }); err == nil {
+			t.Errorf("%v: expected an error reading without salvage", tc.name)
+		}
+
+		r := reader.NewReaderAt(bytes.NewReader(damaged), int64(len(damaged)))
+		r.Salvage = true
+		skips := []reader.Skip{}
+		r.Skipped = func(skip reader.Skip) {
+			if skip.Err == nil {
+				t.Errorf("%v: skip without an error", tc.name)
+			}
+			skip.Err = nil
+			skips = append(skips, skip)
+		}
+
+		found := []string{}
+		ended := false
+		for {
+			preamble, meta, err := r.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				t.Fatalf("%v: %v", tc.name, err)
+			}
+			if file, ok := meta.(*format.File); ok {
+				found = append(found, file.Name)
+			}
+			ended = preamble.IsEndOfArchive()
+		}
+		if !reflect.DeepEqual(found, tc.names) || !ended {
+			t.Errorf("%v: expected %v and the end of archive, got %v", tc.name, tc.names, found)
+		}
+		if !reflect.DeepEqual(skips, tc.skips) {
+			t.Errorf("%v: expected skips %+v, got %+v", tc.name, tc.skips, skips)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package reader
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/indrora/ponzu/ponzu/ioutil"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/ed25519"
+)
+
+var (
+	ErrBadSignature       = errors.New("signature does not match the archive")
+	ErrUnknownSignature   = errors.New("unknown signature algorithm")
+	ErrSignatureUnchecked = errors.New("signature can only be checked reading the archive from its start")
+)
+
+// addToChain adds a preamble to the digest of the archive, and the Merkle tree of its
+// records, starting new ones at the start of each archive.
+func (reader *Reader) addToChain(preamble *format.Preamble) {
+	if preamble.IsStartOfArchive() {
+		reader.chain, _ = blake2b.New512(nil)
+		reader.tree, reader.dataBlocks = new(ioutil.MerkleTree), 0
+	}
+	reader.inArchive = (reader.inArchive || preamble.IsStartOfArchive()) && !preamble.IsEndOfArchive()
+	reader.signed = nil
+	if reader.chain != nil {
+		reader.signed = reader.chain.Sum(nil)
+		preamble.WritePreamble(reader.chain)
+	}
+	reader.addToTree(preamble)
+}
+
+// SignedDigest is what a signature at the current record signs: the BLAKE2b-512 digest
+// of the preambles of every record from the start of the archive up to the current one.
+// It is nil if the reader has not read all of them, such as after Open.
+func (reader *Reader) SignedDigest() []byte {
+	return reader.signed
+}
+
+// CheckSignature checks a signature, from the current record, against the records before
+// it. It says nothing about whose key made it; that is for the caller to decide.
+func (reader *Reader) CheckSignature(sig *format.Signature) error {
+	if reader.signed == nil {
+		return ErrSignatureUnchecked
+	}
+	if sig.Algorithm != format.SIGNATURE_ED25519 {
+		return fmt.Errorf("%w %q", ErrUnknownSignature, sig.Algorithm)
+	}
+	if len(sig.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(sig.PublicKey, reader.signed, sig.Signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package reader_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/indrora/ponzu/ponzu/reader"
+	"github.com/indrora/ponzu/ponzu/writer"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestSignature(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	build := func(key ed25519.PrivateKey, jobs int) []byte {
+		buff := new(bytes.Buffer)
+		setup := func(w *writer.ArchiveWriter) {
+			w.SignKey = key
+			w.Jobs = jobs
+			w.WriteIndex = true
+		}
+		buildArchive(t, buff, 2, setup, func(w *writer.ArchiveWriter) error {
+			for i := 0; i < 5; i++ {
+				data := make([]byte, 3*format.BLOCK_SIZE)
+				rand.Read(data)
+				if err := w.AppendStream(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_ZSTD, format.File{Name: fmt.Sprint(i)}, bytes.NewReader(data)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		return buff.Bytes()
+	}
+
+	for _, jobs := range []int{1, 4} {
+		archive := build(private, jobs)
+		report := reader.NewReader(bytes.NewReader(archive)).Verify()
+		if !report.Ok {
+			t.Fatalf("jobs %d: expected a signed archive to verify, got %+v", jobs, report)
+		}
+		if len(report.Signatures) != 1 || !report.Signatures[0].Ok || !public.Equal(ed25519.PublicKey(report.Signatures[0].PublicKey)) {
+			t.Errorf("jobs %d: expected one good signature by the key, got %+v", jobs, report.Signatures)
+		}
+
+		// Changing any preamble, even in a way that still checks out, breaks the signature.
+		tampered := bytes.Clone(archive)
+		tampered[format.BLOCK_SIZE+7] = byte(format.COMPRESSION_NONE)
+		report = reader.NewReader(bytes.NewReader(tampered)).Verify()
+		if len(report.Signatures) != 1 || report.Signatures[0].Ok || report.Ok {
+			t.Errorf("jobs %d: expected the signature to fail, got %+v", jobs, report.Signatures)
+		}
+	}
+
+	// Signing an archive after the fact, in place of its end of archive, signs the same
+	// thing as signing it while it is written.
+	unsigned := build(nil, 1)
+	r := reader.NewReader(bytes.NewReader(unsigned))
+	var end uint64
+	var digest []byte
+	for {
+		preamble, _, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if preamble.IsEndOfArchive() {
+			end, digest = r.Offset(), r.SignedDigest()
+		}
+	}
+
+	buff := bytes.NewBuffer(bytes.Clone(unsigned[:end]))
+	if err := writer.NewWriter(buff, 0).AppendSignature(private, digest); err != nil {
+		t.Fatal(err)
+	}
+	buff.Write(unsigned[end:])
+	report := reader.NewReader(bytes.NewReader(buff.Bytes())).Verify()
+	if !report.Ok || len(report.Signatures) != 1 {
+		t.Errorf("expected an archive signed afterwards to verify, got %+v", report)
+	}
+
+	// Random access readers can't check signatures found by skipping ahead.
+	ra := reader.NewReaderAt(bytes.NewReader(buff.Bytes()), int64(buff.Len()))
+	if _, _, err := ra.Open("3"); err != nil {
+		t.Fatal(err)
+	}
+	if ra.SignedDigest() != nil {
+		t.Error("expected no digest after Open")
+	}
+}
+
+// A signature only vouches for an archive if nothing but more signatures and an end of
+// archive that matches it come after it, in every archive in the file.
+func TestSignedBy(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	stranger, _, _ := ed25519.GenerateKey(rand.Reader)
+	keys := []ed25519.PublicKey{stranger, public}
+
+	file := func(w *writer.ArchiveWriter, name string) error {
+		return w.AppendBytes(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.File{Name: name}, []byte(name))
+	}
+	build := func(setup func(w *writer.ArchiveWriter), add func(w *writer.ArchiveWriter) error) []byte {
+		buff := new(bytes.Buffer)
+		buildArchive(t, buff, 2, setup, add)
+		return buff.Bytes()
+	}
+	signed := build(func(w *writer.ArchiveWriter) {
+		w.SignKey = private
+		w.Parity = 16
+	}, func(w *writer.ArchiveWriter) error {
+		for i := 0; i < 20; i++ {
+			if err := file(w, fmt.Sprint(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	unsigned := build(nil, func(w *writer.ArchiveWriter) error { return file(w, "evil") })
+	// Someone without the key can add records after the signature, as the end of
+	// archive is theirs to write.
+	inserted := build(nil, func(w *writer.ArchiveWriter) error {
+		if err := file(w, "good"); err != nil {
+			return err
+		}
+		if err := w.AppendSignature(private, nil); err != nil {
+			return err
+		}
+		return file(w, "evil")
+	})
+
+	testCases := []struct {
+		name    string
+		archive []byte
+		keys    []ed25519.PublicKey
+		signed  bool
+	}{
+		{"signed", signed, keys, true},
+		{"other key", signed, []ed25519.PublicKey{stranger}, false},
+		{"unsigned", unsigned, keys, false},
+		{"appended archive", append(bytes.Clone(signed), unsigned...), keys, false},
+		{"two signed archives", append(bytes.Clone(signed), signed...), keys, true},
+		{"inserted record", inserted, keys, false},
+	}
+	for _, tc := range testCases {
+		report := reader.NewReader(bytes.NewReader(tc.archive)).Verify()
+		if !report.Ok {
+			t.Errorf("%v: expected the archive to verify, got %+v", tc.name, report)
+		}
+		if report.SignedBy(tc.keys) != tc.signed {
+			t.Errorf("%v: expected SignedBy to be %v, got signatures %+v", tc.name, tc.signed, report.Signatures)
+		}
+	}
+}
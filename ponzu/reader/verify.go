@@ -0,0 +1,240 @@
+package reader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/indrora/ponzu/ponzu/format"
+	"golang.org/x/crypto/ed25519"
+)
+
+var (
+	ErrMissingStart       = errors.New("record found outside of an archive (missing start of archive)")
+	ErrMissingEnd         = errors.New("archive is truncated: it ended without an end of archive record")
+	ErrNestedStart        = errors.New("start of archive found before the end of the previous archive")
+	ErrBrokenChain        = errors.New("continuation chain is broken")
+	ErrOrphanContinue     = errors.New("continuation record does not follow a continued record")
+	ErrUnreadableArchive  = errors.New("archive could not be read past this point")
+	ErrMalformedSignature = errors.New("signature record could not be read")
+)
+
+// RecordReport is the outcome of verifying a single record.
+type RecordReport struct {
+	// Position of the record in the archive, counting from 0
+	Index int `json:"index"`
+	// Byte offset of the record's preamble
+	Offset uint64 `json:"offset"`
+	// Record type and flags, straight from the preamble
+	Type  format.RecordType  `json:"type"`
+	Flags format.RecordFlags `json:"flags"`
+	// Name of the record, if it has one
+	Name string `json:"name,omitempty"`
+	// Whether the metadata and data checksums matched
+	MetadataOK bool `json:"metadataOk"`
+	DataOK     bool `json:"dataOk"`
+	// Anything else that is wrong with this record
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Ok is true if nothing was wrong with the record.
+func (r *RecordReport) Ok() bool {
+	return r.MetadataOK && r.DataOK && len(r.Errors) == 0
+}
+
+// SignatureReport is a signature found in an archive.
+type SignatureReport struct {
+	// Position of the signature record in the archive
+	Record int `json:"record"`
+	// Key the signature was made with, which is only as trustworthy as the archive
+	// unless the caller knows it
+	PublicKey []byte `json:"publicKey"`
+	// Whether the signature matched the records before it
+	Ok bool `json:"ok"`
+	// Which archive in the file the signature is in, counting from 0
+	Archive int `json:"archive"`
+	// Whether the signature covers the whole of its archive: only more signatures come
+	// after it, then an end of archive that accounts for exactly the records signed
+	Covers bool `json:"covers"`
+}
+
+// VerifyReport is the outcome of verifying a whole archive.
+type VerifyReport struct {
+	Records    []RecordReport    `json:"records"`
+	Signatures []SignatureReport `json:"signatures,omitempty"`
+	// How many archives the file holds
+	Archives int `json:"archives"`
+	// Problems with the archive as a whole, such as a missing end of archive record
+	Errors []string `json:"errors,omitempty"`
+	// True if every record and the archive framing checked out
+	Ok bool `json:"ok"`
+}
+
+// Verify walks every record in the archive, checking the metadata and data checksums
+// of each one along with the framing of the archive: every record must be inside a
+// start/end of archive pair, continuation chains must be unbroken, hardlinks must
+// point at files that came before them, signatures must match what they sign, and the
+// end of archive must account for every record before it.
+//
+// Bodies are checked as they are stored, so nothing is decompressed, and encrypted
+// archives can be verified without their key.
+// Every problem found, including an archive that cannot be read to the end, is
+// recorded in the report.
+func (reader *Reader) Verify() *VerifyReport {
+
+	report := &VerifyReport{
+		Records: make([]RecordReport, 0),
+	}
+
+	inArchive := false
+	continues := false
+	// The signatures since the last record that wasn't one, which cover the archive if
+	// its end comes next
+	var tail []int
+
+	for index := 0; ; index++ {
+
+		preamble, meta, err := reader.readRecord()
+
+		if preamble == nil {
+			if !errors.Is(err, io.EOF) {
+				report.Errors = append(report.Errors, fmt.Sprintf("%v at offset %d: %v", ErrUnreadableArchive, reader.offset, err))
+			}
+			break
+		}
+
+		record := RecordReport{
+			Index:      index,
+			Offset:     reader.offset,
+			Type:       preamble.Rtype,
+			Flags:      preamble.Flags,
+			MetadataOK: err == nil,
+		}
+		if errors.Is(err, ErrEncrypted) {
+			// The checksum matched; there is just no reading what it is of.
+			record.MetadataOK = true
+		} else if err != nil {
+			record.Errors = append(record.Errors, err.Error())
+		}
+		if name, ok := format.RecordName(meta); ok {
+			record.Name = name
+		}
+		if link, ok := meta.(*format.Hardlink); ok {
+			if _, err := reader.CheckHardlink(link); err != nil {
+				record.Errors = append(record.Errors, err.Error())
+			}
+		}
+		isStart := preamble.IsStartOfArchive()
+		isEnd := preamble.IsEndOfArchive()
+		if isStart {
+			report.Archives++
+		}
+
+		if sig, ok := meta.(*format.Signature); ok {
+			err := reader.CheckSignature(sig)
+			if err != nil {
+				record.Errors = append(record.Errors, err.Error())
+			}
+			tail = append(tail, len(report.Signatures))
+			report.Signatures = append(report.Signatures, SignatureReport{
+				Record:    index,
+				PublicKey: sig.PublicKey,
+				Ok:        err == nil,
+				Archive:   report.Archives - 1,
+			})
+		} else if eoa, ok := meta.(*format.EndOfArchive); ok {
+			if err := reader.CheckEnd(eoa); err != nil {
+				record.Errors = append(record.Errors, err.Error())
+			} else if reader.endMatches(eoa) {
+				for _, i := range tail {
+					report.Signatures[i].Covers = true
+				}
+			}
+			tail = nil
+		} else {
+			if preamble.Rtype == format.RECORD_TYPE_SIGNATURE && err == nil {
+				record.Errors = append(record.Errors, ErrMalformedSignature.Error())
+			}
+			tail = nil
+		}
+
+		// Check that the record fits where it was found.
+		if continues && preamble.Rtype != format.RECORD_TYPE_CONTINUE {
+			record.Errors = append(record.Errors, ErrBrokenChain.Error())
+		} else if !continues && preamble.Rtype == format.RECORD_TYPE_CONTINUE {
+			record.Errors = append(record.Errors, ErrOrphanContinue.Error())
+		}
+
+		if isStart {
+			if inArchive {
+				record.Errors = append(record.Errors, ErrNestedStart.Error())
+			}
+			inArchive = true
+		} else if !inArchive {
+			record.Errors = append(record.Errors, ErrMissingStart.Error())
+		} else if isEnd {
+			inArchive = false
+		}
+
+		// Control records reuse the CONTINUES bit for CONTROL_END.
+		continues = preamble.Rtype != format.RECORD_TYPE_CONTROL && preamble.Flags&format.RECORD_FLAG_CONTINUES == format.RECORD_FLAG_CONTINUES
+
+		// Then check the body.
+		if ok, err := reader.Validate(); ok {
+			record.DataOK = true
+		} else {
+			record.Errors = append(record.Errors, err.Error())
+			if !errors.Is(err, ErrHashMismatch) {
+				// the body could not be read at all; there is nothing more to find.
+				report.Records = append(report.Records, record)
+				break
+			}
+		}
+
+		report.Records = append(report.Records, record)
+	}
+
+	if continues {
+		report.Errors = append(report.Errors, ErrBrokenChain.Error())
+	}
+	if inArchive {
+		report.Errors = append(report.Errors, ErrMissingEnd.Error())
+	}
+	if len(report.Records) == 0 {
+		report.Errors = append(report.Errors, ErrMissingStart.Error())
+	}
+
+	report.Ok = len(report.Errors) == 0
+	for i := range report.Records {
+		report.Ok = report.Ok && report.Records[i].Ok()
+	}
+
+	return report
+}
+
+// SignedBy is true if every archive in the file is signed by one of the keys, with a
+// signature that covers the whole of it (see SignatureReport.Covers). A signature that
+// only covers part of an archive, or an archive without one, could have had anything
+// added to it by someone without the key.
+func (report *VerifyReport) SignedBy(keys []ed25519.PublicKey) bool {
+	if report.Archives == 0 {
+		return false
+	}
+	signed := make([]bool, report.Archives)
+	for _, sig := range report.Signatures {
+		if !sig.Ok || !sig.Covers || sig.Archive < 0 {
+			continue
+		}
+		for _, key := range keys {
+			if key.Equal(ed25519.PublicKey(sig.PublicKey)) {
+				signed[sig.Archive] = true
+			}
+		}
+	}
+	for _, ok := range signed {
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
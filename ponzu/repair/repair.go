@@ -0,0 +1,273 @@
+// Package repair rebuilds the damaged blocks of an archive from the parity records in it.
+package repair
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/indrora/ponzu/ponzu/parity"
+	"github.com/indrora/ponzu/ponzu/reader"
+	"golang.org/x/crypto/blake2b"
+)
+
+// maxRounds is the most times Repair goes over the archive. Rebuilding a parity record
+// can make it possible to rebuild more, so it takes more than one go.
+const maxRounds = 8
+
+// Damage is a stretch of an archive found to be damaged: a record that fails its
+// checksum, header and body, or something the reader had to skip to find the next record.
+type Damage struct {
+	// From and To are byte offsets.
+	From, To uint64
+	Err      error
+}
+
+// Result is what Repair found and did.
+type Result struct {
+	// Found is the damage found in the archive as it is, and Damaged what is still
+	// damaged once the rebuilt blocks are in place.
+	Found   []Damage
+	Damaged []Damage
+	// Blocks are the blocks that were rebuilt, by their offset in the archive.
+	Blocks map[uint64][]byte
+	// Parity is how many intact parity records were found.
+	Parity int
+}
+
+// run is a run of blocks covered by a parity record.
+type run struct {
+	start   uint64 // block number
+	blocks  int
+	stripes int
+	shards  int
+	parity  []byte
+}
+
+// Repair looks through an archive for damage, locating it with the checksums of the
+// records, and rebuilds what it can from the parity records. Blocks that don't agree
+// with their parity are rebuilt even if no checksum caught them, such as damage to the
+// parts of a preamble that nothing else covers.
+//
+// Nothing is written: the rebuilt blocks are returned, to be written in place once
+// the archive is known to be free of damage with them.
+func Repair(ra io.ReaderAt, size int64) (*Result, error) {
+	result := &Result{Blocks: map[uint64][]byte{}}
+	archive := &patched{ra: ra, blocks: result.Blocks}
+
+	s, err := survey(archive, size)
+	if err != nil {
+		return nil, err
+	}
+	result.Found, result.Parity = s.damage, len(s.runs)
+
+	for round := 0; round < maxRounds; round++ {
+		rebuilt := 0
+		for _, run := range s.runs {
+			rebuilt += rebuild(archive, size, run, s.suspect)
+		}
+		if rebuilt == 0 {
+			break
+		}
+		if s, err = survey(archive, size); err != nil {
+			return nil, err
+		}
+		if len(s.damage) == 0 {
+			break
+		}
+	}
+	result.Damaged = s.damage
+	return result, nil
+}
+
+// surveyed is what survey found: the damage, the blocks it covers and the runs of
+// blocks that parity can be used for.
+type surveyed struct {
+	damage  []Damage
+	suspect map[uint64]bool
+	runs    []run
+}
+
+func (s *surveyed) add(from uint64, to uint64, err error) {
+	s.damage = append(s.damage, Damage{From: from, To: to, Err: err})
+	for block := from / format.BLOCK_SIZE; block*format.BLOCK_SIZE < to; block++ {
+		s.suspect[block] = true
+	}
+}
+
+// survey reads through an archive, checking each record and collecting the parity
+// records that are intact.
+func survey(ra io.ReaderAt, size int64) (*surveyed, error) {
+	s := &surveyed{suspect: map[uint64]bool{}}
+
+	// A record whose body runs past the end of the archive, until the reader skips on to
+	// the record after it.
+	var long *overlong
+
+	r := reader.NewReaderAt(ra, size)
+	r.Salvage = true
+	r.Skipped = func(skip reader.Skip) {
+		if long != nil && skip.From == long.body {
+			// If the body up to the next record is intact, it was only the header that
+			// was damaged.
+			if intactBody(ra, long.preamble, skip.From, skip.To) {
+				s.add(long.offset, long.body, skip.Err)
+			} else {
+				s.add(long.offset, skip.To, skip.Err)
+			}
+			long = nil
+			return
+		}
+		s.add(skip.From, skip.To, skip.Err)
+	}
+
+	preambleSize := uint64(binary.Size(format.Preamble{}))
+	for {
+		// Encrypted records are checked as they are stored, so there's no need to read them.
+		preamble, meta, err := r.NextRaw()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil && !errors.Is(err, reader.ErrEncrypted) {
+			return nil, err
+		}
+
+		offset := r.Offset()
+		header := (preambleSize + uint64(preamble.MetadataLength) + format.BLOCK_SIZE - 1) / format.BLOCK_SIZE
+		// DataLen is not covered by any checksum, so a damaged one may run the record past
+		// the end of the archive, or even past 2^64. Where the record really ends is found
+		// when the reader skips on to the next one.
+		left := (uint64(size) - offset) / format.BLOCK_SIZE
+		if header > left || preamble.DataLen > left-header {
+			long = &overlong{preamble: preamble, offset: offset, body: offset + header*format.BLOCK_SIZE}
+			continue
+		}
+		end := offset + (header+preamble.DataLen)*format.BLOCK_SIZE
+
+		if p, ok := meta.(*format.Parity); ok {
+			body, err := io.ReadAll(r.RawBody())
+			if err != nil || blake2b.Sum512(body) != preamble.DataChecksum {
+				s.add(offset, end, reader.ErrHashMismatch)
+			} else if usable(p, offset, len(body)) {
+				s.runs = append(s.runs, run{
+					start:   offset/format.BLOCK_SIZE - p.Before,
+					blocks:  int(p.Blocks),
+					stripes: int(p.Stripes),
+					shards:  int(p.Shards),
+					parity:  body,
+				})
+			}
+			continue
+		}
+
+		if _, err := r.Validate(); err != nil {
+			s.add(offset, end, err)
+		}
+	}
+	if long != nil {
+		s.add(long.offset, uint64(size), io.ErrUnexpectedEOF)
+	}
+	return s, nil
+}
+
+// overlong is a record whose body runs past the end of the archive.
+type overlong struct {
+	preamble *format.Preamble
+	offset   uint64 // of the record
+	body     uint64 // where its body starts
+}
+
+// intactBody is whether the body of a record, taken to run from one offset to another,
+// matches its checksum.
+func intactBody(ra io.ReaderAt, preamble *format.Preamble, from uint64, to uint64) bool {
+	length := to - from
+	if preamble.Modulo != 0 {
+		if length < format.BLOCK_SIZE {
+			return false
+		}
+		length -= format.BLOCK_SIZE - uint64(preamble.Modulo)
+	}
+	hash, _ := blake2b.New512(nil)
+	if _, err := io.Copy(hash, io.NewSectionReader(ra, int64(from), int64(length))); err != nil {
+		return false
+	}
+	return bytes.Equal(hash.Sum(nil), preamble.DataChecksum[:])
+}
+
+// usable is whether a parity record, found at the given offset with a body of the given
+// length, is one that can be used.
+func usable(p *format.Parity, offset uint64, length int) bool {
+	if p.Algorithm != format.PARITY_REED_SOLOMON || p.Shards < 1 || p.Shards > parity.MaxShards || p.Stripes < 1 {
+		return false
+	}
+	if p.Blocks > uint64(p.Stripes)*uint64(256-int(p.Shards)) || p.Before < p.Blocks || p.Before > offset/format.BLOCK_SIZE {
+		return false
+	}
+	return uint64(length) == uint64(p.Stripes)*uint64(p.Shards)*format.BLOCK_SIZE
+}
+
+// rebuild rebuilds what it can of a run of blocks, returning how many blocks it rebuilt.
+func rebuild(archive *patched, size int64, run run, suspect map[uint64]bool) int {
+	if (run.start+uint64(run.blocks))*format.BLOCK_SIZE > uint64(size) {
+		return 0
+	}
+
+	blocks := make([][]byte, run.blocks)
+	for n := range blocks {
+		blocks[n] = make([]byte, format.BLOCK_SIZE)
+		if _, err := archive.ReadAt(blocks[n], int64((run.start+uint64(n))*format.BLOCK_SIZE)); err != nil {
+			return 0
+		}
+	}
+
+	rebuilt := 0
+	for stripe := 0; stripe < run.stripes; stripe++ {
+		data := [][]byte{}
+		suspects := []int{}
+		for n := stripe; n < run.blocks; n += run.stripes {
+			if suspect[run.start+uint64(n)] {
+				suspects = append(suspects, len(data))
+			}
+			data = append(data, blocks[n])
+		}
+		shards := make([][]byte, run.shards)
+		for j := range shards {
+			start := (stripe*run.shards + j) * int(format.BLOCK_SIZE)
+			shards[j] = run.parity[start : start+int(format.BLOCK_SIZE)]
+		}
+
+		changed, err := parity.Correct(data, shards, suspects)
+		if err != nil {
+			continue
+		}
+		for _, i := range changed {
+			block := run.start + uint64(stripe+i*run.stripes)
+			archive.blocks[block*format.BLOCK_SIZE] = data[i]
+			rebuilt++
+		}
+	}
+	return rebuilt
+}
+
+// patched is an archive with rebuilt blocks in place of what was there.
+type patched struct {
+	ra     io.ReaderAt
+	blocks map[uint64][]byte
+}
+
+func (p *patched) ReadAt(b []byte, off int64) (int, error) {
+	n, err := p.ra.ReadAt(b, off)
+	for block := uint64(off) / format.BLOCK_SIZE * format.BLOCK_SIZE; block < uint64(off)+uint64(n); block += format.BLOCK_SIZE {
+		data, ok := p.blocks[block]
+		if !ok {
+			continue
+		}
+		if block < uint64(off) {
+			copy(b[:n], data[uint64(off)-block:])
+		} else {
+			copy(b[block-uint64(off):n], data)
+		}
+	}
+	return n, err
+}
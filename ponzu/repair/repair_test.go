@@ -0,0 +1,104 @@
+package repair_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/indrora/ponzu/ponzu/reader"
+	"github.com/indrora/ponzu/ponzu/repair"
+	"github.com/indrora/ponzu/ponzu/writer"
+)
+
+func TestRepair(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	block := int(format.BLOCK_SIZE)
+
+	buff := new(bytes.Buffer)
+	w := writer.NewWriter(buff, 256*format.BLOCK_SIZE)
+	w.Parity = 64
+	w.AppendStart("", "")
+	for i := 0; i < 20; i++ {
+		data := make([]byte, random.Intn(20*block))
+		random.Read(data)
+		w.AppendBytes(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.File{Name: string(rune('a' + i))}, data)
+	}
+	if err := w.AppendEnd(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	archive := buff.Bytes()
+
+	// Where the records are, and which are parity
+	records, parity := []int{}, []int{}
+	r := reader.NewReader(bytes.NewReader(archive))
+	for {
+		preamble, _, err := r.Next()
+		if err != nil {
+			break
+		}
+		records = append(records, int(r.Offset()))
+		if preamble.Rtype == format.RECORD_TYPE_PARITY {
+			parity = append(parity, int(r.Offset()))
+		}
+	}
+	if len(parity) < 3 {
+		t.Fatalf("expected parity records every 64 blocks of %d, found %d", len(archive)/block, len(parity))
+	}
+	if report := reader.NewReader(bytes.NewReader(archive)).Verify(); !report.Ok {
+		t.Fatalf("expected the archive to verify, got %+v", report)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		damage func([]byte)
+		found  int
+	}{
+		{"clean", func([]byte) {}, 0},
+		{"body", func(d []byte) { d[records[3]+block+100] ^= 1 }, 1},
+		{"header", func(d []byte) { copy(d[records[5]:records[5]+block], make([]byte, block)) }, 1},
+		{"unchecked preamble", func(d []byte) { d[records[6]+8] ^= 1 }, 0},
+		// Bit 32 of the DataLen, after the magic, type, compression and flags
+		{"data length", func(d []byte) { d[records[4]+13] ^= 1 }, 1},
+		{"run of blocks", func(d []byte) { random.Read(d[8*block : 11*block]) }, 1},
+		{"parity and what it covers", func(d []byte) {
+			d[parity[0]+block+7] ^= 0xff
+			d[parity[0]-10*block] ^= 0xff
+		}, 2},
+	} {
+		damaged := bytes.Clone(archive)
+		tc.damage(damaged)
+
+		result, err := repair.Repair(bytes.NewReader(damaged), int64(len(damaged)))
+		if err != nil {
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+		if len(result.Found) < tc.found || (tc.found == 0) != (len(result.Found) == 0) {
+			t.Errorf("%v: expected %d stretches of damage, found %+v", tc.name, tc.found, result.Found)
+		}
+		if len(result.Damaged) != 0 {
+			t.Errorf("%v: still damaged: %+v", tc.name, result.Damaged)
+		}
+		for offset, data := range result.Blocks {
+			copy(damaged[offset:], data)
+		}
+		if !bytes.Equal(damaged, archive) {
+			t.Errorf("%v: archive not repaired", tc.name)
+		}
+	}
+
+	// Damage to more blocks in a row than parity can cover is left as it is.
+	damaged := bytes.Clone(archive)
+	for offset := records[2]; offset < records[2]+70*block; offset += block {
+		binary.BigEndian.PutUint64(damaged[offset+block/2:], random.Uint64())
+	}
+	result, err := repair.Repair(bytes.NewReader(damaged), int64(len(damaged)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Damaged) == 0 {
+		t.Error("expected damage that can't be repaired")
+	}
+}
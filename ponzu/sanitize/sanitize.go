@@ -0,0 +1,182 @@
+/*
+The sanitize package resolves names found in an archive to paths on disk, enforcing
+the rules the spec sets out for paths: names and the archive prefix must be
+forward-relative, a leading slash is stripped from the prefix, and links may not point
+outside of the extraction root.
+
+All of these checks can be turned off by trusting the archive, which the spec allows
+but requires to be off by default.
+*/
+package sanitize
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrUnsafePath   = errors.New("path is not forward-relative")
+	ErrUnsafeLink   = errors.New("link target escapes the extraction root")
+	ErrLinkTraverse = errors.New("path traverses a symbolic link")
+)
+
+// Sanitizer maps names within an archive to paths beneath an extraction root.
+type Sanitizer struct {
+	root   string
+	prefix string
+	trust  bool
+}
+
+// New makes a Sanitizer that places files in prefix beneath root.
+//
+// Unless trust is set, a leading slash is removed from the prefix and the result must
+// be forward-relative. When trust is set, the prefix and every name are used as-is.
+func New(root string, prefix string, trust bool) (*Sanitizer, error) {
+	if !trust {
+		var err error
+		if prefix, err = CleanPrefix(prefix); err != nil {
+			return nil, err
+		}
+	}
+	return &Sanitizer{
+		root:   root,
+		prefix: prefix,
+		trust:  trust,
+	}, nil
+}
+
+// Prefix is the prefix that files are written under, after any rewriting.
+func (s *Sanitizer) Prefix() string {
+	return s.prefix
+}
+
+// Resolve returns the location on disk for a name in the archive.
+// This is used both for the names of records and for the targets of hardlinks,
+// which must also refer to something within the archive.
+func (s *Sanitizer) Resolve(name string) (string, error) {
+	if s.trust {
+		return filepath.Join(s.root, filepath.FromSlash(s.prefix), filepath.FromSlash(name)), nil
+	}
+
+	if !IsForwardRelative(name) {
+		return "", fmt.Errorf("%w: %q", ErrUnsafePath, name)
+	}
+
+	rel := path.Join(s.prefix, name)
+	if err := s.checkParents(rel); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, filepath.FromSlash(rel)), nil
+}
+
+// ResolveSymlink returns the location on disk for a symbolic link, making sure that
+// its target does not lead outside of the extraction root.
+func (s *Sanitizer) ResolveSymlink(name string, target string) (string, error) {
+	dest, err := s.Resolve(name)
+	if err != nil || s.trust {
+		return dest, err
+	}
+
+	if target == "" || path.IsAbs(target) || filepath.IsAbs(filepath.FromSlash(target)) {
+		return "", fmt.Errorf("%w: %q -> %q", ErrUnsafeLink, name, target)
+	}
+	// The target is relative to the directory the link lives in.
+	if !IsForwardRelative(path.Join(s.prefix, path.Dir(name)) + "/" + target) {
+		return "", fmt.Errorf("%w: %q -> %q", ErrUnsafeLink, name, target)
+	}
+	// That only holds if every ".." climbs out of a real directory. The ones leading the
+	// target climb out of the directories the link lives in, but one that comes after a
+	// name could be climbing out of a symbolic link, which goes somewhere else entirely:
+	// with y -> ".", "y/.." is the parent of the root. Whether y is a link may not be
+	// known until later in the archive, so these are refused whatever is on disk.
+	if climbsAfterName(target) {
+		return "", fmt.Errorf("%w: %q -> %q", ErrUnsafeLink, name, target)
+	}
+	return dest, nil
+}
+
+// climbsAfterName reports whether a ".." comes after a name in p, as in "a/../b".
+func climbsAfterName(p string) bool {
+	named := false
+	for _, part := range splitPath(p) {
+		switch part {
+		case ".":
+		case "..":
+			if named {
+				return true
+			}
+		default:
+			named = true
+		}
+	}
+	return false
+}
+
+// checkParents makes sure that none of the directories leading up to rel (relative to
+// the root) are symbolic links. Links are checked lexically when they are created, but
+// once one is on disk a later record could use it to walk somewhere else.
+func (s *Sanitizer) checkParents(rel string) error {
+	current := s.root
+	parts := splitPath(rel)
+	for i := 0; i < len(parts)-1; i++ {
+		current = filepath.Join(current, parts[i])
+		info, err := os.Lstat(current)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Nothing past here exists yet, so there is nothing to follow.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("%w: %q", ErrLinkTraverse, rel)
+		}
+	}
+	return nil
+}
+
+// CleanPrefix strips any leading slashes from an archive prefix and makes sure what is
+// left is forward-relative.
+func CleanPrefix(prefix string) (string, error) {
+	prefix = strings.TrimLeft(prefix, "/")
+	if !IsForwardRelative(prefix) {
+		return "", fmt.Errorf("%w: prefix %q", ErrUnsafePath, prefix)
+	}
+	return prefix, nil
+}
+
+// IsForwardRelative reports whether p only ever refers to something beneath where it
+// starts. Parent references are allowed as long as they never climb above the start,
+// so "pools/../cheeses" is fine but "kittens/../../dogs" is not.
+func IsForwardRelative(p string) bool {
+	if strings.ContainsRune(p, 0) || strings.HasPrefix(p, "/") || filepath.VolumeName(filepath.FromSlash(p)) != "" {
+		return false
+	}
+	depth := 0
+	for _, part := range splitPath(p) {
+		switch part {
+		case ".":
+		case "..":
+			depth--
+			if depth < 0 {
+				return false
+			}
+		default:
+			depth++
+		}
+	}
+	return true
+}
+
+// splitPath splits a slash separated path into its parts, dropping empty ones.
+// Where the OS uses a different separator it is split on as well, so that it cannot
+// be smuggled inside of a single part.
+func splitPath(p string) []string {
+	return strings.FieldsFunc(p, func(r rune) bool {
+		return r == '/' || r == filepath.Separator
+	})
+}
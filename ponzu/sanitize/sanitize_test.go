@@ -0,0 +1,103 @@
+package sanitize
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsForwardRelative(t *testing.T) {
+	testCases := []struct {
+		path string
+		ok   bool
+	}{
+		{"coconuts/bunches/lovely.jpg", true},
+		{"pools/../cheeses/Wensleydale.tiff", true},
+		{"heads/talking/", true},
+		{"", true},
+		{"kittens/../../dogs/puppies/newfoundland.jpg", false},
+		{"./../bob/", false},
+		{"../x", false},
+		{"/etc/passwd", false},
+		{"a/\x00/b", false},
+	}
+
+	for _, tc := range testCases {
+		if IsForwardRelative(tc.path) != tc.ok {
+			t.Errorf("IsForwardRelative(%q) should be %v", tc.path, tc.ok)
+		}
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	s, err := New("root", "/opt/thing", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Prefix() != "opt/thing" {
+		t.Errorf("expected leading slash to be stripped, got %q", s.Prefix())
+	}
+
+	if _, err = New("root", "../escape", false); !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("expected an unsafe prefix to be rejected, got %v", err)
+	}
+
+	s, err = New("", "/opt/thing", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := s.Resolve("x"); p != filepath.FromSlash("/opt/thing/x") {
+		t.Errorf("expected a trusted prefix to be kept, got %q", p)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	root := t.TempDir()
+	s, err := New(root, "pfx", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := s.Resolve("a/../b/c.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != filepath.Join(root, "pfx", "b", "c.txt") {
+		t.Errorf("unexpected path %q", p)
+	}
+
+	if _, err = s.Resolve("../../etc/x"); !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("expected traversal to be rejected, got %v", err)
+	}
+
+	if _, err = s.ResolveSymlink("a/link", "../b/c.txt"); err != nil {
+		t.Errorf("expected a link within the root to be fine, got %v", err)
+	}
+	if _, err = s.ResolveSymlink("a/link", "/etc/passwd"); !errors.Is(err, ErrUnsafeLink) {
+		t.Errorf("expected an absolute link to be rejected, got %v", err)
+	}
+	if _, err = s.ResolveSymlink("a/link", "../../../etc/passwd"); !errors.Is(err, ErrUnsafeLink) {
+		t.Errorf("expected an escaping link to be rejected, got %v", err)
+	}
+	// With y -> ".", x -> "y/.." is the parent of the root, whichever of them is made first.
+	if _, err = s.ResolveSymlink("y", "."); err != nil {
+		t.Errorf("expected a link to its own directory to be fine, got %v", err)
+	}
+	if _, err = s.ResolveSymlink("x", "y/.."); !errors.Is(err, ErrUnsafeLink) {
+		t.Errorf("expected a link climbing out of a name to be rejected, got %v", err)
+	}
+
+	// A link that already exists on disk cannot be used to get somewhere else.
+	os.MkdirAll(filepath.Join(root, "pfx"), 0755)
+	if err = os.Symlink("..", filepath.Join(root, "pfx", "up")); err != nil {
+		t.Skip("can't make symlinks here:", err)
+	}
+	if _, err = s.Resolve("up/x"); !errors.Is(err, ErrLinkTraverse) {
+		t.Errorf("expected a path through a symlink to be rejected, got %v", err)
+	}
+	os.Symlink(".", filepath.Join(root, "pfx", "y"))
+	if _, err = s.ResolveSymlink("x", "y/.."); !errors.Is(err, ErrUnsafeLink) {
+		t.Errorf("expected a link climbing out of a link on disk to be rejected, got %v", err)
+	}
+}
@@ -1,48 +1,40 @@
 package writer
 
 import (
-	"bytes"
-	"io"
+	"sync"
 
-	"github.com/andybalholm/brotli"
-	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/indrora/ponzu/ponzu/compression"
 	"github.com/klauspost/compress/zstd"
-	"github.com/pkg/errors"
 )
 
-func (archive *ArchiveWriter) getCompressedChunk(data []byte, compressor format.CompressionType) ([]byte, error) {
+// CompressionOptions tune how bodies are compressed.
+type CompressionOptions = compression.Options
 
-	switch compressor {
-	case format.COMPRESSION_NONE:
-		return data, nil
-	case format.COMPRESSION_BROTLI:
-		buf := new(bytes.Buffer)
-		comp := brotli.NewWriter(buf)
-		_, err := comp.Write(data)
-		if err != nil {
-			return nil, err
-		}
-		comp.Close()
-		return buf.Bytes(), nil
-	case format.COMPRESSION_ZSTD:
-		buf := new(bytes.Buffer)
-
-		var zs io.WriteCloser
-		var err error
-		if archive.zstdDict == nil {
-			zs, err = zstd.NewWriter(buf)
-		} else {
-			zs, err = zstd.NewWriter(buf, zstd.WithEncoderDict(archive.zstdDict))
-		}
-		if err != nil {
-			return nil, err
-		}
-		zs.Write(data)
+const (
+	// sampleSize is how much of an entry is tried out to see if it compresses.
+	sampleSize = 64 * 1024
+	// incompressibleRatio is the most a sample can compress to and still not be worth
+	// compressing.
+	incompressibleRatio = 0.9
+)
 
-		zs.Close()
+var (
+	samplerOnce sync.Once
+	sampler     *zstd.Encoder
+)
 
-		return buf.Bytes(), nil
-	default:
-		return nil, errors.New("unkonwn compressor")
+// sampleRatio compresses the start of some data as quickly as possible, returning how
+// big it came out compared to how big it was.
+func sampleRatio(data []byte) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	if len(data) > sampleSize {
+		data = data[:sampleSize]
 	}
+	samplerOnce.Do(func() {
+		sampler, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	})
+	compressed := sampler.EncodeAll(data, make([]byte, 0, len(data)))
+	return float64(len(compressed)) / float64(len(data))
 }
@@ -0,0 +1,136 @@
+package writer
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/indrora/ponzu/ponzu/compression"
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/indrora/ponzu/ponzu/reader"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompressionOptions(t *testing.T) {
+	data := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog ", 2000))
+
+	testCases := []struct {
+		compression format.CompressionType
+		options     CompressionOptions
+	}{
+		{format.COMPRESSION_ZSTD, CompressionOptions{}},
+		{format.COMPRESSION_ZSTD, CompressionOptions{Level: 1}},
+		{format.COMPRESSION_ZSTD, CompressionOptions{Level: 19, Long: true}},
+		{format.COMPRESSION_BROTLI, CompressionOptions{}},
+		{format.COMPRESSION_BROTLI, CompressionOptions{Level: 11, Window: 24}},
+	}
+
+	for _, tc := range testCases {
+		compressed, err := compression.Compress(data, tc.compression, tc.options, nil)
+		if err != nil {
+			t.Fatalf("%v %+v: %v", tc.compression, tc.options, err)
+		}
+
+		var decompressor io.Reader
+		if tc.compression == format.COMPRESSION_ZSTD {
+			decoder, err := zstd.NewReader(bytes.NewReader(compressed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer decoder.Close()
+			decompressor = decoder
+		} else {
+			decompressor = brotli.NewReader(bytes.NewReader(compressed))
+		}
+
+		out, err := io.ReadAll(decompressor)
+		if err != nil {
+			t.Errorf("%v %+v: failed to decompress: %v", tc.compression, tc.options, err)
+		} else if !bytes.Equal(out, data) {
+			t.Errorf("%v %+v: round trip failed", tc.compression, tc.options)
+		}
+	}
+
+	// The options make it through to records appended while they are set.
+	buff := new(bytes.Buffer)
+	w := NewWriter(buff, 0)
+	w.CompressionOptions = CompressionOptions{Level: 19}
+	w.AppendBytes(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_ZSTD, format.File{Name: "fox"}, data)
+	w.Close()
+
+	expected, _ := compression.Compress(data, format.COMPRESSION_ZSTD, CompressionOptions{Level: 19}, nil)
+	if !bytes.Contains(buff.Bytes(), expected) {
+		t.Error("expected the body to be compressed at level 19")
+	}
+}
+
+func TestSkipIncompressible(t *testing.T) {
+	random := make([]byte, 3*format.BLOCK_SIZE)
+	rand.Read(random)
+	text := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog ", 2000))
+
+	for _, skip := range []bool{false, true} {
+		buff := new(bytes.Buffer)
+		// chunks of a single block can't get any smaller, so make them bigger.
+		w := NewWriter(buff, 16*format.BLOCK_SIZE)
+		w.SkipIncompressible = skip
+		reported := make([]string, 0)
+		w.Uncompressed = func(name string, reason string) {
+			reported = append(reported, name)
+		}
+
+		w.AppendStart("", "")
+		// sampled: the whole entry is stored as it is.
+		w.AppendStream(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_ZSTD, format.File{Name: "random"}, bytes.NewReader(random))
+		w.AppendStream(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_ZSTD, format.File{Name: "text"}, bytes.NewReader(text))
+		// not sampled, but still no smaller.
+		w.AppendBytes(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_BROTLI, format.File{Name: "bytes"}, random)
+		w.AppendEnd()
+		w.Close()
+
+		compressions := make(map[string][]format.CompressionType)
+		r := reader.NewReader(buff)
+		name := ""
+		err := r.Walk(func(preamble *format.Preamble, meta any) error {
+			if file, ok := meta.(*format.File); ok {
+				name = file.Name
+			}
+			if preamble.DataLen > 0 {
+				compressions[name] = append(compressions[name], preamble.Compression)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := format.COMPRESSION_ZSTD
+		if skip {
+			expected = format.COMPRESSION_NONE
+		}
+		for _, c := range compressions["random"] {
+			if c != expected {
+				t.Errorf("skip %v: random data stored with compression %v", skip, c)
+			}
+		}
+		for _, c := range compressions["text"] {
+			if c != format.COMPRESSION_ZSTD {
+				t.Errorf("skip %v: text stored with compression %v", skip, c)
+			}
+		}
+		if skip && compressions["bytes"][0] != format.COMPRESSION_NONE {
+			t.Errorf("expected random bytes to be stored uncompressed")
+		}
+
+		// The sampled entry is reported once; the record on its own once too.
+		if skip && !reflect.DeepEqual(reported, []string{"random", "bytes"}) {
+			t.Errorf("reported %v", reported)
+		} else if !skip && len(reported) != 0 {
+			t.Errorf("reported %v without SkipIncompressible", reported)
+		}
+	}
+}
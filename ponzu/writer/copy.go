@@ -0,0 +1,60 @@
+package writer
+
+import (
+	"io"
+
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/pkg/errors"
+)
+
+// CopyRecord appends a record from another archive as it is stored there, as given by
+// Reader.NextRaw, RawMetadata and RawBody: the preamble, metadata and body go in as
+// they are, without being compressed, encrypted or checked. recordInfo is the decoded
+// metadata of the record, if it could be read, to list it in the index by.
+//
+// A start of archive record starts a new archive, as AppendStart does, and the body
+// of a zstd dictionary is not used for anything appended after it.
+func (archive *ArchiveWriter) CopyRecord(preamble *format.Preamble, metadata []byte, recordInfo any, body io.Reader) error {
+	if err := archive.ready(); err != nil {
+		return err
+	}
+	if err := archive.flush(); err != nil {
+		return err
+	}
+	if preamble.IsStartOfArchive() {
+		if err := archive.startArchive(); err != nil {
+			return err
+		}
+	}
+
+	rec := &record{rtype: preamble.Rtype, metadata: metadata}
+	if name, ok := format.RecordName(recordInfo); ok && rec.rtype != format.RECORD_TYPE_CONTINUE {
+		rec.name, rec.named = name, true
+	}
+	if rec.rtype == format.RECORD_TYPE_ZDICTIONARY {
+		archive.dictionaries = append(archive.dictionaries, archive.currentBlock())
+	}
+
+	archive.addToChain(preamble)
+	if err := archive.writeHeader(rec, preamble); err != nil {
+		return err
+	}
+	if preamble.DataLen == 0 {
+		return archive.writeParity()
+	}
+
+	length := int64(preamble.DataLen * format.BLOCK_SIZE)
+	if preamble.Modulo != 0 {
+		length -= int64(format.BLOCK_SIZE - uint64(preamble.Modulo))
+	}
+	n, err := io.Copy(&archive.blockio, io.LimitReader(body, length))
+	if err != nil {
+		return errors.Wrap(err, "Failed to write block")
+	} else if n != length {
+		return errors.Wrapf(ErrMisalignedWrite, "expected a body of %d bytes, got %d", length, n)
+	}
+	if err := archive.blockio.Align(); err != nil {
+		return err
+	}
+	return archive.writeParity()
+}
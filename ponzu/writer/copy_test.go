@@ -0,0 +1,82 @@
+package writer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/indrora/ponzu/ponzu/reader"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestCopyRecord(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog "), 1000)
+
+	buff := new(bytes.Buffer)
+	w := NewWriter(buff, 4*format.BLOCK_SIZE)
+	w.WriteIndex = true
+	w.SignKey = key
+	w.AppendStart("", "")
+	w.AppendZstdDict(text[:1000])
+	w.AppendBytes(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_ZSTD, format.File{Name: "short"}, text[:100])
+	w.AppendStream(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.File{Name: "long"}, bytes.NewReader(text))
+	w.AppendBytes(format.RECORD_TYPE_DIRECTORY, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.Directory{File: format.File{Name: "dir"}}, nil)
+	if err := w.AppendEnd(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	archive := buff.Bytes()
+
+	// Copying every record as it is makes the same archive again.
+	r := reader.NewReaderAt(bytes.NewReader(archive), int64(len(archive)))
+	out := new(bytes.Buffer)
+	c := NewWriter(out, 0)
+	for {
+		preamble, meta, err := r.NextRaw()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if err = c.CopyRecord(preamble, r.RawMetadata(), meta, r.RawBody()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Close()
+	if !bytes.Equal(out.Bytes(), archive) {
+		t.Fatalf("copy differs from the original, %d bytes against %d", out.Len(), len(archive))
+	}
+
+	// Copying the records but for the index, signature and end, and ending the archive
+	// again, rebuilds those to match.
+	r = reader.NewReaderAt(bytes.NewReader(archive), int64(len(archive)))
+	out.Reset()
+	c = NewWriter(out, 0)
+	c.WriteIndex = true
+	c.SignKey = key
+	for {
+		preamble, meta, err := r.NextRaw()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if preamble.Rtype == format.RECORD_TYPE_INDEX || preamble.Rtype == format.RECORD_TYPE_SIGNATURE || preamble.IsEndOfArchive() {
+			continue
+		}
+		if err = c.CopyRecord(preamble, r.RawMetadata(), meta, r.RawBody()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.AppendEnd(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if !bytes.Equal(out.Bytes(), archive) {
+		t.Errorf("rebuilt archive differs from the original, %d bytes against %d", out.Len(), len(archive))
+	}
+}
@@ -0,0 +1,15 @@
+package writer
+
+import (
+	"github.com/klauspost/compress/dict"
+)
+
+// TrainZstdDict builds a zstd dictionary of up to size bytes from samples of the sort of
+// data it is to compress, ready for AppendZstdDict. Many small samples train better
+// than a few big ones.
+func TrainZstdDict(samples [][]byte, size int) ([]byte, error) {
+	return dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: size,
+		HashBytes:   6,
+	})
+}
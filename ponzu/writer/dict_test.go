@@ -0,0 +1,71 @@
+package writer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/indrora/ponzu/ponzu/reader"
+)
+
+func TestTrainZstdDict(t *testing.T) {
+	samples := make([][]byte, 0)
+	for i := 0; i < 500; i++ {
+		samples = append(samples, []byte(fmt.Sprintf(`{"id": %d, "name": "user%d", "email": "user%d@example.com", "roles": ["viewer"], "theme": "dark"}`, i, i*7, i*13)))
+	}
+
+	dict, err := TrainZstdDict(samples, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Make some files big enough to be compressed out of the samples.
+	files := make([][]byte, 0)
+	for i := 0; i < 10; i++ {
+		files = append(files, bytes.Join(samples[i*50:(i+1)*50], []byte("\n")))
+	}
+
+	buff := new(bytes.Buffer)
+	buildArchive(t, buff, 64, nil, func(w *ArchiveWriter) error {
+		if err := w.AppendZstdDict(dict); err != nil {
+			return err
+		}
+		for i, data := range files {
+			if err := w.AppendBytes(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_ZSTD, format.File{Name: fmt.Sprint(i)}, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	archive := buff.Bytes()
+	for _, readAhead := range []int{0, 4} {
+		r := reader.NewReaderAt(bytes.NewReader(archive), int64(len(archive)))
+		r.ReadAhead = readAhead
+		for i := 0; ; i++ {
+			_, meta, err := r.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := meta.(*format.File); !ok {
+				continue
+			}
+			if !bytes.Equal(r.ZstdDict(), dict) {
+				t.Fatal("expected the reader to pick up the dictionary")
+			}
+			out, err := io.ReadAll(r.Body())
+			if err != nil {
+				t.Fatalf("read ahead %d: %v", readAhead, err)
+			}
+			if !bytes.Equal(out, files[i-1]) {
+				t.Errorf("read ahead %d: file %d did not round trip", readAhead, i-1)
+			}
+		}
+		r.Close()
+	}
+}
@@ -0,0 +1,361 @@
+package writer
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/indrora/ponzu/ponzu/compression"
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2b"
+)
+
+// directWriter writes the body of a record straight into the archive as it arrives,
+// compressing it on the way, and goes back to fill in the preamble once the body is
+// done. Like entryWriter, it splits the body over continuation records of (at most)
+// half of MaxReadBuffer each; whether a record continues is settled when the next
+// write (or Close) comes along, by patching its preamble again.
+type directWriter struct {
+	archive     *ArchiveWriter
+	rtype       format.RecordType
+	flags       format.RecordFlags
+	compression format.CompressionType
+	options     CompressionOptions
+	skip        bool
+	recordInfo  any
+	size        int64 // of the body that goes in each record
+
+	sample  []byte // the start of the body, until there is enough to try compressing
+	decided bool   // whether the sample has been tried and written out
+	skipped string
+
+	current *directRecord // being written
+	last    *directRecord // finished, waiting to find out whether it is the last
+	started bool          // whether the first record of the chain has been written
+	err     error
+}
+
+// directRecord is a record being written by a directWriter.
+type directRecord struct {
+	archive *ArchiveWriter
+	rec     *record
+	header  uint64 // where the preamble is
+	out     *hashWriter
+	sealer  io.WriteCloser // if the record is encrypted
+	encoder io.WriteCloser
+	taken   int64 // of the body, before it was compressed
+}
+
+// hashWriter passes writes on, keeping count of them and a checksum.
+type hashWriter struct {
+	w    io.Writer
+	hash hash.Hash
+	n    uint64
+}
+
+func (h *hashWriter) Write(p []byte) (int, error) {
+	n, err := h.w.Write(p)
+	h.hash.Write(p[:n])
+	h.n += uint64(n)
+	return n, err
+}
+
+func (archive *ArchiveWriter) newDirectWriter(rtype format.RecordType, flags format.RecordFlags, compression format.CompressionType, recordInfo any) *directWriter {
+	size := archive.MaxReadBuffer / 2
+	if size == 0 {
+		size = format.BLOCK_SIZE
+	}
+	return &directWriter{
+		archive:     archive,
+		rtype:       rtype,
+		flags:       flags,
+		compression: compression,
+		options:     archive.CompressionOptions,
+		skip:        archive.SkipIncompressible,
+		recordInfo:  recordInfo,
+		size:        int64(size),
+	}
+}
+
+func (w *directWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	written := 0
+	if !w.decided {
+		n := sampleSize - len(w.sample)
+		if n > len(p) {
+			n = len(p)
+		}
+		w.sample = append(w.sample, p[:n]...)
+		written += n
+		p = p[n:]
+		if len(w.sample) < sampleSize {
+			return written, nil
+		}
+		if err := w.decide(); err != nil {
+			return written, w.fail(err)
+		}
+	}
+
+	n, err := w.write(p)
+	if err != nil {
+		return written + n, w.fail(err)
+	}
+	return written + n, nil
+}
+
+// decide works out whether the body is worth compressing from the start of it, then
+// writes the start out.
+func (w *directWriter) decide() error {
+	w.decided = true
+	if w.skip && w.compression != format.COMPRESSION_NONE {
+		if len(w.sample) == 0 {
+			// Nothing is saved compressing nothing.
+			w.compression = format.COMPRESSION_NONE
+		} else if ratio := sampleRatio(w.sample); ratio > incompressibleRatio {
+			w.compression = format.COMPRESSION_NONE
+			w.skipped = fmt.Sprintf("a sample compressed to %.0f%%, storing all of it uncompressed", ratio*100)
+		}
+	}
+
+	sample := w.sample
+	w.sample = nil
+	_, err := w.write(sample)
+	return err
+}
+
+// write writes part of the body into the archive, starting and finishing records as
+// it goes.
+func (w *directWriter) write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if w.current == nil {
+			// There is more to come, so the last record continues.
+			if w.last != nil {
+				if err := w.last.patch(true); err != nil {
+					return written, err
+				}
+				w.last = nil
+			}
+			if err := w.start(); err != nil {
+				return written, err
+			}
+		}
+
+		n := len(p)
+		if room := w.size - w.current.taken; int64(n) > room {
+			n = int(room)
+		}
+		if err := w.current.write(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+
+		if w.current.taken == w.size {
+			if err := w.current.end(); err != nil {
+				return written, err
+			}
+			w.last, w.current = w.current, nil
+		}
+	}
+	return written, nil
+}
+
+// start writes the header of the next record, with its body to be filled in.
+func (w *directWriter) start() error {
+	archive := w.archive
+	rtype, flags, recordInfo := format.RECORD_TYPE_CONTINUE, format.RECORD_FLAG_NONE, any(nil)
+	skipped := ""
+	if !w.started {
+		rtype, flags, recordInfo = w.rtype, w.flags, w.recordInfo
+		skipped = w.skipped
+		w.started = true
+	}
+
+	name, _ := format.RecordName(w.recordInfo)
+	rec := &record{
+		rtype:       rtype,
+		flags:       flags,
+		compression: w.compression,
+		options:     w.options,
+		entry:       name,
+		skipped:     skipped,
+	}
+	if err := archive.prepare(rec, recordInfo); err != nil {
+		return err
+	}
+	archive.reportSkipped(rec)
+	if err := rec.sealMetadata(); err != nil {
+		return err
+	}
+
+	hash, _ := blake2b.New512(nil)
+	d := &directRecord{
+		archive: archive,
+		rec:     rec,
+		header:  archive.blockio.Offset(),
+		out:     &hashWriter{w: &archive.blockio, hash: hash},
+	}
+	if err := archive.writeHeader(rec, rec.preamble(0, make([]byte, blake2b.Size))); err != nil {
+		return err
+	}
+	var sink io.Writer = d.out
+	if rec.key != nil {
+		d.sealer = rec.key.NewWriter(d.out, rec.id, rec.rtype, rec.compression)
+		sink = d.sealer
+	}
+	if rec.compression != format.COMPRESSION_NONE {
+		encoder, err := compression.NewWriter(sink, rec.compression, rec.options, rec.dict)
+		if err != nil {
+			return err
+		}
+		d.encoder = encoder
+	}
+	w.current = d
+	return nil
+}
+
+// Close writes out whatever is left of the body, finishing the record.
+func (w *directWriter) Close() error {
+	if w.archive.entry == w {
+		w.archive.entry = nil
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.finish(); err != nil {
+		return w.fail(err)
+	}
+	w.err = ErrEntryClosed
+	return nil
+}
+
+// finish writes out the rest of the body and patches the last preamble.
+func (w *directWriter) finish() error {
+	if !w.decided {
+		if err := w.decide(); err != nil {
+			return err
+		}
+	}
+	if w.current == nil && w.last == nil {
+		// The body is empty, but the record still has to be written.
+		if err := w.start(); err != nil {
+			return err
+		}
+	}
+	if w.current != nil {
+		if err := w.current.end(); err != nil {
+			return err
+		}
+		w.last, w.current = w.current, nil
+	}
+	if err := w.last.patch(false); err != nil {
+		return err
+	}
+	w.last = nil
+	return nil
+}
+
+func (w *directWriter) abort(err error) {
+	w.fail(err)
+}
+
+// fail gives up on the body after an error. The archive is truncated back to the start
+// of the first record whose preamble hasn't been filled in, so that whatever follows
+// lines up; any records before it are left flagged as continuing, for readers to find
+// the chain incomplete. If the archive can't be truncated, nothing more can be appended.
+func (w *directWriter) fail(err error) error {
+	if w.archive.entry == w {
+		w.archive.entry = nil
+	}
+	w.err = err
+
+	d := w.last
+	if d == nil {
+		d = w.current
+	}
+	w.last, w.current = nil, nil
+	if d != nil {
+		if rerr := w.archive.rewind(d.header); rerr != nil {
+			w.archive.failed = errors.Wrap(err, "archive was left partway through a record")
+		}
+	}
+	return err
+}
+
+// rewind throws away everything written to the archive from offset on.
+func (archive *ArchiveWriter) rewind(offset uint64) error {
+	truncater, ok := archive.seeker.(interface{ Truncate(size int64) error })
+	if !ok {
+		return errors.New("archive can't be truncated")
+	}
+	if err := truncater.Truncate(archive.base + int64(offset)); err != nil {
+		return err
+	}
+	if _, err := archive.seeker.Seek(archive.base+int64(offset), io.SeekStart); err != nil {
+		return err
+	}
+	archive.blockio.Reset(offset)
+	for n := len(archive.index); n > 0 && archive.index[n-1].Block*format.BLOCK_SIZE >= offset; n-- {
+		archive.index = archive.index[:n-1]
+	}
+	return nil
+}
+
+func (d *directRecord) write(p []byte) error {
+	d.taken += int64(len(p))
+	var err error
+	if d.encoder != nil {
+		_, err = d.encoder.Write(p)
+	} else if d.sealer != nil {
+		_, err = d.sealer.Write(p)
+	} else {
+		_, err = d.out.Write(p)
+	}
+	return err
+}
+
+// end finishes the body.
+func (d *directRecord) end() error {
+	if d.encoder != nil {
+		if err := d.encoder.Close(); err != nil {
+			return err
+		}
+	}
+	if d.sealer != nil {
+		if err := d.sealer.Close(); err != nil {
+			return err
+		}
+	}
+	return d.archive.blockio.Align()
+}
+
+// patch fills in the preamble, now that the body is done, and goes back to the end of
+// the archive.
+func (d *directRecord) patch(continues bool) error {
+	archive := d.archive
+	if continues {
+		d.rec.flags |= format.RECORD_FLAG_CONTINUES
+	}
+
+	preamble := d.rec.preamble(d.out.n, d.out.hash.Sum(nil))
+	buff := new(bytes.Buffer)
+	preamble.WritePreamble(buff)
+
+	if _, err := archive.seeker.Seek(archive.base+int64(d.header), io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := archive.seeker.Write(buff.Bytes()); err != nil {
+		return err
+	}
+	if _, err := archive.seeker.Seek(archive.base+int64(archive.blockio.Offset()), io.SeekStart); err != nil {
+		return err
+	}
+	archive.addToChain(preamble)
+	return nil
+}
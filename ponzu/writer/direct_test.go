@@ -0,0 +1,213 @@
+package writer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/indrora/ponzu/ponzu/reader"
+)
+
+func TestBackpatch(t *testing.T) {
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog "), 1000)
+	random := make([]byte, 3*format.BLOCK_SIZE)
+	rand.Read(random)
+
+	testCases := []struct {
+		name        string
+		data        []byte
+		compression format.CompressionType
+	}{
+		{"empty", nil, format.COMPRESSION_ZSTD},
+		{"short", text[:100], format.COMPRESSION_ZSTD},
+		{"text", text, format.COMPRESSION_ZSTD},
+		{"brotli", text, format.COMPRESSION_BROTLI},
+		{"none", text, format.COMPRESSION_NONE},
+		{"random", random, format.COMPRESSION_ZSTD},
+		{"one chunk", text[:2*format.BLOCK_SIZE], format.COMPRESSION_NONE},
+	}
+
+	for _, tc := range testCases {
+		build := func(out io.Writer) *ArchiveWriter {
+			return buildArchive(t, out, 4, nil, func(w *ArchiveWriter) error {
+				if err := w.AppendStream(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, tc.compression, format.File{Name: tc.name}, bytes.NewReader(tc.data)); err != nil {
+					return fmt.Errorf("%v: %w", tc.name, err)
+				}
+				return w.AppendBytes(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, tc.compression, format.File{Name: "after"}, text[:100])
+			})
+		}
+
+		path := filepath.Join(t.TempDir(), "archive.pzarc")
+		fh, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Something before the archive, to be sure patches land in the right place
+		fh.Write([]byte("preface"))
+		if w := build(fh); !w.Backpatch {
+			t.Fatal("expected a file to be backpatched")
+		}
+		patched, _ := os.ReadFile(path)
+		patched = patched[len("preface"):]
+
+		// The same archive, from start to end, as it would be written to a pipe
+		spooled := new(bytes.Buffer)
+		if w := build(spooled); w.Backpatch {
+			t.Fatal("expected a buffer not to be backpatched")
+		}
+		if !bytes.Equal(patched, spooled.Bytes()) {
+			t.Errorf("%v: backpatched archive differs from the spooled one", tc.name)
+		}
+
+		r := reader.NewReader(bytes.NewReader(patched))
+		names := []string{}
+		for {
+			_, meta, err := r.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				t.Fatalf("%v: %v", tc.name, err)
+			}
+			file, ok := meta.(*format.File)
+			if !ok {
+				continue
+			}
+			names = append(names, file.Name)
+			out := new(bytes.Buffer)
+			if err = r.CopyAll(out, true); err != nil && err != io.EOF {
+				t.Fatalf("%v: %v", tc.name, err)
+			}
+			if file.Name == tc.name && !bytes.Equal(out.Bytes(), tc.data) {
+				t.Errorf("%v: round trip failed, got %d bytes", tc.name, out.Len())
+			}
+		}
+		if len(names) != 2 {
+			t.Errorf("%v: expected 2 files, got %v", tc.name, names)
+		}
+	}
+}
+
+func TestBackpatchPipe(t *testing.T) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.Close()
+	defer pw.Close()
+
+	if w := NewWriter(pw, 0); w.Backpatch {
+		t.Error("expected a pipe not to be backpatched")
+	}
+}
+
+// failingFile is a file that can be seeked in but not truncated, and fails writes once
+// there have been enough of them.
+type failingFile struct {
+	fh   *os.File
+	left int
+}
+
+func (f *failingFile) Write(p []byte) (int, error) {
+	if f.left -= len(p); f.left < 0 {
+		return 0, errors.New("disk full")
+	}
+	return f.fh.Write(p)
+}
+
+func (f *failingFile) Seek(offset int64, whence int) (int64, error) {
+	return f.fh.Seek(offset, whence)
+}
+
+func TestBackpatchFailure(t *testing.T) {
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog "), 1000)
+	errBroken := errors.New("broken")
+	open := func() *os.File {
+		fh, err := os.Create(filepath.Join(t.TempDir(), "archive.pzarc"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { fh.Close() })
+		return fh
+	}
+
+	// Nothing else goes into the archive while an entry is being written into it.
+	w := NewWriter(open(), 4*format.BLOCK_SIZE)
+	w.AppendStart("", "")
+	entry, _ := w.Create(format.File{Name: "open"})
+	others := map[string]func() error{
+		"AppendStart": func() error { return w.AppendStart("", "") },
+		"AppendBytes": func() error {
+			return w.AppendBytes(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.File{Name: "other"}, nil)
+		},
+		"AppendSignature": func() error { return w.AppendSignature(make([]byte, 64), []byte("digest")) },
+		"AppendEnd":       w.AppendEnd,
+	}
+	for name, appendOther := range others {
+		if err := appendOther(); err != ErrEntryOpen {
+			t.Errorf("expected %v to be refused while an entry is open, got %v", name, err)
+		}
+	}
+	entry.Close()
+
+	// A stream that fails is cut back out of the archive, as far as it has to be for
+	// the rest of the archive to line up.
+	fh := open()
+	w = NewWriter(fh, 4*format.BLOCK_SIZE)
+	w.Compression = format.COMPRESSION_NONE
+	w.AppendStart("", "")
+	// Past the sample taken for SkipIncompressible, so that some of it is written
+	stream := io.MultiReader(bytes.NewReader(bytes.Repeat(text, 2)[:sampleSize+20000]), iotest.ErrReader(errBroken))
+	if err := w.AppendStream(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.File{Name: "broken"}, stream); !errors.Is(err, errBroken) {
+		t.Errorf("expected the read error, got %v", err)
+	}
+	if err := w.AppendBytes(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.File{Name: "after"}, text[:100]); err != nil {
+		t.Fatal(err)
+	}
+	w.AppendEnd()
+	w.Close()
+
+	archive, _ := os.ReadFile(fh.Name())
+	r := reader.NewReader(bytes.NewReader(archive))
+	found := false
+	for {
+		_, meta, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if file, ok := meta.(*format.File); ok && file.Name == "after" {
+			found = true
+			out := new(bytes.Buffer)
+			if err = r.CopyAll(out, true); (err != nil && err != io.EOF) || !bytes.Equal(out.Bytes(), text[:100]) {
+				t.Errorf("expected the file after to come through, got %d bytes, %v", out.Len(), err)
+			}
+		}
+	}
+	if !found {
+		t.Error("expected to find the file after the one that failed")
+	}
+	if reader.NewReader(bytes.NewReader(archive)).Verify().Ok {
+		t.Error("expected the archive to fail verification")
+	}
+
+	// An archive that can't be truncated can't be added to once a record is left unfinished.
+	w = NewWriter(&failingFile{fh: open(), left: 3 * int(format.BLOCK_SIZE)}, 4*format.BLOCK_SIZE)
+	if !w.Backpatch {
+		t.Fatal("expected the file to be backpatched")
+	}
+	w.AppendStart("", "")
+	if err := w.AppendStream(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.File{Name: "big"}, bytes.NewReader(text)); err == nil {
+		t.Error("expected the write to fail")
+	}
+	if err := w.AppendEnd(); err == nil {
+		t.Error("expected the archive to be left alone once a record was left unfinished")
+	}
+}
@@ -0,0 +1,208 @@
+package writer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/indrora/ponzu/ponzu/format"
+)
+
+var (
+	ErrEntryOpen   = errors.New("another entry is still being written")
+	ErrEntryClosed = errors.New("entry has already been closed")
+)
+
+// entry is the body of a record being written, by an entryWriter or a directWriter.
+type entry interface {
+	io.WriteCloser
+	// abort gives up on the body partway through. Whatever has not been written out
+	// is thrown away, and nothing more is, so the chain ends on a record flagged as
+	// continuing and readers can tell that it is incomplete.
+	abort(err error)
+}
+
+// entryWriter writes the body of a record as it arrives, splitting it over
+// continuation records of (at most) half of MaxReadBuffer each. Each part of the body
+// is held in a spool until it is written out, so only SpoolSize of it need be in memory
+// however big the parts are.
+//
+// The last record of a chain must not be flagged as continuing, which can't be known
+// until the next write (or Close) comes along. Normally one full chunk is held back
+// until then. In a streamed archive, chunks are written as soon as they fill up
+// instead, and the chain is finished with a continuation holding whatever is left,
+// even if that is nothing at all.
+type entryWriter struct {
+	archive     *ArchiveWriter
+	rtype       format.RecordType
+	flags       format.RecordFlags
+	compression format.CompressionType
+	options     CompressionOptions
+	skip        bool
+	recordInfo  any
+
+	size    int64  // of each chunk
+	chunk   *spool // being filled
+	held    *spool // full, waiting to find out whether it is the last
+	started bool   // whether the first record of the chain has been written
+	err     error
+}
+
+// Create starts a file record, with the body written to it as it becomes available.
+// The body is compressed with the archive's Compression and split over continuation
+// records, so memory use is bounded by SpoolSize however much is written.
+//
+// Nothing else can be appended to the archive until the writer has been closed.
+func (archive *ArchiveWriter) Create(meta format.File) (io.WriteCloser, error) {
+	if err := archive.ready(); err != nil {
+		return nil, err
+	}
+	archive.entry = archive.newEntry(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, archive.Compression, meta)
+	return archive.entry, nil
+}
+
+// newEntry starts writing the body of a record, straight into the archive if it can be
+// backpatched.
+func (archive *ArchiveWriter) newEntry(rtype format.RecordType, flags format.RecordFlags, compression format.CompressionType, recordInfo any) entry {
+	if archive.Backpatch && archive.seeker != nil && archive.Jobs <= 1 && !archive.Streamed && archive.Parity <= 0 {
+		return archive.newDirectWriter(rtype, flags, compression, recordInfo)
+	}
+	return archive.newEntryWriter(rtype, flags, compression, recordInfo)
+}
+
+func (archive *ArchiveWriter) newEntryWriter(rtype format.RecordType, flags format.RecordFlags, compression format.CompressionType, recordInfo any) *entryWriter {
+	size := archive.MaxReadBuffer / 2
+	if size == 0 {
+		size = format.BLOCK_SIZE
+	}
+	return &entryWriter{
+		archive:     archive,
+		rtype:       rtype,
+		flags:       flags,
+		compression: compression,
+		options:     archive.CompressionOptions,
+		skip:        archive.SkipIncompressible,
+		recordInfo:  recordInfo,
+		size:        int64(size),
+		chunk:       archive.newSpool(),
+	}
+}
+
+func (w *entryWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if room := w.size - w.chunk.Len(); int64(n) > room {
+			n = int(room)
+		}
+		n, w.err = w.chunk.Write(p[:n])
+		written += n
+		p = p[n:]
+		if w.err == nil && w.chunk.Len() == w.size {
+			w.err = w.push()
+		}
+		if w.err != nil {
+			w.discard()
+			return written, w.err
+		}
+	}
+	return written, nil
+}
+
+// push deals with a chunk that has filled up.
+func (w *entryWriter) push() error {
+	chunk := w.chunk
+	w.chunk = w.archive.newSpool()
+	if w.archive.Streamed {
+		return w.emit(chunk, true)
+	}
+
+	held := w.held
+	w.held = chunk
+	if held != nil {
+		return w.emit(held, true)
+	}
+	return nil
+}
+
+// discard throws away the parts of the body that have not been written out.
+func (w *entryWriter) discard() {
+	for _, s := range []*spool{w.chunk, w.held} {
+		if s != nil {
+			s.Close()
+		}
+	}
+	w.chunk, w.held = nil, nil
+}
+
+func (w *entryWriter) abort(err error) {
+	if w.archive.entry == w {
+		w.archive.entry = nil
+	}
+	w.err = err
+	w.discard()
+}
+
+// emit writes a record holding the given part of the body, which it takes over.
+func (w *entryWriter) emit(body *spool, continues bool) error {
+	rtype, flags, recordInfo := format.RECORD_TYPE_CONTINUE, format.RECORD_FLAG_NONE, any(nil)
+	skipped := ""
+	if !w.started {
+		rtype, flags, recordInfo = w.rtype, w.flags, w.recordInfo
+		w.started = true
+		// The first chunk decides whether the rest is worth compressing.
+		if w.skip && w.compression != format.COMPRESSION_NONE {
+			sample := make([]byte, sampleSize)
+			n, _ := body.ReadAt(sample, 0)
+			if ratio := sampleRatio(sample[:n]); ratio > incompressibleRatio {
+				w.compression = format.COMPRESSION_NONE
+				skipped = fmt.Sprintf("a sample compressed to %.0f%%, storing all of it uncompressed", ratio*100)
+			}
+		}
+	}
+	if continues {
+		flags |= format.RECORD_FLAG_CONTINUES
+	}
+
+	name, _ := format.RecordName(w.recordInfo)
+	return w.archive.appendRecord(&record{
+		rtype:       rtype,
+		flags:       flags,
+		compression: w.compression,
+		options:     w.options,
+		body:        body,
+		entry:       name,
+		skip:        w.skip,
+		skipped:     skipped,
+	}, recordInfo)
+}
+
+// Close writes out whatever is left of the body, finishing the record.
+func (w *entryWriter) Close() error {
+	if w.archive.entry == w {
+		w.archive.entry = nil
+	}
+	if w.err != nil {
+		w.discard()
+		return w.err
+	}
+	w.err = ErrEntryClosed
+
+	chunk, held := w.chunk, w.held
+	w.chunk, w.held = nil, nil
+	if held != nil && chunk.Len() == 0 {
+		chunk.Close()
+		return w.emit(held, false)
+	}
+	if held != nil {
+		if err := w.emit(held, true); err != nil {
+			chunk.Close()
+			return err
+		}
+	}
+	return w.emit(chunk, false)
+}
@@ -0,0 +1,127 @@
+package writer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/indrora/ponzu/ponzu/reader"
+)
+
+func TestCreate(t *testing.T) {
+	testCases := []struct {
+		size     int
+		streamed bool
+		records  int // file record and continuations
+	}{
+		{0, false, 1},
+		{100, false, 1},
+		{2 * int(format.BLOCK_SIZE), false, 2},
+		{2*int(format.BLOCK_SIZE) + 1, false, 3},
+		{0, true, 1},
+		{int(format.BLOCK_SIZE), true, 2},
+		{2*int(format.BLOCK_SIZE) + 1, true, 3},
+	}
+
+	for _, tc := range testCases {
+		buff := new(bytes.Buffer)
+		w := NewWriter(buff, 2*format.BLOCK_SIZE)
+		w.Streamed = tc.streamed
+
+		data := make([]byte, tc.size)
+		rand.Read(data)
+
+		w.AppendStart("", "")
+		entry, err := w.Create(format.File{Name: "dump.sql", ModTime: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Create(format.File{Name: "other"}); err != ErrEntryOpen {
+			t.Errorf("expected a second entry to be refused, got %v", err)
+		}
+		others := map[string]func() error{
+			"AppendBytes": func() error {
+				return w.AppendBytes(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.File{Name: "other"}, nil)
+			},
+			"AppendZstdDict": func() error { return w.AppendZstdDict([]byte("dictionary")) },
+			"AppendEnd":      w.AppendEnd,
+		}
+		for name, appendOther := range others {
+			if err = appendOther(); err != ErrEntryOpen {
+				t.Errorf("expected %v to be refused while an entry is open, got %v", name, err)
+			}
+		}
+		// Dribble it in, as a pipe would.
+		for p := data; len(p) > 0; {
+			n := rand.Intn(1000) + 1
+			if n > len(p) {
+				n = len(p)
+			}
+			entry.Write(p[:n])
+			p = p[n:]
+		}
+		if err = entry.Close(); err != nil {
+			t.Fatal(err)
+		}
+		w.AppendEnd()
+		w.Close()
+
+		archive := buff.Bytes()
+		r := reader.NewReader(bytes.NewReader(archive))
+		start, _, _ := r.Next()
+		if streamed := start.Flags&format.RECORD_FLAG_CONTROL_STREAMED != 0; streamed != tc.streamed {
+			t.Errorf("expected streamed to be %v", tc.streamed)
+		}
+		r.Next()
+		out := new(bytes.Buffer)
+		if err = r.CopyAll(out, true); err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), data) {
+			t.Errorf("size %d, streamed %v: round trip failed, got %d bytes", tc.size, tc.streamed, out.Len())
+		}
+
+		// Count the records between the start and end of archive.
+		records := 0
+		for sr := reader.NewReader(bytes.NewReader(archive)); ; records++ {
+			p, _, err := sr.Next()
+			if err != nil || p.IsEndOfArchive() {
+				break
+			}
+		}
+		if records-1 != tc.records {
+			t.Errorf("size %d, streamed %v: expected %d records, got %d", tc.size, tc.streamed, tc.records, records-1)
+		}
+	}
+}
+
+func TestAppendStreamFailure(t *testing.T) {
+	errBroken := errors.New("broken")
+	for _, streamed := range []bool{false, true} {
+		buff := new(bytes.Buffer)
+		w := NewWriter(buff, 2*format.BLOCK_SIZE)
+		w.Streamed = streamed
+		w.AppendStart("", "")
+
+		stream := io.MultiReader(io.LimitReader(rand.New(rand.NewSource(1)), 20000), iotest.ErrReader(errBroken))
+		err := w.AppendStream(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.File{Name: "broken", ModTime: time.Now()}, stream)
+		if !errors.Is(err, errBroken) {
+			t.Errorf("streamed %v: expected the read error, got %v", streamed, err)
+		}
+
+		// The archive carries on, but the file that was cut short can't pass for whole.
+		if err = w.AppendBytes(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.File{Name: "after", ModTime: time.Now()}, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		w.AppendEnd()
+		w.Close()
+		if reader.NewReader(bytes.NewReader(buff.Bytes())).Verify().Ok {
+			t.Errorf("streamed %v: expected the archive to fail verification", streamed)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package writer
+
+import (
+	"io"
+
+	"github.com/indrora/ponzu/ponzu/format"
+	"github.com/indrora/ponzu/ponzu/parity"
+	"github.com/pkg/errors"
+)
+
+// DefaultParityShards is how many parity blocks each stripe gets when ParityShards is
+// not set.
+const DefaultParityShards = 4
+
+var ErrParity = errors.New("parity records would cover fewer blocks than they take up")
+
+// parityTee passes what is written on to the archive, and once parity is started,
+// works out the parity of each run of blocks as it goes by.
+type parityTee struct {
+	out io.Writer
+
+	run     *parity.Encoder
+	start   uint64 // block number the run starts on
+	written uint64 // bytes of the run written so far
+	blocks  uint64 // how many blocks go in a run
+	shards  int
+	// Runs that are complete, waiting for their parity records
+	done []parityRun
+}
+
+type parityRun struct {
+	run   *parity.Encoder
+	start uint64
+}
+
+func (tee *parityTee) Write(p []byte) (int, error) {
+	n, err := tee.out.Write(p)
+	for rest := p[:n]; tee.run != nil && len(rest) > 0; {
+		chunk := rest
+		if room := tee.blocks*format.BLOCK_SIZE - tee.written; uint64(len(chunk)) > room {
+			chunk = chunk[:room]
+		}
+		tee.run.Write(chunk)
+		tee.written += uint64(len(chunk))
+		rest = rest[len(chunk):]
+		if tee.written == tee.blocks*format.BLOCK_SIZE {
+			tee.finish()
+		}
+	}
+	return n, err
+}
+
+func (tee *parityTee) Close() error {
+	if closer, ok := tee.out.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// begin starts working out parity from the given block on, in runs of so many blocks.
+func (tee *parityTee) begin(block uint64, blocks int, shards int) error {
+	if shards <= 0 {
+		shards = DefaultParityShards
+	}
+	if shards > parity.MaxShards {
+		return parity.ErrShards
+	}
+	// Each run is followed by a parity record, which has to fit in the next run.
+	if 1+parity.Stripes(blocks, shards)*shards >= blocks {
+		return ErrParity
+	}
+	tee.start, tee.blocks, tee.shards = block, uint64(blocks), shards
+	return tee.next()
+}
+
+// next starts a run where the last one finished.
+func (tee *parityTee) next() error {
+	run, err := parity.NewEncoder(int(tee.blocks), tee.shards)
+	tee.run, tee.written = run, 0
+	return err
+}
+
+// finish ends the current run, if it has anything in it, and starts the next.
+func (tee *parityTee) finish() {
+	if tee.run == nil || tee.written == 0 {
+		return
+	}
+	tee.done = append(tee.done, parityRun{run: tee.run, start: tee.start})
+	tee.start += tee.written / format.BLOCK_SIZE
+	tee.next()
+}
+
+// writeParity writes a parity record for each run of blocks that is complete. It is
+// called after each record is written, as parity records can only go between them.
+func (archive *ArchiveWriter) writeParity() error {
+	if archive.writingParity {
+		return nil
+	}
+	archive.writingParity = true
+	defer func() { archive.writingParity = false }()
+
+	tee := archive.tee
+	for len(tee.done) > 0 {
+		done := tee.done[0]
+		tee.done = tee.done[1:]
+
+		rec := &record{
+			rtype:       format.RECORD_TYPE_PARITY,
+			flags:       format.RECORD_FLAG_NONE,
+			compression: format.COMPRESSION_NONE,
+			data:        done.run.Parity(),
+		}
+		meta := format.Parity{
+			Algorithm: format.PARITY_REED_SOLOMON,
+			Before:    archive.currentBlock() - done.start,
+			Blocks:    uint64(done.run.Blocks()),
+			Stripes:   uint32(done.run.Stripes()),
+			Shards:    uint8(tee.shards),
+		}
+		if err := archive.prepare(rec, meta); err != nil {
+			return err
+		}
+		rec.compress()
+		if err := archive.writeRecord(rec); err != nil {
+			return errors.Wrap(err, "failed to write parity")
+		}
+	}
+	return nil
+}
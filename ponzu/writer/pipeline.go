@@ -0,0 +1,223 @@
+package writer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/indrora/ponzu/ponzu/compression"
+	"github.com/indrora/ponzu/ponzu/encryption"
+	"github.com/indrora/ponzu/ponzu/format"
+)
+
+// record is a record on its way into the archive, waiting for its body to be
+// compressed.
+type record struct {
+	rtype       format.RecordType
+	flags       format.RecordFlags
+	compression format.CompressionType
+	options     CompressionOptions
+	metadata    []byte
+	dict        []byte
+	// The body is in data, or for bodies written bit by bit, in body.
+	data []byte
+	body *spool
+	// The key to encrypt the record with, if it is encrypted, and the ID that ties its
+	// body to its metadata
+	key *encryption.Key
+	id  []byte
+
+	// Records with a name go in the index.
+	name  string
+	named bool
+	// The name of the entry this record is part of, for reporting
+	entry string
+
+	// Whether to store the body uncompressed if compressing it does not save anything,
+	// and why it was, if it was.
+	skip    bool
+	skipped string
+
+	done chan struct{}
+	err  error
+}
+
+// compress replaces the body of the record with its compressed form, encrypted if the
+// record is to be.
+func (rec *record) compress() {
+	if rec.body != nil {
+		rec.compressBody()
+	} else {
+		rec.compressData()
+	}
+	if rec.err == nil && rec.key != nil {
+		rec.encrypt()
+	}
+}
+
+// compressData is compress for a body held in data.
+func (rec *record) compressData() {
+	if rec.data == nil || rec.compression == format.COMPRESSION_NONE {
+		return
+	}
+
+	compressed, err := compression.Compress(rec.data, rec.compression, rec.options, rec.dict)
+	if err != nil {
+		rec.err = err
+		return
+	}
+	if rec.skip && blocks(int64(len(compressed))) >= blocks(int64(len(rec.data))) {
+		rec.compression = format.COMPRESSION_NONE
+		rec.skipped = fmt.Sprintf("compressing %d bytes to %d saves no blocks", len(rec.data), len(compressed))
+		return
+	}
+	rec.data = compressed
+}
+
+// compressBody is compress for a body in a spool, which is compressed into another.
+func (rec *record) compressBody() {
+	if rec.compression == format.COMPRESSION_NONE {
+		return
+	}
+
+	out := newSpool(rec.body.limit, rec.body.dir)
+	encoder, err := compression.NewWriter(out, rec.compression, rec.options, rec.dict)
+	if err == nil {
+		_, err = io.Copy(encoder, rec.body.Reader())
+		if cerr := encoder.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		out.Close()
+		rec.err = err
+		return
+	}
+	if rec.skip && blocks(out.Len()) >= blocks(rec.body.Len()) {
+		out.Close()
+		rec.compression = format.COMPRESSION_NONE
+		rec.skipped = fmt.Sprintf("compressing %d bytes to %d saves no blocks", rec.body.Len(), out.Len())
+		return
+	}
+	rec.body.Close()
+	rec.body = out
+}
+
+// encrypt replaces the compressed body of the record with its encrypted form.
+func (rec *record) encrypt() {
+	if rec.body == nil {
+		if rec.data != nil {
+			rec.data, rec.err = rec.key.Seal(rec.data, rec.id, rec.rtype, rec.compression)
+		}
+		return
+	}
+
+	out := newSpool(rec.body.limit, rec.body.dir)
+	sealer := rec.key.NewWriter(out, rec.id, rec.rtype, rec.compression)
+	_, err := io.Copy(sealer, rec.body.Reader())
+	if cerr := sealer.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		out.Close()
+		rec.err = err
+		return
+	}
+	rec.body.Close()
+	rec.body = out
+}
+
+// release throws away the record's body, if it is in a spool.
+func (rec *record) release() {
+	if rec.body != nil {
+		rec.body.Close()
+		rec.body = nil
+	}
+}
+
+// blocks is how many blocks a body of n bytes takes up.
+func blocks(n int64) int64 {
+	return (n + int64(format.BLOCK_SIZE) - 1) / int64(format.BLOCK_SIZE)
+}
+
+// pipeline compresses records on a pool of goroutines and writes them out in the
+// order they were queued.
+type pipeline struct {
+	queue   chan *record
+	slots   chan struct{}
+	written chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+// enqueue hands a record to the pipeline, starting it if need be. The first error the
+// pipeline ran into is returned, and the record is dropped.
+func (archive *ArchiveWriter) enqueue(rec *record) error {
+	if archive.pipe == nil {
+		archive.pipe = &pipeline{
+			queue:   make(chan *record, archive.Jobs),
+			slots:   make(chan struct{}, archive.Jobs),
+			written: make(chan struct{}),
+		}
+		go archive.writeLoop(archive.pipe)
+	}
+	pipe := archive.pipe
+	if err := pipe.failed(); err != nil {
+		rec.release()
+		return err
+	}
+
+	// The caller may reuse data as soon as we return.
+	if rec.data != nil {
+		rec.data = bytes.Clone(rec.data)
+	}
+	rec.done = make(chan struct{})
+
+	pipe.slots <- struct{}{}
+	go func() {
+		rec.compress()
+		<-pipe.slots
+		close(rec.done)
+	}()
+	pipe.queue <- rec
+	return nil
+}
+
+// writeLoop writes records out as they finish compressing, in the order they were
+// queued. Once anything has failed, the rest are dropped.
+func (archive *ArchiveWriter) writeLoop(pipe *pipeline) {
+	defer close(pipe.written)
+	for rec := range pipe.queue {
+		<-rec.done
+		if pipe.failed() != nil {
+			rec.release()
+			continue
+		}
+		if err := archive.writeRecord(rec); err != nil {
+			pipe.mu.Lock()
+			pipe.err = err
+			pipe.mu.Unlock()
+		}
+	}
+}
+
+func (pipe *pipeline) failed() error {
+	pipe.mu.Lock()
+	defer pipe.mu.Unlock()
+	return pipe.err
+}
+
+// flush waits for everything queued to be written out, returning the first error the
+// pipeline ran into. Anything that looks at where the archive is up to must flush first.
+func (archive *ArchiveWriter) flush() error {
+	pipe := archive.pipe
+	if pipe == nil {
+		return nil
+	}
+	archive.pipe = nil
+	close(pipe.queue)
+	<-pipe.written
+	return pipe.err
+}
@@ -0,0 +1,43 @@
+package writer
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/indrora/ponzu/ponzu/format"
+)
+
+// Compressing on several goroutines must not change a single byte of the archive.
+func TestJobs(t *testing.T) {
+	build := func(jobs int) []byte {
+		buff := new(bytes.Buffer)
+		setup := func(w *ArchiveWriter) {
+			w.WriteIndex = true
+			w.Jobs = jobs
+		}
+		buildArchive(t, buff, 4, setup, func(w *ArchiveWriter) error {
+			rng := rand.New(rand.NewSource(1))
+			for i := 0; i < 20; i++ {
+				data := make([]byte, rng.Intn(6*int(format.BLOCK_SIZE)))
+				// half random, half zeroes, so that there is something to compress
+				rng.Read(data[:len(data)/2])
+				meta := format.File{Name: fmt.Sprintf("file%02d", i), ModTime: time.Unix(0, 0)}
+				if err := w.AppendStream(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, format.COMPRESSION_ZSTD, meta, bytes.NewReader(data)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		return buff.Bytes()
+	}
+
+	serial := build(1)
+	for _, jobs := range []int{2, 8} {
+		if parallel := build(jobs); !bytes.Equal(serial, parallel) {
+			t.Errorf("archive written with %d jobs differs from the serial one", jobs)
+		}
+	}
+}
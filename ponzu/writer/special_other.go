@@ -0,0 +1,11 @@
+//go:build !unix
+
+package writer
+
+import "io/fs"
+
+// deviceNumbers gets the mknod mode and device number of a special file.
+// There's no such thing as mknod on this host.
+func deviceNumbers(info fs.FileInfo) (uint32, uint32, error) {
+	return 0, 0, ErrNotSpecial
+}
@@ -0,0 +1,32 @@
+//go:build unix
+
+package writer
+
+import (
+	"io/fs"
+	"math"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// deviceNumbers gets the mknod mode and device number of a special file.
+func deviceNumbers(info fs.FileInfo) (uint32, uint32, error) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, ErrNotSpecial
+	}
+
+	mode := uint32(stat.Mode)
+	switch mode & unix.S_IFMT {
+	case unix.S_IFIFO, unix.S_IFSOCK:
+		return mode, 0, nil
+	case unix.S_IFCHR, unix.S_IFBLK:
+		if uint64(stat.Rdev) > math.MaxUint32 {
+			return 0, 0, ErrDeviceNumber
+		}
+		return mode, uint32(stat.Rdev), nil
+	default:
+		return 0, 0, ErrNotSpecial
+	}
+}
@@ -0,0 +1,41 @@
+//go:build unix
+
+package writer
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestAppendSpecial(t *testing.T) {
+	dir := t.TempDir()
+	fifo, regular := filepath.Join(dir, "fifo"), filepath.Join(dir, "regular")
+	if err := unix.Mkfifo(fifo, 0640); err != nil {
+		t.Skip("can't make a FIFO here:", err)
+	}
+	os.WriteFile(regular, []byte("hello"), 0644)
+
+	writer := NewWriter(new(bytes.Buffer), 0)
+
+	info, _ := os.Lstat(fifo)
+	mode, dev, err := deviceNumbers(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode&unix.S_IFMT != unix.S_IFIFO || mode&0777 != 0640 || dev != 0 {
+		t.Errorf("unexpected mode %o and device %v for a FIFO", mode, dev)
+	}
+	if err = writer.AppendSpecial("fifo", fifo, info); err != nil {
+		t.Fatal(err)
+	}
+
+	info, _ = os.Lstat(regular)
+	if err = writer.AppendSpecial("regular", regular, info); !errors.Is(err, ErrNotSpecial) {
+		t.Errorf("expected a regular file to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package writer
+
+import (
+	"bytes"
+	"hash"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// DefaultSpoolSize is how much of a body is kept in memory, if SpoolSize is not set.
+const DefaultSpoolSize = 4 * 1024 * 1024
+
+// spool holds a body on its way into the archive: in memory up to its limit, and in a
+// temporary file past that. It keeps a running checksum of everything written to it, so
+// that the body's preamble can be written before the body is read back.
+type spool struct {
+	limit int
+	dir   string
+
+	mem  []byte
+	file *os.File
+	size int64
+	hash hash.Hash
+}
+
+func newSpool(limit int, dir string) *spool {
+	hash, _ := blake2b.New512(nil)
+	return &spool{limit: limit, dir: dir, hash: hash}
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	s.hash.Write(p)
+	n := 0
+	if s.file == nil {
+		n = len(p)
+		if room := s.limit - len(s.mem); n > room {
+			n = room
+		}
+		s.mem = append(s.mem, p[:n]...)
+		s.size += int64(n)
+		if n == len(p) {
+			return n, nil
+		}
+
+		file, err := os.CreateTemp(s.dir, "ponzu-spool-*")
+		if err != nil {
+			return n, err
+		}
+		s.file = file
+	}
+
+	m, err := s.file.Write(p[n:])
+	s.size += int64(m)
+	return n + m, err
+}
+
+// Len is how many bytes have been written to the spool.
+func (s *spool) Len() int64 {
+	return s.size
+}
+
+// Sum is the BLAKE2b-512 checksum of everything written to the spool.
+func (s *spool) Sum() []byte {
+	return s.hash.Sum(nil)
+}
+
+func (s *spool) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	if off < int64(len(s.mem)) {
+		n = copy(p, s.mem[off:])
+		if n == len(p) {
+			return n, nil
+		}
+	}
+	if s.file == nil {
+		return n, io.EOF
+	}
+	m, err := s.file.ReadAt(p[n:], off+int64(n)-int64(len(s.mem)))
+	return n + m, err
+}
+
+// Reader reads back everything written to the spool.
+func (s *spool) Reader() io.Reader {
+	if s.file == nil {
+		return bytes.NewReader(s.mem)
+	}
+	return io.NewSectionReader(s, 0, s.size)
+}
+
+// Close throws away whatever the spool holds.
+func (s *spool) Close() error {
+	s.mem = nil
+	if s.file == nil {
+		return nil
+	}
+	name := s.file.Name()
+	s.file.Close()
+	s.file = nil
+	return os.Remove(name)
+}
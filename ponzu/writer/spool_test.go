@@ -0,0 +1,95 @@
+package writer
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/indrora/ponzu/ponzu/format"
+	"golang.org/x/crypto/blake2b"
+)
+
+func TestSpool(t *testing.T) {
+	data := make([]byte, 10000)
+	rand.Read(data)
+
+	for _, limit := range []int{0, 100, 4096, 20000} {
+		s := newSpool(limit, t.TempDir())
+		for p := data; len(p) > 0; {
+			n := rand.Intn(1000) + 1
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err := s.Write(p[:n]); err != nil {
+				t.Fatal(err)
+			}
+			p = p[n:]
+		}
+
+		if s.Len() != int64(len(data)) {
+			t.Errorf("limit %d: expected %d bytes, got %d", limit, len(data), s.Len())
+		}
+		if spilled := s.file != nil; spilled != (limit < len(data)) {
+			t.Errorf("limit %d: spilled to a file is %v", limit, spilled)
+		}
+		if sum := blake2b.Sum512(data); !bytes.Equal(s.Sum(), sum[:]) {
+			t.Errorf("limit %d: checksum does not match", limit)
+		}
+		out, err := io.ReadAll(s.Reader())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("limit %d: read back something else", limit)
+		}
+
+		// Across where the memory ends and the file starts
+		part := make([]byte, 50)
+		if n, err := s.ReadAt(part, 75); err != nil || !bytes.Equal(part[:n], data[75:125]) {
+			t.Errorf("limit %d: ReadAt got %d bytes, %v", limit, n, err)
+		}
+
+		var name string
+		if s.file != nil {
+			name = s.file.Name()
+		}
+		s.Close()
+		if name != "" {
+			if _, err := os.Stat(name); !os.IsNotExist(err) {
+				t.Errorf("limit %d: temporary file left behind", limit)
+			}
+		}
+	}
+}
+
+func TestSpoolSize(t *testing.T) {
+	data := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog "), 20000)
+
+	build := func(spoolSize int, dir string) []byte {
+		buff := new(bytes.Buffer)
+		setup := func(w *ArchiveWriter) {
+			w.SpoolSize = spoolSize
+			w.SpoolDir = dir
+		}
+		buildArchive(t, buff, 64, setup, func(w *ArchiveWriter) error {
+			entry, err := w.Create(format.File{Name: "fox"})
+			if err != nil {
+				return err
+			}
+			entry.Write(data)
+			return entry.Close()
+		})
+		return buff.Bytes()
+	}
+
+	// Spooling through a file makes no difference to the archive.
+	dir := t.TempDir()
+	if !bytes.Equal(build(100, dir), build(0, "")) {
+		t.Error("archives differ")
+	}
+	if left, _ := os.ReadDir(dir); len(left) != 0 {
+		t.Errorf("%d temporary files left behind", len(left))
+	}
+}
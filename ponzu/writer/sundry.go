@@ -6,24 +6,33 @@ import (
 	"github.com/indrora/ponzu/ponzu/format"
 )
 
-func (archive *ArchiveWriter) AppendDirectory(path string, info fs.FileInfo) error {
+func (archive *ArchiveWriter) AppendDirectory(path string, source string, info fs.FileInfo) error {
+	meta, err := archive.fileMetadata(source, info)
+	if err != nil {
+		return err
+	}
 
-	err := archive.AppendBytes(format.RECORD_TYPE_DIRECTORY, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.Directory{
+	err = archive.AppendBytes(format.RECORD_TYPE_DIRECTORY, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.Directory{
 		File: format.File{Name: path,
 			ModTime:  info.ModTime(),
-			Metadata: map[string]any{},
+			Metadata: meta,
 		},
 	}, nil)
 
 	return err
 }
 
-func (archive *ArchiveWriter) AppendSymlink(path string, destination string, info fs.FileInfo) error {
-	err := archive.AppendBytes(format.RECORD_TYPE_DIRECTORY, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.Symlink{
+func (archive *ArchiveWriter) AppendSymlink(path string, source string, destination string, info fs.FileInfo) error {
+	meta, err := archive.fileMetadata(source, info)
+	if err != nil {
+		return err
+	}
+
+	err = archive.AppendBytes(format.RECORD_TYPE_SYMLINK, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.Symlink{
 		Link: format.Link{
 			File: format.File{Name: path,
 				ModTime:  info.ModTime(),
-				Metadata: map[string]any{},
+				Metadata: meta,
 			},
 			Target: destination,
 		},
@@ -32,3 +41,45 @@ func (archive *ArchiveWriter) AppendSymlink(path string, destination string, inf
 	return err
 
 }
+
+// AppendHardlink adds a hardlink to a file that has already been added to the archive.
+// The target is the name of that file in the archive.
+func (archive *ArchiveWriter) AppendHardlink(path string, source string, target string, info fs.FileInfo) error {
+	meta, err := archive.fileMetadata(source, info)
+	if err != nil {
+		return err
+	}
+
+	return archive.AppendBytes(format.RECORD_TYPE_HARDLINK, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.Hardlink{
+		Link: format.Link{
+			File: format.File{Name: path,
+				ModTime:  info.ModTime(),
+				Metadata: meta,
+			},
+			Target: target,
+		},
+	}, nil)
+}
+
+// AppendSpecial adds a FIFO, socket or device node to the archive, as something that
+// mknod can recreate.
+func (archive *ArchiveWriter) AppendSpecial(path string, source string, info fs.FileInfo) error {
+	mode, dev, err := deviceNumbers(info)
+	if err != nil {
+		return err
+	}
+	meta, err := archive.fileMetadata(source, info)
+	if err != nil {
+		return err
+	}
+
+	return archive.AppendBytes(format.RECORD_TYPE_OS_SPECIAL, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, format.OSSpecial{
+		File: format.File{Name: path,
+			ModTime:  info.ModTime(),
+			Metadata: meta,
+		},
+		SpecialType: format.SPECIAL_TYPE_MKNOD,
+		Mode:        mode,
+		Device:      dev,
+	}, nil)
+}
@@ -2,21 +2,27 @@ package writer
 
 import (
 	"bytes"
+	"crypto/ecdh"
+	"hash"
 	"io"
 	"io/fs"
 	"os"
 
 	"github.com/fxamacker/cbor/v2"
+	"github.com/indrora/ponzu/ponzu/encryption"
 	"github.com/indrora/ponzu/ponzu/format"
 	"github.com/indrora/ponzu/ponzu/format/metadata"
-	"github.com/indrora/ponzu/ponzu/ioutil"
 	pio "github.com/indrora/ponzu/ponzu/ioutil"
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/ed25519"
 )
 
 var (
 	ErrMisalignedWrite = errors.New("unexpected number of bytes written")
+	ErrNotSpecial      = errors.New("not a FIFO, socket or device node")
+	ErrDeviceNumber    = errors.New("device number does not fit in an archive")
+	ErrNotStarted      = errors.New("no archive has been started")
 )
 
 type ArchiveWriter struct {
@@ -25,46 +31,342 @@ type ArchiveWriter struct {
 	cHeader       *format.StartOfArchive
 	MaxReadBuffer uint64
 	zstdDict      []byte
+
+	// Compression is used for bodies written through Create.
+	Compression format.CompressionType
+	// CompressionOptions tune the compression of everything appended while they are
+	// set, whichever way it is compressed.
+	CompressionOptions CompressionOptions
+
+	// SkipIncompressible stores bodies uncompressed when compressing them is not worth
+	// it. The start of each entry is given a quick trial compression first, and if that
+	// barely shrinks it, none of the entry is compressed. Past that, any record that
+	// does not come out at least a block smaller is stored as it is.
+	SkipIncompressible bool
+	// Uncompressed, if set, is told about each record stored uncompressed by
+	// SkipIncompressible: the name of the entry it is part of and why. It is called in
+	// the order records are written, and with Jobs set, from another goroutine.
+	Uncompressed func(name string, reason string)
+
+	// Streamed archives are marked as such in their start of archive record, and
+	// write bodies out as soon as each chunk of one is ready, rather than holding
+	// one chunk back. This suits writing to a socket or pipe that someone is
+	// reading from as the archive is made.
+	Streamed bool
+	entry    io.WriteCloser
+
+	// Host is written to the start of each archive, and says what sort of metadata
+	// the records have. It defaults to this host; set it to format.HOST_OS_GENERIC to
+	// leave out everything but the common metadata.
+	Host string
+
+	// WriteIndex adds an index record to the end of each archive, so that readers
+	// with random access can go straight to a record instead of scanning for it.
+	// Block numbers in the index count from the first byte given to this writer.
+	WriteIndex   bool
+	index        []format.IndexEntry
+	dictionaries []uint64
+
+	// Jobs is how many records may be compressed at once. Records are still written
+	// out in the order they were appended. Up to 1, everything is done in the caller.
+	Jobs int
+	pipe *pipeline
+
+	// SpoolSize is how much of each body written through Create or AppendStream is kept
+	// in memory on its way into the archive; the rest goes to a temporary file in
+	// SpoolDir, or the default directory for temporary files if that is empty. Up to
+	// 0, DefaultSpoolSize is used.
+	SpoolSize int
+	SpoolDir  string
+
+	// Backpatch writes bodies from Create and AppendStream straight into the archive as
+	// they are compressed, then goes back to fill in their preambles, instead of
+	// spooling them. NewWriter turns it on when the archive can be seeked in, which
+	// must not then be opened for appending. It is not used with Jobs, Parity or in
+	// streamed archives, and records written this way are only stored uncompressed by
+	// SkipIncompressible if the trial compression of the entry says so.
+	//
+	// If writing a body this way fails, the archive is truncated back to before the
+	// records that were left unfinished. Where it can't be, nothing more can be
+	// appended.
+	Backpatch bool
+	seeker    io.WriteSeeker
+	base      int64 // where in seeker the archive starts
+	failed    error
+
+	// SignKey, if set, signs each archive: AppendEnd adds a signature record covering
+	// everything in the archive before it.
+	SignKey ed25519.PrivateKey
+	// Digest of the preambles of the records written since the start of the archive
+	chain hash.Hash
+	// Merkle tree of the records written since the start of the archive, and their
+	// data blocks, for the end of archive
+	tree       *pio.MerkleTree
+	dataBlocks uint64
+
+	// Passphrase and Recipients, if either is set, encrypt each archive started with
+	// them: the metadata and body of every record but the control and signature records
+	// are sealed with a new key, which anyone with the passphrase or the private key of
+	// one of the recipients can unwrap.
+	Passphrase []byte
+	Recipients []*ecdh.PublicKey
+	key        *encryption.Key
+
+	// Parity, if above 0, adds a parity record after every so many blocks of the
+	// archive, from which damaged blocks can be rebuilt. Each run of blocks is dealt
+	// into stripes of up to 256 - ParityShards blocks, and up to ParityShards damaged
+	// blocks in each stripe can be rebuilt; it defaults to DefaultParityShards. Parity
+	// records go between records, so each comes a little after the run it covers, and
+	// the last parity record and end of archive are left uncovered. Both are to be set
+	// before the first archive is started.
+	Parity        int
+	ParityShards  int
+	tee           *parityTee
+	writingParity bool
 }
 
 func NewWriter(file io.Writer, readBufferSize uint64) *ArchiveWriter {
 
-	return &ArchiveWriter{
+	tee := &parityTee{out: file}
+	archive := &ArchiveWriter{
 		fileio:        file,
-		blockio:       *pio.NewBlockWriter(file, format.BLOCK_SIZE),
+		blockio:       *pio.NewBlockWriter(tee, format.BLOCK_SIZE),
+		tee:           tee,
 		cHeader:       nil,
 		MaxReadBuffer: readBufferSize,
 		zstdDict:      nil,
+		Compression:   format.COMPRESSION_ZSTD,
+		Host:          metadata.Host,
+	}
+
+	// Pipes are files too, but can't be seeked in.
+	if seeker, ok := file.(io.WriteSeeker); ok {
+		if base, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			archive.seeker, archive.base = seeker, base
+			archive.Backpatch = true
+		}
 	}
 
+	return archive
 }
 
 func (archive *ArchiveWriter) AppendStart(prefix string, comment string) error {
+	if err := archive.ready(); err != nil {
+		return err
+	}
 	// write the initial header to the file.
 
 	// This is the CBOR portion.
 	archiveHeader := format.StartOfArchive{
 		Version: format.PONZU_VERSION,
-		Host:    format.HOST_OS_GENERIC,
+		Host:    archive.Host,
 		Prefix:  prefix,
 		Comment: comment,
 	}
 
-	return archive.AppendBytes(format.RECORD_TYPE_CONTROL, format.RECORD_FLAG_CONTROL_START, format.COMPRESSION_NONE, archiveHeader, nil)
+	if err := archive.startArchive(); err != nil {
+		return err
+	}
+	if archive.Passphrase != nil || len(archive.Recipients) > 0 {
+		key, enc, err := encryption.NewKey(archive.Passphrase, archive.Recipients)
+		if err != nil {
+			return errors.Wrap(err, "failed to make a key for the archive")
+		}
+		archiveHeader.Encryption = enc
+		archive.key = key
+	}
+
+	flags := format.RECORD_FLAG_CONTROL_START
+	if archive.Streamed {
+		flags |= format.RECORD_FLAG_CONTROL_STREAMED
+	}
+
+	return archive.AppendBytes(format.RECORD_TYPE_CONTROL, flags, format.COMPRESSION_NONE, archiveHeader, nil)
+}
+
+// ready is whether anything can be appended: not while an entry is open, nor once a
+// record has been left unfinished in the archive.
+func (archive *ArchiveWriter) ready() error {
+	if archive.failed != nil {
+		return archive.failed
+	}
+	if archive.entry != nil {
+		return ErrEntryOpen
+	}
+	return nil
+}
+
+// startArchive finishes with whatever archive came before, and starts afresh on the
+// index, signature chain and Merkle tree of the next one.
+func (archive *ArchiveWriter) startArchive() error {
+	if err := archive.flush(); err != nil {
+		return err
+	}
+	archive.index = nil
+	archive.dictionaries = nil
+	archive.chain, _ = blake2b.New512(nil)
+	archive.tree, archive.dataBlocks = new(pio.MerkleTree), 0
+	archive.key = nil
+
+	// Parity carries on from one archive into the next.
+	if archive.Parity > 0 && archive.tee.run == nil {
+		return archive.tee.begin(archive.currentBlock(), archive.Parity, archive.ParityShards)
+	}
+	return nil
 }
 
 func (archive *ArchiveWriter) AppendEnd() error {
-	return archive.AppendBytes(format.RECORD_TYPE_CONTROL, format.RECORD_FLAG_CONTROL_END, format.COMPRESSION_NONE, nil, nil)
+	if err := archive.ready(); err != nil {
+		return err
+	}
+	end := format.EndOfArchive{}
+	if archive.WriteIndex {
+		indexBlock, err := archive.appendIndex()
+		if err != nil {
+			return errors.Wrap(err, "failed to write index")
+		}
+		end.Index = indexBlock
+	}
+
+	// Everything before the end has to be written to be counted.
+	if err := archive.flush(); err != nil {
+		return err
+	}
+	archive.tee.finish()
+	if err := archive.writeParity(); err != nil {
+		return err
+	}
+	// The signature goes last, so that nothing but the end of archive comes after it.
+	if archive.SignKey != nil {
+		if err := archive.AppendSignature(archive.SignKey, nil); err != nil {
+			return errors.Wrap(err, "failed to sign archive")
+		}
+	}
+	if archive.tree != nil {
+		end.Records = archive.tree.Len()
+		end.DataBlocks = archive.dataBlocks
+		end.MerkleRoot = archive.tree.Root()
+	}
+
+	if err := archive.AppendBytes(format.RECORD_TYPE_CONTROL, format.RECORD_FLAG_CONTROL_END, format.COMPRESSION_NONE, end, nil); err != nil {
+		return err
+	}
+	// Everything in the archive is on its way out by the end of it.
+	return archive.flush()
+}
+
+// appendIndex writes an index of everything appended since the start of the archive,
+// returning the block number the index record starts on.
+func (archive *ArchiveWriter) appendIndex() (uint64, error) {
+	if err := archive.flush(); err != nil {
+		return 0, err
+	}
+	body, err := cbor.Marshal(format.Index{
+		Entries:      archive.index,
+		Dictionaries: archive.dictionaries,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	block := archive.currentBlock()
+	return block, archive.AppendBytes(format.RECORD_TYPE_INDEX, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, nil, body)
+}
+
+// newSpool makes a spool to hold a body in.
+func (archive *ArchiveWriter) newSpool() *spool {
+	size := archive.SpoolSize
+	if size <= 0 {
+		size = DefaultSpoolSize
+	}
+	return newSpool(size, archive.SpoolDir)
+}
+
+// AppendSignature signs the archive so far with an Ed25519 key. The signature covers the
+// preambles of every record since the start of the archive, which hold the checksums of
+// their metadata and bodies.
+//
+// digest is what to sign, from Reader.SignedDigest, when signing an archive that this
+// writer did not write; given nil, the digest of what has been written is signed.
+func (archive *ArchiveWriter) AppendSignature(key ed25519.PrivateKey, digest []byte) error {
+	if err := archive.ready(); err != nil {
+		return err
+	}
+	if digest == nil {
+		if err := archive.flush(); err != nil {
+			return err
+		}
+		if archive.chain == nil {
+			return ErrNotStarted
+		}
+		digest = archive.chain.Sum(nil)
+	}
+
+	signature := format.Signature{
+		Algorithm: format.SIGNATURE_ED25519,
+		PublicKey: key.Public().(ed25519.PublicKey),
+		Signature: ed25519.Sign(key, digest),
+	}
+	return archive.AppendBytes(format.RECORD_TYPE_SIGNATURE, format.RECORD_FLAG_NONE, format.COMPRESSION_NONE, signature, nil)
+}
+
+// addToChain adds the preamble of a record that has been written to the digest of the
+// archive, and to the Merkle tree if it is not a signature or the end of archive.
+func (archive *ArchiveWriter) addToChain(preamble *format.Preamble) {
+	if archive.chain != nil {
+		preamble.WritePreamble(archive.chain)
+	}
+	if archive.tree != nil && preamble.Rtype != format.RECORD_TYPE_SIGNATURE && !preamble.IsEndOfArchive() {
+		archive.tree.Add(preamble.MetadataChecksum[:], preamble.DataChecksum[:])
+		archive.dataBlocks += preamble.DataLen
+	}
+}
+
+// currentBlock is the block number that the next record will start on.
+func (archive *ArchiveWriter) currentBlock() uint64 {
+	return archive.blockio.Offset() / format.BLOCK_SIZE
 }
 
 // AppendBytes adds a raw, uncompressed block of data to the end of the archive.
 // This includes the header and relevant body (`recordInfo`)
+//
+// With Jobs set, the data is compressed (and written) in the background; errors from
+// that turn up in a later call. The data may be reused as soon as AppendBytes returns.
 func (archive *ArchiveWriter) AppendBytes(
 	rtype format.RecordType,
 	flags format.RecordFlags,
 	compression format.CompressionType,
 	recordInfo any,
 	data []byte) error {
+	if err := archive.ready(); err != nil {
+		return err
+	}
+	return archive.appendRecord(&record{
+		rtype:       rtype,
+		flags:       flags,
+		compression: compression,
+		options:     archive.CompressionOptions,
+		skip:        archive.SkipIncompressible,
+		data:        data,
+	}, recordInfo)
+}
+
+// appendRecord fills in the rest of a record and sends it on its way into the archive.
+func (archive *ArchiveWriter) appendRecord(rec *record, recordInfo any) error {
+	if err := archive.prepare(rec, recordInfo); err != nil {
+		rec.release()
+		return err
+	}
+
+	if archive.Jobs > 1 {
+		return archive.enqueue(rec)
+	}
+	rec.compress()
+	return archive.writeRecord(rec)
+}
+
+// prepare fills in the metadata of a record.
+func (archive *ArchiveWriter) prepare(rec *record, recordInfo any) error {
 
 	// Build preamble
 
@@ -84,49 +386,132 @@ func (archive *ArchiveWriter) AppendBytes(
 		cborData = []byte{}
 	}
 
-	metadataChecksum := blake2b.Sum512(cborData)
-	metadataLengh := len(cborData)
-
-	if data != nil {
-		data, err = archive.getCompressedChunk(data, compression)
+	rec.metadata = cborData
+	rec.dict = archive.zstdDict
+	if archive.key != nil && rec.rtype != format.RECORD_TYPE_CONTROL && rec.rtype != format.RECORD_TYPE_SIGNATURE && rec.rtype != format.RECORD_TYPE_PARITY {
+		id, err := encryption.NewID()
 		if err != nil {
-			return errors.Wrap(err, "failed to compress data")
+			return errors.Wrap(err, "failed to make a record ID")
 		}
+		rec.key, rec.id = archive.key, id
+		rec.flags |= format.RECORD_FLAG_ENCRYPTED
+	}
+	if name, ok := format.RecordName(recordInfo); ok && rec.rtype != format.RECORD_TYPE_CONTINUE {
+		rec.name, rec.named = name, true
+		if rec.entry == "" {
+			rec.entry = name
+		}
+	}
+	return nil
+}
+
+// writeRecord writes out a record whose body has been compressed.
+func (archive *ArchiveWriter) writeRecord(rec *record) error {
+	defer rec.release()
+	if rec.err != nil {
+		return errors.Wrap(rec.err, "failed to compress data")
+	}
+	archive.reportSkipped(rec)
+	if err := rec.sealMetadata(); err != nil {
+		return err
+	}
+
+	var body io.Reader
+	var dlen uint64
+	var bodyChecksum []byte
+	if rec.body != nil {
+		body = rec.body.Reader()
+		dlen = uint64(rec.body.Len())
+		bodyChecksum = rec.body.Sum()
 	} else {
-		data = []byte{}
+		// we can safely assume that if there is data, we can get the length of the data.
+		body = bytes.NewReader(rec.data)
+		dlen = uint64(len(rec.data))
+		sum := blake2b.Sum512(rec.data)
+		bodyChecksum = sum[:]
 	}
 
-	// we can safely assume that if there is data, we can get the length of the data.
-	dlen := uint64(0)
-	if data != nil {
-		dlen = uint64(len(data))
+	preamble := rec.preamble(dlen, bodyChecksum)
+	archive.addToChain(preamble)
+	if err := archive.writeHeader(rec, preamble); err != nil {
+		return err
+	}
+	// if we have data, append it here.
+	if dlen > 0 {
+		if _, err := io.Copy(&archive.blockio, body); err != nil {
+			return errors.Wrap(err, "Failed to write block")
+		}
+		if err := archive.blockio.Align(); err != nil {
+			return err
+		}
 	}
 
-	bodyChecksum := blake2b.Sum512(data)
+	return archive.writeParity()
+}
+
+// reportSkipped passes on why a record was stored uncompressed, if it was.
+func (archive *ArchiveWriter) reportSkipped(rec *record) {
+	if rec.skipped != "" && archive.Uncompressed != nil {
+		archive.Uncompressed(rec.entry, rec.skipped)
+	}
+}
 
-	headerbuf := new(bytes.Buffer)
+// writeHeader writes the preamble and metadata of a record.
+func (archive *ArchiveWriter) writeHeader(rec *record, preamble *format.Preamble) error {
+	if rec.named {
+		archive.index = append(archive.index, format.IndexEntry{
+			Name:  rec.name,
+			Block: archive.currentBlock(),
+			Type:  rec.rtype,
+		})
+	}
 
-	preamble := format.NewPreamble(rtype, compression, flags, dlen, bodyChecksum[:], uint16(metadataLengh), metadataChecksum[:])
+	headerbuf := new(bytes.Buffer)
 
 	// Write the preamble out
 	preamble.WritePreamble(headerbuf)
 	// Now write the cbor data to the buffer
-	headerbuf.Write(cborData)
+	headerbuf.Write(rec.metadata)
 
 	// Write the full record header to the block io -- this pads out to the next 4K block.
-	archive.blockio.WriteWhole(headerbuf.Bytes())
-	// if we have data, append it here.
-	if data != nil {
-		archive.blockio.WriteWhole(data)
-	}
+	_, err := archive.blockio.WriteWhole(headerbuf.Bytes())
+	return err
+}
 
+// sealMetadata encrypts the metadata of a record, if it is to be encrypted. This waits
+// until the record is about to be written, as the compression is part of what is
+// sealed and SkipIncompressible may change it. Empty metadata is sealed too, as it
+// carries the ID the body is tied to.
+func (rec *record) sealMetadata() error {
+	if rec.key == nil {
+		return nil
+	}
+	sealed, err := rec.key.SealMetadata(rec.id, rec.metadata, rec.rtype, rec.compression)
+	if err != nil {
+		return errors.Wrap(err, "failed to encrypt metadata")
+	}
+	rec.metadata = sealed
 	return nil
 }
 
+// preamble makes the preamble for a record.
+func (rec *record) preamble(dlen uint64, bodyChecksum []byte) *format.Preamble {
+	metadataChecksum := blake2b.Sum512(rec.metadata)
+	preamble := format.NewPreamble(rec.rtype, rec.compression, rec.flags, dlen, bodyChecksum, uint16(len(rec.metadata)), metadataChecksum[:])
+	return &preamble
+}
+
 func (archive *ArchiveWriter) AppendZstdDict(dictionary []byte) error {
 	// Write a dictionary record to the archive
 	// Set the compression type to ZSTD_DICTIONARY
 
+	if err := archive.ready(); err != nil {
+		return err
+	}
+	if err := archive.flush(); err != nil {
+		return err
+	}
+	block := archive.currentBlock()
 	err := archive.AppendBytes(
 		format.RECORD_TYPE_ZDICTIONARY,
 		format.RECORD_FLAG_NONE,
@@ -138,47 +523,25 @@ func (archive *ArchiveWriter) AppendZstdDict(dictionary []byte) error {
 		return err
 	}
 	archive.zstdDict = dictionary
+	archive.dictionaries = append(archive.dictionaries, block)
 
 	return nil
 }
 
+// AppendStream adds a record with the body read from stream, split over continuation
+// records as needed.
 func (archive *ArchiveWriter) AppendStream(rtype format.RecordType, flags format.RecordFlags, compression format.CompressionType, recordInfo any, stream io.Reader) error {
-
-	chunkReader := ioutil.NewBlockReader(stream, archive.MaxReadBuffer/2)
-
-	// Read at least the first chunk
-
-	chunk, err := chunkReader.ReadBlock()
-
-	if err == io.EOF {
-		// There is only one block, we're cool
-		return archive.AppendBytes(rtype, flags, compression, recordInfo, chunk)
-	} else if err != nil {
-		return errors.Wrap(err, "failed to read block from underlying stream")
-	} else {
-		// Tick on the CONTINUES flag
-		flags |= format.RECORD_FLAG_CONTINUES
-		if err = archive.AppendBytes(rtype, flags, compression, recordInfo, chunk); err != nil {
-			return errors.Wrap(err, "Failed to write first chunk in continue chain")
-		} else {
-			for {
-				chunk, err = chunkReader.ReadBlock()
-				if err != nil && err != io.EOF {
-					return errors.Wrap(err, "failed to read block from underlying stream")
-				} else if err == io.EOF {
-					return archive.AppendBytes(format.RECORD_TYPE_CONTINUE, format.RECORD_FLAG_NONE, compression, nil, chunk)
-				} else {
-					err = archive.AppendBytes(format.RECORD_TYPE_CONTINUE, format.RECORD_FLAG_CONTINUES, compression, nil, chunk)
-					if err != nil {
-						return errors.Wrap(err, "failed to write continuation block.")
-					}
-				}
-
-			}
-		}
-
+	if err := archive.ready(); err != nil {
+		return err
 	}
 
+	entry := archive.newEntry(rtype, flags, compression, recordInfo)
+	if _, err := io.Copy(entry, stream); err != nil {
+		// Closing it would finish off a record that is missing the rest of the body.
+		entry.abort(err)
+		return errors.Wrap(err, "failed to write stream to archive")
+	}
+	return entry.Close()
 }
 
 func (archive *ArchiveWriter) AppendFile(path string, source string, compressionType format.CompressionType, info fs.FileInfo) error {
@@ -188,18 +551,36 @@ func (archive *ArchiveWriter) AppendFile(path string, source string, compression
 	}
 	defer fstream.Close()
 
-	size := uint64(info.Size())
+	fileMeta, err := archive.fileMetadata(source, info)
+	if err != nil {
+		return err
+	}
 	meta := format.File{
-		Name:    path,
-		ModTime: info.ModTime(),
-		Metadata: metadata.CommonMetadata{
-			FileSize: &size,
-		},
+		Name:     path,
+		ModTime:  info.ModTime(),
+		Metadata: fileMeta,
 	}
 
 	return archive.AppendStream(format.RECORD_TYPE_FILE, format.RECORD_FLAG_NONE, compressionType, meta, fstream)
 }
 
+// fileMetadata collects the metadata for a file on disk, as much as the archive's
+// host calls for.
+func (archive *ArchiveWriter) fileMetadata(source string, info fs.FileInfo) (any, error) {
+	if archive.Host != metadata.Host {
+		common := metadata.CommonMetadata{}
+		if info.Mode().IsRegular() {
+			common.FileSize = metadata.MakePointer(uint64(info.Size()))
+		}
+		return common, nil
+	}
+	return metadata.GetMetadata(source, info)
+}
+
 func (archive *ArchiveWriter) Close() error {
+	if err := archive.flush(); err != nil {
+		archive.blockio.Close()
+		return err
+	}
 	return archive.blockio.Close()
 }
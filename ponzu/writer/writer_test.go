@@ -13,6 +13,31 @@ import (
 	"github.com/indrora/ponzu/ponzu/ioutil"
 )
 
+// buildArchive writes an archive to out with a buffer of so many blocks. setup, if
+// given, sets the writer up before the archive starts, and add appends the records
+// that go between the start and end of archive. Any error fails the test. The writer
+// is returned, for what it made of out.
+func buildArchive(t *testing.T, out io.Writer, blocks uint64, setup func(w *ArchiveWriter), add func(w *ArchiveWriter) error) *ArchiveWriter {
+	t.Helper()
+	w := NewWriter(out, blocks*format.BLOCK_SIZE)
+	if setup != nil {
+		setup(w)
+	}
+	if err := w.AppendStart("", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := add(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AppendEnd(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
 func TestWriter(t *testing.T) {
 
 	buffer := new(bytes.Buffer)